@@ -0,0 +1,231 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	runnerv1 "code.gitea.io/actions-proto-go/runner/v1"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	"gitea.com/gitea/act_runner/internal/app/run"
+)
+
+// drainStatus is the response of the drain endpoints of the admin API.
+type drainStatus struct {
+	State string `json:"state"`
+}
+
+// taskLogs is the response of the log endpoint of the admin API.
+type taskLogs struct {
+	Start int       `json:"start"` // Start is the index of the first line.
+	Next  int       `json:"next"`  // Next is the index to get the following lines from.
+	Lines []logLine `json:"lines"`
+}
+
+type logLine struct {
+	Time    time.Time `json:"time"`
+	Content string    `json:"content"`
+}
+
+// defaultLogTail is the number of the last lines returned by the log endpoint if the start index isn't specified.
+const defaultLogTail = 100
+
+// adminHandler returns the handler of the admin API, which drains the runner and shows the running tasks of the instances.
+func adminHandler(d *drainer, instances []*instance) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			d.drain()
+		default:
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+			return
+		}
+		writeJSON(w, drainStatus{State: d.state()})
+	})
+	mux.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+			return
+		}
+		d.resume()
+		writeJSON(w, drainStatus{State: d.state()})
+	})
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+			return
+		}
+		// the config is shared by the instances
+		content, err := yaml.Marshal(instances[0].runner.Config().Redacted())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		_, _ = w.Write(content)
+	})
+	mux.HandleFunc("/tasks", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+			return
+		}
+		tasks := []run.TaskInfo{}
+		for _, in := range instances {
+			tasks = append(tasks, in.runner.Tasks()...)
+		}
+		writeJSON(w, tasks)
+	})
+	mux.HandleFunc("/tasks/", func(w http.ResponseWriter, r *http.Request) {
+		idText, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/tasks/"), "/")
+		id, err := strconv.ParseInt(idText, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("invalid task ID %q", idText))
+			return
+		}
+		switch action {
+		case "cancel":
+			if r.Method != http.MethodPost {
+				writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+				return
+			}
+			for _, in := range instances {
+				if in.runner.CancelTask(id) {
+					log.Infof("task %d is cancelled by the admin API", id)
+					writeJSON(w, struct{}{})
+					return
+				}
+			}
+		case "logs":
+			if r.Method != http.MethodGet {
+				writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+				return
+			}
+			from, tail, err := logRange(r)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			for _, in := range instances {
+				if logs, done, ok := in.runner.TaskLogs(id); ok {
+					if r.URL.Query().Get("follow") == "true" {
+						followLogs(w, r, logs, done, from, tail)
+					} else {
+						writeJSON(w, readLogs(logs, from, tail))
+					}
+					return
+				}
+			}
+		default:
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown path %s", r.URL.Path))
+			return
+		}
+		writeError(w, http.StatusNotFound, fmt.Errorf("task %d is not running", id))
+	})
+	return mux
+}
+
+// readLogs returns the log rows starting at the index from, only the last tail rows are returned if tail isn't -1.
+func readLogs(logs func(from int) ([]*runnerv1.LogRow, int), from, tail int) taskLogs {
+	rows, start := logs(from)
+	if tail >= 0 && len(rows) > tail {
+		start += len(rows) - tail
+		rows = rows[len(rows)-tail:]
+	}
+	ret := taskLogs{Start: start, Next: start + len(rows), Lines: make([]logLine, 0, len(rows))}
+	for _, row := range rows {
+		ret.Lines = append(ret.Lines, logLine{Time: row.Time.AsTime(), Content: row.Content})
+	}
+	return ret
+}
+
+// followLogs streams the logs as a sequence of JSON objects until the task finishes, the last one contains the final logs.
+func followLogs(w http.ResponseWriter, r *http.Request, logs func(from int) ([]*runnerv1.LogRow, int), done <-chan struct{}, from, tail int) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		// the logs are read after checking done, so the final ones are returned
+		finished := false
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		ret := readLogs(logs, from, tail)
+		tail = -1
+		if len(ret.Lines) > 0 || ret.Start > from || finished {
+			writeJSON(w, ret)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if finished {
+			return
+		}
+		from = ret.Next
+		select {
+		case <-r.Context().Done():
+			return
+		case <-done:
+		case <-ticker.C:
+		}
+	}
+}
+
+// logRange returns the start index and the number of the last lines to return from the query of the log endpoint,
+// the last defaultLogTail lines are returned if neither "from" nor "tail" is specified, and tail is -1 if there is no limit.
+func logRange(r *http.Request) (from, tail int, err error) {
+	query := r.URL.Query()
+	if v := query.Get("from"); v != "" {
+		if from, err = strconv.Atoi(v); err != nil {
+			return 0, 0, fmt.Errorf("invalid from %q", v)
+		}
+		return from, -1, nil
+	}
+	tail = defaultLogTail
+	if v := query.Get("tail"); v != "" {
+		if tail, err = strconv.Atoi(v); err != nil || tail < 0 {
+			return 0, 0, fmt.Errorf("invalid tail %q", v)
+		}
+	}
+	return 0, tail, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Debug("failed to write the response of the admin API")
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// listenAdmin listens on the Unix socket of the admin API, which is only accessible by the owner.
+// A socket left by a previous daemon is replaced, but not the one of a running daemon.
+func listenAdmin(socket string) (net.Listener, error) {
+	if conn, err := net.DialTimeout("unix", socket, time.Second); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("another runner is listening on %s", socket)
+	}
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return listenUnix(socket)
+}
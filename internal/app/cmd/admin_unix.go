@@ -0,0 +1,20 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+//go:build !windows
+
+package cmd
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenUnix listens on the Unix socket, which is created only accessible by the owner,
+// so there is no window in which others could connect to it.
+func listenUnix(socket string) (net.Listener, error) {
+	// the umask is process-wide, files created by other goroutines meanwhile are only more restricted
+	old := syscall.Umask(0o177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", socket)
+}
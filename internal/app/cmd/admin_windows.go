@@ -0,0 +1,13 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+//go:build windows
+
+package cmd
+
+import "net"
+
+// listenUnix listens on the Unix socket, the access to it is controlled by the ACL of its directory on Windows.
+func listenUnix(socket string) (net.Listener, error) {
+	return net.Listen("unix", socket)
+}
@@ -0,0 +1,163 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+
+	"gitea.com/gitea/act_runner/internal/pkg/config"
+)
+
+// The exit codes of `act_runner register --bootstrap`, so scripts can tell the failures apart without parsing the logs.
+const (
+	exitInvalidConfig = 2 // the config or the inputs are invalid
+	exitUnreachable   = 3 // the Gitea instance can't be reached after all attempts
+	exitRejected      = 4 // the Gitea instance doesn't accept the registration
+)
+
+// exitError is an error with the exit code of the process.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// registerBootstrap registers the runner with the bootstrap section of the config file, the flags take precedence over it.
+// It does nothing if the runner has been registered to the same instance with the same name,
+// the labels are not compared since the daemon declares the labels of the config file when it starts.
+func registerBootstrap(ctx context.Context, configFile string, regArgs *registerArgs) error {
+	cfg, err := config.LoadDefault(configFile)
+	if err != nil {
+		return &exitError{code: exitInvalidConfig, err: err}
+	}
+	inputs, err := bootstrapInputs(cfg, regArgs)
+	if err != nil {
+		return &exitError{code: exitInvalidConfig, err: err}
+	}
+
+	if registered, err := isRegistered(cfg, inputs); err != nil {
+		return &exitError{code: exitInvalidConfig, err: err}
+	} else if registered {
+		log.Infof("Runner %q has been registered to %s, skip the registration.", inputs.RunnerName, inputs.InstanceAddr)
+		return nil
+	}
+
+	log.Infof("Registering runner, name=%s, instance=%s, labels=%v.", inputs.RunnerName, inputs.InstanceAddr, inputs.Labels)
+	if err := doRegister(ctx, cfg, inputs); err != nil {
+		err = fmt.Errorf("Failed to register runner: %w", err)
+		switch {
+		case errors.Is(err, errUnreachable):
+			return &exitError{code: exitUnreachable, err: err}
+		case errors.Is(err, errRejected):
+			return &exitError{code: exitRejected, err: err}
+		}
+		return err
+	}
+	log.Infof("Runner registered successfully.")
+	return nil
+}
+
+// bootstrapInputs returns the inputs of the registration from the config and the flags.
+func bootstrapInputs(cfg *config.Config, regArgs *registerArgs) (*registerInputs, error) {
+	b := cfg.Bootstrap
+	inputs := &registerInputs{
+		InstanceAddr: b.Instance,
+		Token:        b.Token,
+		Labels:       defaultLabels,
+		InitialDelay: b.InitialDelay,
+		MaxDelay:     b.MaxDelay,
+	}
+	if b.MaxAttempts > 0 {
+		inputs.MaxAttempts = uint(b.MaxAttempts)
+	}
+	if regArgs.MaxAttempts != 0 {
+		inputs.MaxAttempts = uint(max(regArgs.MaxAttempts, 0))
+	}
+
+	if regArgs.InstanceAddr != "" {
+		inputs.InstanceAddr = regArgs.InstanceAddr
+	}
+	if regArgs.Token != "" {
+		inputs.Token = regArgs.Token
+	} else if inputs.Token == "" && b.TokenFile != "" {
+		content, err := os.ReadFile(b.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("read token file: %w", err)
+		}
+		inputs.Token = strings.TrimSpace(string(content))
+	}
+
+	if regArgs.RunnerName != "" {
+		inputs.RunnerName = regArgs.RunnerName
+	} else {
+		name, err := renderRunnerName(b.Name)
+		if err != nil {
+			return nil, err
+		}
+		inputs.RunnerName = name
+	}
+
+	if ls := strings.TrimSpace(regArgs.Labels); ls != "" {
+		inputs.Labels = strings.Split(ls, ",")
+	} else if len(cfg.Runner.Labels) > 0 {
+		inputs.Labels = cfg.Runner.Labels
+	}
+
+	if err := inputs.validate(); err != nil {
+		return nil, err
+	}
+	return inputs, nil
+}
+
+// renderRunnerName executes the template of the runner name,
+// the field .Hostname and the function env, like `{{ env "POD_NAME" }}`, are available.
+func renderRunnerName(text string) (string, error) {
+	tmpl, err := template.New("name").Funcs(template.FuncMap{"env": os.Getenv}).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("parse runner name: %w", err)
+	}
+	hostname, _ := os.Hostname()
+	sb := &strings.Builder{}
+	if err := tmpl.Execute(sb, struct{ Hostname string }{hostname}); err != nil {
+		return "", fmt.Errorf("render runner name: %w", err)
+	}
+	name := strings.TrimSpace(sb.String())
+	if name == "" {
+		return "", errors.New("runner name is empty")
+	}
+	return name, nil
+}
+
+// isRegistered reports whether the registration file exists and is for the instance and the name of inputs.
+func isRegistered(cfg *config.Config, inputs *registerInputs) (bool, error) {
+	tokenKey, err := cfg.Runner.TokenKey.Load()
+	if err != nil {
+		return false, fmt.Errorf("failed to load token key: %w", err)
+	}
+	reg, err := config.LoadRegistration(cfg.Runner.File, tokenKey)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to load registration file: %w", err)
+	}
+	if reg.Token != "" && strings.TrimSuffix(reg.Address, "/") == strings.TrimSuffix(inputs.InstanceAddr, "/") && reg.Name == inputs.RunnerName {
+		return true, nil
+	}
+	log.Warnf("Registration file %s is for runner %q of %s, it will be replaced.", cfg.Runner.File, reg.Name, reg.Address)
+	return false, nil
+}
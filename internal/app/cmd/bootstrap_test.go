@@ -0,0 +1,129 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitea.com/gitea/act_runner/internal/pkg/config"
+	"gitea.com/gitea/act_runner/internal/pkg/fakegitea"
+)
+
+// writeBootstrapConfig writes a config file with the bootstrap section.
+func writeBootstrapConfig(t *testing.T, bootstrap string) string {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte(fmt.Sprintf(`
+runner:
+  file: %s
+  labels:
+    - e2e:host
+bootstrap:
+%s
+`, filepath.Join(dir, ".runner"), bootstrap)), 0o600))
+	return configFile
+}
+
+func exitCode(err error) int {
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+	return 1
+}
+
+func TestRegisterBootstrap(t *testing.T) {
+	srv := fakegitea.NewServer("registration-token")
+	t.Cleanup(srv.Close)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("registration-token\n"), 0o600))
+	t.Setenv("RUNNER_SUFFIX", "1")
+
+	configFile := writeBootstrapConfig(t, fmt.Sprintf(`
+  instance: %s
+  token_file: %s
+  name: 'runner-{{ env "RUNNER_SUFFIX" }}'
+`, srv.URL(), tokenFile))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, registerBootstrap(ctx, configFile, &registerArgs{}))
+
+	runners := srv.Runners()
+	require.Len(t, runners, 1)
+	assert.Equal(t, "runner-1", runners[0].Name)
+	assert.Equal(t, []string{"e2e"}, runners[0].Labels)
+
+	// it's idempotent
+	require.NoError(t, registerBootstrap(ctx, configFile, &registerArgs{}))
+	assert.Len(t, srv.Runners(), 1)
+
+	// the runner is registered again with another name
+	require.NoError(t, registerBootstrap(ctx, configFile, &registerArgs{RunnerName: "another"}))
+	require.Len(t, srv.Runners(), 2)
+	cfg, err := config.LoadDefault(configFile)
+	require.NoError(t, err)
+	reg, err := config.LoadRegistration(cfg.Runner.File, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "another", reg.Name)
+}
+
+func TestRegisterBootstrap_ExitCodes(t *testing.T) {
+	srv := fakegitea.NewServer("registration-token")
+	t.Cleanup(srv.Close)
+	closed := httptest.NewServer(nil)
+	closed.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := registerBootstrap(ctx, writeBootstrapConfig(t, `
+  token: registration-token
+`), &registerArgs{})
+	assert.Equal(t, exitInvalidConfig, exitCode(err))
+	assert.EqualError(t, err, "instance address is empty")
+
+	start := time.Now()
+	err = registerBootstrap(ctx, writeBootstrapConfig(t, fmt.Sprintf(`
+  instance: %s
+  token: registration-token
+  max_attempts: 3
+  initial_delay: 10ms
+`, closed.URL)), &registerArgs{})
+	assert.Equal(t, exitUnreachable, exitCode(err))
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	err = registerBootstrap(ctx, writeBootstrapConfig(t, fmt.Sprintf(`
+  instance: %s
+  token: wrong-token
+`, srv.URL())), &registerArgs{})
+	assert.Equal(t, exitRejected, exitCode(err))
+	assert.Empty(t, srv.Runners())
+}
+
+func TestBootstrapInputs_Labels(t *testing.T) {
+	cfg, err := config.LoadDefault(writeBootstrapConfig(t, `
+  instance: http://gitea.example.com
+  token: registration-token
+`))
+	require.NoError(t, err)
+
+	inputs, err := bootstrapInputs(cfg, &registerArgs{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"e2e:host"}, inputs.Labels)
+
+	// the flag takes precedence over runner.labels
+	inputs, err = bootstrapInputs(cfg, &registerArgs{Labels: "flag:host,other:host"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"flag:host", "other:host"}, inputs.Labels)
+}
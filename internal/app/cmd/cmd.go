@@ -5,6 +5,7 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 
@@ -39,17 +40,37 @@ func Execute(ctx context.Context) {
 	registerCmd.Flags().StringVar(&regArgs.Token, "token", "", "Runner token")
 	registerCmd.Flags().StringVar(&regArgs.RunnerName, "name", "", "Runner name")
 	registerCmd.Flags().StringVar(&regArgs.Labels, "labels", "", "Runner tags, comma separated")
+	registerCmd.Flags().BoolVar(&regArgs.Bootstrap, "bootstrap", false, "Register with the bootstrap section of the config file without interaction, skip if already registered")
+	registerCmd.Flags().IntVar(&regArgs.MaxAttempts, "max-attempts", 0, "Maximum number of attempts to reach the instance in bootstrap mode, negative for unlimited")
 	rootCmd.AddCommand(registerCmd)
 
 	// ./act_runner daemon
+	var daemArgs daemonArgs
 	daemonCmd := &cobra.Command{
 		Use:   "daemon",
 		Short: "Run as a runner daemon",
 		Args:  cobra.MaximumNArgs(1),
-		RunE:  runDaemon(ctx, &configFile),
+		RunE:  runDaemon(ctx, &daemArgs, &configFile),
 	}
+	daemonCmd.Flags().BoolVar(&daemArgs.Once, "once", false, "Run a single task, then remove the registration file and exit")
 	rootCmd.AddCommand(daemonCmd)
 
+	// ./act_runner unregister
+	var unregArgs unregisterArgs
+	unregisterCmd := &cobra.Command{
+		Use:   "unregister",
+		Short: "Remove the runner from the server and delete the registration file",
+		Args:  cobra.MaximumNArgs(0),
+		RunE:  runUnregister(ctx, &unregArgs, &configFile),
+	}
+	unregisterCmd.Flags().StringVar(&unregArgs.APIToken, "api-token", "", "Access token of an administrator to delete the runner on the server")
+	unregisterCmd.Flags().BoolVar(&unregArgs.Archive, "archive", false, "Keep the registration file with a timestamp suffix instead of deleting it")
+	unregisterCmd.Flags().BoolVar(&unregArgs.Force, "force", false, "Remove the registration file even if the runner fails to be deleted on the server")
+	rootCmd.AddCommand(unregisterCmd)
+
+	// ./act_runner ctl
+	rootCmd.AddCommand(loadCtlCmd(ctx, &configFile))
+
 	// ./act_runner exec
 	rootCmd.AddCommand(loadExecCmd(ctx))
 
@@ -80,6 +101,10 @@ func Execute(ctx context.Context) {
 	rootCmd.CompletionOptions.HiddenDefaultCmd = true
 
 	if err := rootCmd.Execute(); err != nil {
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.code)
+		}
 		os.Exit(1)
 	}
 }
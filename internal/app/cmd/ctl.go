@@ -0,0 +1,285 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"gitea.com/gitea/act_runner/internal/app/run"
+	"gitea.com/gitea/act_runner/internal/pkg/config"
+)
+
+type ctlArgs struct {
+	Socket string
+	Follow bool
+	Tail   int
+	Wait   bool
+}
+
+// loadCtlCmd returns the commands which control a running daemon through the admin API.
+func loadCtlCmd(ctx context.Context, configFile *string) *cobra.Command {
+	var args ctlArgs
+	ctlCmd := &cobra.Command{
+		Use:   "ctl",
+		Short: "Control a running runner daemon through its admin socket",
+	}
+	ctlCmd.PersistentFlags().StringVar(&args.Socket, "socket", "", "Path of the admin socket, defaults to admin.socket of the config file")
+
+	ctlCmd.AddCommand(&cobra.Command{
+		Use:   "tasks",
+		Short: "List the running tasks",
+		Args:  cobra.NoArgs,
+		RunE: runCtl(configFile, &args, func(c *ctlClient, cmd *cobra.Command, _ []string) error {
+			return ctlTasks(ctx, c, cmd.OutOrStdout())
+		}),
+	})
+	ctlCmd.AddCommand(&cobra.Command{
+		Use:   "cancel <task id>",
+		Short: "Cancel a running task",
+		Args:  cobra.ExactArgs(1),
+		RunE: runCtl(configFile, &args, func(c *ctlClient, cmd *cobra.Command, a []string) error {
+			id, err := strconv.ParseInt(a[0], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid task id %q", a[0])
+			}
+			if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/tasks/%d/cancel", id), nil); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "task %d is cancelled\n", id)
+			return nil
+		}),
+	})
+	logsCmd := &cobra.Command{
+		Use:   "logs <task id>",
+		Short: "Show the logs of a running task",
+		Args:  cobra.ExactArgs(1),
+		RunE: runCtl(configFile, &args, func(c *ctlClient, cmd *cobra.Command, a []string) error {
+			id, err := strconv.ParseInt(a[0], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid task id %q", a[0])
+			}
+			return ctlLogs(ctx, c, cmd.OutOrStdout(), id, args.Tail, args.Follow)
+		}),
+	}
+	logsCmd.Flags().BoolVarP(&args.Follow, "follow", "f", false, "Follow the logs until the task finishes")
+	logsCmd.Flags().IntVar(&args.Tail, "tail", defaultLogTail, "Number of the last lines to show")
+	ctlCmd.AddCommand(logsCmd)
+	ctlCmd.AddCommand(&cobra.Command{
+		Use:   "config",
+		Short: "Show the effective configuration with the secrets redacted",
+		Args:  cobra.NoArgs,
+		RunE: runCtl(configFile, &args, func(c *ctlClient, cmd *cobra.Command, _ []string) error {
+			var content []byte
+			if err := c.do(ctx, http.MethodGet, "/config", &content); err != nil {
+				return err
+			}
+			_, err := cmd.OutOrStdout().Write(content)
+			return err
+		}),
+	})
+	drainCmd := &cobra.Command{
+		Use:   "drain",
+		Short: "Stop fetching new tasks, the running tasks keep running",
+		Args:  cobra.NoArgs,
+		RunE: runCtl(configFile, &args, func(c *ctlClient, cmd *cobra.Command, _ []string) error {
+			return ctlDrain(ctx, c, cmd.OutOrStdout(), args.Wait)
+		}),
+	}
+	drainCmd.Flags().BoolVar(&args.Wait, "wait", false, "Wait until the running tasks finish")
+	ctlCmd.AddCommand(drainCmd)
+	ctlCmd.AddCommand(&cobra.Command{
+		Use:   "resume",
+		Short: "Resume fetching new tasks after draining",
+		Args:  cobra.NoArgs,
+		RunE: runCtl(configFile, &args, func(c *ctlClient, cmd *cobra.Command, _ []string) error {
+			var status drainStatus
+			if err := c.do(ctx, http.MethodPost, "/resume", &status); err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), status.State)
+			return nil
+		}),
+	})
+	return ctlCmd
+}
+
+// runCtl returns the RunE of a ctl command, which calls f with the client of the admin socket.
+func runCtl(configFile *string, args *ctlArgs, f func(c *ctlClient, cmd *cobra.Command, a []string) error) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, a []string) error {
+		socket := args.Socket
+		if socket == "" {
+			cfg, err := config.LoadDefault(*configFile)
+			if err != nil {
+				return fmt.Errorf("invalid configuration: %w", err)
+			}
+			socket = cfg.Admin.Socket
+		}
+		return f(newCtlClient(socket), cmd, a)
+	}
+}
+
+// ctlClient calls the admin API of a running daemon through its Unix socket.
+type ctlClient struct {
+	socket string
+	client *http.Client
+}
+
+func newCtlClient(socket string) *ctlClient {
+	return &ctlClient{
+		socket: socket,
+		client: &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}},
+	}
+}
+
+// notFoundError is returned if the admin API responds 404, like when the task isn't running.
+type notFoundError struct {
+	msg string
+}
+
+func (e *notFoundError) Error() string {
+	return e.msg
+}
+
+// request calls the admin API, and returns the response if it's successful.
+func (c *ctlClient) request(ctx context.Context, method, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "http://act_runner"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, fmt.Errorf("no runner is listening on %s, is the admin API enabled? %w", c.socket, err)
+		}
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error == "" {
+		return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &notFoundError{msg: body.Error}
+	}
+	return nil, fmt.Errorf("%s %s: %s", method, path, body.Error)
+}
+
+// do calls the admin API and decodes the JSON response into v, the body is returned as it is if v is a *[]byte.
+func (c *ctlClient) do(ctx context.Context, method, path string, v interface{}) error {
+	resp, err := c.request(ctx, method, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case *[]byte:
+		*v, err = io.ReadAll(resp.Body)
+		return err
+	default:
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+}
+
+func ctlTasks(ctx context.Context, c *ctlClient, out io.Writer) error {
+	var tasks []run.TaskInfo
+	if err := c.do(ctx, http.MethodGet, "/tasks", &tasks); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tRUNNER\tREPO\tWORKFLOW\tJOB\tSTARTED\tSTEP")
+	for _, t := range tasks {
+		step := "-"
+		if t.StepIndex >= 0 {
+			step = fmt.Sprintf("#%d %s", t.StepIndex, t.Step)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", t.ID, t.Runner, t.Repo, t.Workflow, t.Job, t.StartedAt.Local().Format(time.DateTime), step)
+	}
+	return w.Flush()
+}
+
+// ctlLogs prints the last tail lines of the task, and the following ones until the task finishes if follow is true.
+func ctlLogs(ctx context.Context, c *ctlClient, out io.Writer, id int64, tail int, follow bool) error {
+	path := fmt.Sprintf("/tasks/%d/logs?tail=%d", id, tail)
+	if !follow {
+		var logs taskLogs
+		if err := c.do(ctx, http.MethodGet, path, &logs); err != nil {
+			return err
+		}
+		printLogs(out, logs)
+		return nil
+	}
+
+	resp, err := c.request(ctx, http.MethodGet, path+"&follow=true")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	next := -1
+	for {
+		var logs taskLogs
+		if err := decoder.Decode(&logs); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if next >= 0 && logs.Start > next {
+			fmt.Fprintf(out, "... %d lines are skipped\n", logs.Start-next)
+		}
+		printLogs(out, logs)
+		next = logs.Next
+	}
+}
+
+func printLogs(out io.Writer, logs taskLogs) {
+	for _, line := range logs.Lines {
+		fmt.Fprintf(out, "%s %s\n", line.Time.Format(time.RFC3339), line.Content)
+	}
+}
+
+// ctlDrain drains the runner, and waits until the running tasks finish if wait is true.
+func ctlDrain(ctx context.Context, c *ctlClient, out io.Writer, wait bool) error {
+	var status drainStatus
+	if err := c.do(ctx, http.MethodPost, "/drain", &status); err != nil {
+		return err
+	}
+	for wait && status.State != drainDrained {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+		if err := c.do(ctx, http.MethodGet, "/drain", &status); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(out, status.State)
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	runnerv1 "code.gitea.io/actions-proto-go/runner/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitea.com/gitea/act_runner/internal/pkg/fakegitea"
+)
+
+func TestCtl_E2E(t *testing.T) {
+	srv, configFile := setupE2E(t)
+	admin := enableAdmin(t, configFile)
+
+	id := srv.AddTask(fakegitea.NewTask(`
+name: test
+on: push
+jobs:
+  job:
+    runs-on: e2e
+    steps:
+      - name: wait
+        run: echo started && sleep 60
+`))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	stop := startDaemon(ctx, t, configFile, admin)
+	defer stop()
+	_, err := srv.WaitForTask(ctx, id, func(t *fakegitea.Task) bool {
+		return strings.Contains(strings.Join(t.Logs, "\n"), "started")
+	})
+	require.NoError(t, err)
+
+	out := &bytes.Buffer{}
+	require.NoError(t, ctlTasks(ctx, admin, out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Regexp(t, `^\d+\s+e2e-runner\s+owner/repo\s+.*#0 wait$`, lines[1])
+
+	out.Reset()
+	require.NoError(t, ctlLogs(ctx, admin, out, id, defaultLogTail, false))
+	assert.Contains(t, out.String(), "started")
+
+	var config []byte
+	require.NoError(t, admin.do(ctx, http.MethodGet, "/config", &config))
+	assert.Contains(t, string(config), "socket: "+admin.socket)
+
+	// follow the logs until the task is cancelled
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(ctlLogs(ctx, admin, pw, id, 1, true))
+	}()
+	reader := bufio.NewReader(pr)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Contains(t, line, "started")
+
+	var notFound *notFoundError
+	require.ErrorAs(t, admin.do(ctx, http.MethodPost, fmt.Sprintf("/tasks/%d/cancel", id+1), nil), &notFound)
+	require.NoError(t, admin.do(ctx, http.MethodPost, fmt.Sprintf("/tasks/%d/cancel", id), nil))
+	task, err := srv.WaitForTask(ctx, id, func(t *fakegitea.Task) bool { return t.Finished() })
+	require.NoError(t, err)
+	assert.Equal(t, runnerv1.Result_RESULT_CANCELLED, task.State.Result)
+
+	// the final logs are streamed before the task is removed
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Contains(t, string(rest), "The task is cancelled")
+}
@@ -5,14 +5,21 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"runtime"
-	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"connectrpc.com/connect"
 	"github.com/mattn/go-isatty"
@@ -24,48 +31,51 @@ import (
 	"gitea.com/gitea/act_runner/internal/pkg/client"
 	"gitea.com/gitea/act_runner/internal/pkg/config"
 	"gitea.com/gitea/act_runner/internal/pkg/envcheck"
+	"gitea.com/gitea/act_runner/internal/pkg/health"
 	"gitea.com/gitea/act_runner/internal/pkg/labels"
+	"gitea.com/gitea/act_runner/internal/pkg/metrics"
+	"gitea.com/gitea/act_runner/internal/pkg/pressure"
 	"gitea.com/gitea/act_runner/internal/pkg/ver"
 )
 
-func runDaemon(ctx context.Context, configFile *string) func(cmd *cobra.Command, args []string) error {
+// daemonArgs represents the arguments for daemon command
+type daemonArgs struct {
+	Once bool
+}
+
+func runDaemon(ctx context.Context, daemArgs *daemonArgs, configFile *string) func(cmd *cobra.Command, args []string) error {
 	return func(cmd *cobra.Command, args []string) error {
 		cfg, err := config.LoadDefault(*configFile)
 		if err != nil {
 			return fmt.Errorf("invalid configuration: %w", err)
 		}
+		if daemArgs.Once {
+			cfg.Runner.Ephemeral = true
+			// the config file has been validated without the flag
+			if err := cfg.ValidateEphemeral(); err != nil {
+				return fmt.Errorf("invalid configuration: %w", err)
+			}
+		}
 
 		initLogging(cfg)
 		log.Infoln("Starting runner daemon")
 
-		reg, err := config.LoadRegistration(cfg.Runner.File)
-		if os.IsNotExist(err) {
-			log.Error("registration file not found, please register the runner first")
-			return err
-		} else if err != nil {
-			return fmt.Errorf("failed to load registration file: %w", err)
-		}
-
-		lbls := reg.Labels
-		if len(cfg.Runner.Labels) > 0 {
-			lbls = cfg.Runner.Labels
-		}
+		// keep the configured docker host, because it could be replaced by the detected one
+		configuredDockerHost := cfg.Container.DockerHost
 
-		ls := labels.Labels{}
-		for _, l := range lbls {
-			label, err := labels.Parse(l)
-			if err != nil {
-				log.WithError(err).Warnf("ignored invalid label %q", l)
-				continue
-			}
-			ls = append(ls, label)
+		tokenKey, err := cfg.Runner.TokenKey.Load()
+		if err != nil {
+			return fmt.Errorf("failed to load token key: %w", err)
 		}
-		if len(ls) == 0 {
-			log.Warn("no labels configured, runner may not be able to pick up jobs")
+		instances, err := loadInstances(cfg, tokenKey)
+		if err != nil {
+			return err
 		}
+		dockerRequired := requireDocker(instances)
 
-		if ls.RequireDocker() {
-			dockerSocketPath, err := getDockerSocketPath(cfg.Container.DockerHost)
+		var dockerSocketPath string
+		if dockerRequired {
+			dockerSocketPath, err = getDockerSocketPath(cfg.Container.DockerHost)
 			if err != nil {
 				return err
 			}
@@ -89,55 +99,254 @@ func runDaemon(ctx context.Context, configFile *string) func(cmd *cobra.Command,
 			}
 		}
 
-		if !slices.Equal(reg.Labels, ls.ToStrings()) {
-			reg.Labels = ls.ToStrings()
-			if err := config.SaveRegistration(cfg.Runner.File, reg); err != nil {
-				return fmt.Errorf("failed to save runner config: %w", err)
+		var monitor *pressure.Monitor
+		if cfg.Pressure.Enabled {
+			paths := []string{cfg.Host.WorkdirParent}
+			if dockerRequired {
+				if root, err := envcheck.GetDockerRootDir(ctx, dockerSocketPath); err != nil {
+					log.WithError(err).Warn("the free disk space of the docker data root won't be checked")
+				} else if _, err := os.Stat(root); err != nil {
+					log.Warnf("the free disk space of the docker data root %q won't be checked, it isn't on this host", root)
+				} else {
+					paths = append(paths, root)
+				}
+			}
+			monitor, err = pressure.NewMonitor(cfg.Pressure, paths...)
+			if err != nil {
+				return fmt.Errorf("invalid configuration: %w", err)
 			}
-			log.Infof("labels updated to: %v", reg.Labels)
 		}
 
-		cli := client.New(
-			reg.Address,
-			cfg.Runner.Insecure,
-			reg.UUID,
-			reg.Token,
-			ver.Version(),
-		)
+		// the tasks of all registrations share the capacity of the runner
+		scheduler := poll.NewScheduler(cfg.Runner.Capacity)
+		scheduler.SetLabelCapacity(cfg.Runner.LabelCapacity)
+		for i, in := range instances {
+			cli := client.New(
+				in.reg.Address,
+				cfg.Runner.Insecure,
+				in.reg.UUID,
+				in.reg.Token,
+				ver.Version(),
+			)
+			if i == 0 {
+				in.runner = run.NewRunner(cfg, in.reg, cli)
+			} else {
+				in.runner = instances[0].runner.NewInstance(in.reg, cli)
+			}
+			in.poller = poll.New(cfg, cli, in.runner)
+			c := instanceConfig(cfg, i)
+			scheduler.SetQueue(in.file, c.Weight, in.labels.FullNames())
+			in.poller.SetScheduler(scheduler, in.file)
+			in.poller.SetCapacity(c.Capacity)
+			if monitor != nil {
+				in.poller.SetPressureMonitor(monitor)
+			}
+		}
 
-		runner := run.NewRunner(cfg, reg, cli)
+		// declared is used by the readiness probe
+		var declared atomic.Bool
+		drain := newDrainer(ctx, instances)
 
-		// declare the labels of the runner before fetching tasks
-		resp, err := runner.Declare(ctx, ls.Names())
-		if err != nil && connect.CodeOf(err) == connect.CodeUnimplemented {
-			log.Errorf("Your Gitea version is too old to support runner declare, please upgrade to v1.21 or later")
-			return err
-		} else if err != nil {
-			log.WithError(err).Error("fail to invoke Declare")
-			return err
-		} else {
-			log.Infof("runner: %s, with version: %s, with labels: %v, declare successfully",
-				resp.Msg.Runner.Name, resp.Msg.Runner.Version, resp.Msg.Runner.Labels)
+		muxes := map[string]*http.ServeMux{}
+		muxOf := func(addr string) *http.ServeMux {
+			if _, ok := muxes[addr]; !ok {
+				muxes[addr] = http.NewServeMux()
+			}
+			return muxes[addr]
+		}
+		if cfg.Metrics.Enabled {
+			for _, in := range instances {
+				metrics.RunnerInfo.WithLabelValues(in.reg.Name, ver.Version()).Set(1)
+			}
+			muxOf(cfg.Metrics.Addr).Handle("/metrics", metrics.Handler())
+		}
+		if cfg.Health.Enabled {
+			liveness := health.NewProbe(5 * time.Second)
+			liveness.Add("poller", func(context.Context) error {
+				for _, in := range instances {
+					if err := in.poller.CheckHealth(cfg.Health.MaxFetchFailures); err != nil {
+						if len(instances) > 1 {
+							return fmt.Errorf("%s: %w", in.file, err)
+						}
+						return err
+					}
+				}
+				return nil
+			})
+			readiness := health.NewProbe(5 * time.Second)
+			readiness.Add("declare", func(context.Context) error {
+				if !declared.Load() {
+					return errors.New("runner has not been declared yet")
+				}
+				return nil
+			})
+			readiness.Add("drain", func(context.Context) error {
+				if state := drain.state(); state != drainActive {
+					return fmt.Errorf("runner is %s", state)
+				}
+				return nil
+			})
+			if dockerRequired {
+				readiness.Add("docker", func(ctx context.Context) error {
+					return envcheck.CheckIfDockerRunning(ctx, dockerSocketPath)
+				})
+			}
+			muxOf(cfg.Health.Addr).Handle("/healthz", liveness)
+			muxOf(cfg.Health.Addr).Handle("/readyz", readiness)
+		}
+		for addr, mux := range muxes {
+			if err := serveHTTP(ctx, addr, mux); err != nil {
+				return fmt.Errorf("failed to listen on %s: %w", addr, err)
+			}
+			log.Infof("http server is listening on %s", addr)
+		}
+		if cfg.Admin.Enabled {
+			ln, err := listenAdmin(cfg.Admin.Socket)
+			if err != nil {
+				return fmt.Errorf("failed to listen on %s: %w", cfg.Admin.Socket, err)
+			}
+			serve(ctx, ln, adminHandler(drain, instances))
+			log.Infof("admin API is listening on %s", cfg.Admin.Socket)
 		}
 
-		poller := poll.New(cfg, cli, runner)
+		// declare the labels of the runners before fetching tasks
+		for _, in := range instances {
+			resp, err := in.runner.Declare(ctx, in.labels.Names())
+			if err != nil && connect.CodeOf(err) == connect.CodeUnimplemented {
+				log.Errorf("Your Gitea version is too old to support runner declare, please upgrade to v1.21 or later")
+				return err
+			} else if err != nil {
+				log.WithError(err).Errorf("fail to invoke Declare for %s", in.reg.Address)
+				return err
+			} else {
+				log.Infof("runner: %s, with version: %s, with labels: %v, declare successfully",
+					resp.Msg.Runner.Name, resp.Msg.Runner.Version, resp.Msg.Runner.Labels)
+			}
+		}
+		declared.Store(true)
 
-		go poller.Poll()
+		for _, in := range instances {
+			if err := in.runner.StartSpool(ctx); err != nil {
+				return fmt.Errorf("failed to replay spool: %w", err)
+			}
+		}
 
-		<-ctx.Done()
-		log.Infof("runner: %s shutdown initiated, waiting %s for running jobs to complete before shutting down", resp.Msg.Runner.Name, cfg.Runner.ShutdownTimeout)
+		if cfg.Runner.Ephemeral && cfg.Runner.Capacity > 1 {
+			log.Warnf("capacity %d is ignored, the runner runs a single task in ephemeral mode", cfg.Runner.Capacity)
+		}
+
+		for _, in := range instances {
+			go in.poller.Poll()
+		}
+
+		rl := &reloader{
+			configFile:           *configFile,
+			configuredDockerHost: configuredDockerHost,
+			tokenKey:             tokenKey,
+			instances:            instances,
+			scheduler:            scheduler,
+			dockerRequired:       dockerRequired,
+			cfg:                  cfg,
+		}
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		drainSignals := make(chan os.Signal, 1)
+		if drainSignal != nil {
+			signal.Notify(drainSignals, drainSignal, resumeSignal)
+			defer signal.Stop(drainSignals)
+		}
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-hup:
+					log.Info("SIGHUP received, reloading configuration")
+					if err := rl.reload(ctx); err != nil {
+						log.WithError(err).Error("failed to reload configuration")
+					}
+				case sig := <-drainSignals:
+					if sig == drainSignal {
+						drain.drain()
+					} else {
+						drain.resume()
+					}
+				}
+			}
+		}()
+
+		// deliver the events of the last tasks before exiting, the runners of all instances share the event sinks
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := instances[0].runner.CloseEvents(ctx); err != nil {
+				log.WithError(err).Warn("some events were not delivered before exiting")
+			}
+		}()
+
+		select {
+		case <-ctx.Done():
+		case <-instances[0].poller.Done():
+			// the task has finished in ephemeral mode, the registration file is removed anyway since the runner can't be reused
+			in := instances[0]
+			log.Infof("runner: %s has finished its task", in.reg.Name)
+			if cfg.Unregister.OnShutdown {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				return unregister(ctx, cfg, in.file, in.reg, true)
+			}
+			return removeRegistration(in.file, cfg.Unregister.Archive)
+		}
+		log.Infof("shutdown initiated, waiting %s for running jobs to complete before shutting down", cfg.Runner.ShutdownTimeout)
 
 		ctx, cancel := context.WithTimeout(context.Background(), cfg.Runner.ShutdownTimeout)
 		defer cancel()
 
-		err = poller.Shutdown(ctx)
-		if err != nil {
-			log.Warnf("runner: %s cancelled in progress jobs during shutdown", resp.Msg.Runner.Name)
+		var wg sync.WaitGroup
+		for _, in := range instances {
+			wg.Add(1)
+			go func(in *instance) {
+				defer wg.Done()
+				if err := in.poller.Shutdown(ctx); err != nil {
+					log.Warnf("runner: %s cancelled in progress jobs during shutdown", in.reg.Name)
+				}
+			}(in)
+		}
+		wg.Wait()
+
+		if cfg.Unregister.OnShutdown {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for _, in := range instances {
+				if err := unregister(ctx, cfg, in.file, in.reg, false); err != nil {
+					log.WithError(err).Errorf("runner: %s failed to unregister, the registration file is kept", in.reg.Name)
+				}
+			}
 		}
 		return nil
 	}
 }
 
+// loadLabels returns the configured labels, or the labels in the registration if none is configured.
+func loadLabels(configured []string, reg *config.Registration) labels.Labels {
+	lbls := reg.Labels
+	if len(configured) > 0 {
+		lbls = configured
+	}
+
+	ls := labels.Labels{}
+	for _, l := range lbls {
+		label, err := labels.Parse(l)
+		if err != nil {
+			log.WithError(err).Warnf("ignored invalid label %q", l)
+			continue
+		}
+		ls = append(ls, label)
+	}
+	return ls
+}
+
 // initLogging setup the global logrus logger.
 func initLogging(cfg *config.Config) {
 	isTerm := isatty.IsTerminal(os.Stdout.Fd())
@@ -146,6 +355,7 @@ func initLogging(cfg *config.Config) {
 		FullTimestamp: true,
 	}
 	log.SetFormatter(format)
+	log.SetReportCaller(false)
 
 	if l := cfg.Log.Level; l != "" {
 		level, err := log.ParseLevel(l)
@@ -176,6 +386,33 @@ func initLogging(cfg *config.Config) {
 	}
 }
 
+// serveHTTP starts serving handler on addr in background, the server is closed when ctx is done.
+func serveHTTP(ctx context.Context, addr string, handler http.Handler) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	serve(ctx, ln, handler)
+	return nil
+}
+
+// serve serves handler on ln in background, the server is closed when ctx is done.
+func serve(ctx context.Context, ln net.Listener, handler http.Handler) {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.WithError(err).Errorf("http server on %s stopped", ln.Addr())
+		}
+	}()
+}
+
 var commonSocketPaths = []string{
 	"/var/run/docker.sock",
 	"/run/podman/podman.sock",
@@ -0,0 +1,361 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	runnerv1 "code.gitea.io/actions-proto-go/runner/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitea.com/gitea/act_runner/internal/pkg/event"
+	"gitea.com/gitea/act_runner/internal/pkg/fakegitea"
+)
+
+// setupE2E starts a fake Gitea server, and registers a runner with a host label to it.
+func setupE2E(t *testing.T) (srv *fakegitea.Server, configFile string) {
+	srv = fakegitea.NewServer("registration-token")
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	configFile = filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte(fmt.Sprintf(`
+log:
+  level: warn
+runner:
+  file: %s
+  fetch_interval: 100ms
+  shutdown_timeout: 30s
+  labels:
+    - e2e:host
+cache:
+  enabled: false
+host:
+  workdir_parent: %s
+`, filepath.Join(dir, ".runner"), filepath.Join(dir, "work"))), 0o600))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, registerNoInteractive(ctx, configFile, &registerArgs{
+		NoInteractive: true,
+		InstanceAddr:  srv.URL(),
+		Token:         "registration-token",
+		RunnerName:    "e2e-runner",
+	}))
+
+	runners := srv.Runners()
+	require.Len(t, runners, 1)
+	assert.Equal(t, "e2e-runner", runners[0].Name)
+	assert.Equal(t, []string{"e2e"}, runners[0].Labels)
+	return srv, configFile
+}
+
+func TestDaemon_E2E(t *testing.T) {
+	srv, configFile := setupE2E(t)
+
+	id := srv.AddTask(fakegitea.NewTask(`
+name: test
+on: push
+jobs:
+  job:
+    runs-on: e2e
+    steps:
+      - run: echo "hello from $GITHUB_REPOSITORY"
+`))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	// the runner exits after a single task in ephemeral mode
+	require.NoError(t, runDaemon(ctx, &daemonArgs{Once: true}, &configFile)(nil, nil))
+
+	task := srv.Task(id)
+	require.True(t, task.Finished())
+	assert.Equal(t, runnerv1.Result_RESULT_SUCCESS, task.State.Result)
+	require.Len(t, task.State.Steps, 1)
+	assert.Equal(t, runnerv1.Result_RESULT_SUCCESS, task.State.Steps[0].Result)
+	assert.Contains(t, strings.Join(task.Logs, "\n"), "hello from owner/repo")
+	assert.NotContains(t, strings.Join(task.Logs, "\n"), task.Task.Context.Fields["token"].GetStringValue())
+
+	runners := srv.Runners()
+	require.Len(t, runners, 1)
+	assert.Equal(t, []string{"e2e"}, runners[0].Labels)
+	assert.NoFileExists(t, filepath.Join(filepath.Dir(configFile), ".runner"))
+}
+
+func TestDaemon_E2EWebhook(t *testing.T) {
+	srv, configFile := setupE2E(t)
+
+	var mu sync.Mutex
+	var events []*event.Event
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := &event.Event{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(e))
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+	f, err := os.OpenFile(configFile, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(f, "webhooks:\n  - url: %s\n    events: [job_finished]\n", hook.URL)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	id := srv.AddTask(fakegitea.NewTask(`
+name: test
+on: push
+jobs:
+  job:
+    runs-on: e2e
+    steps:
+      - run: echo "::warning file=main.go,line=3::unused variable"
+`))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	require.NoError(t, runDaemon(ctx, &daemonArgs{Once: true}, &configFile)(nil, nil))
+	require.True(t, srv.Task(id).Finished())
+
+	// the annotations are sent with the job_finished event
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, events, 1)
+	assert.Equal(t, event.JobFinished, events[0].Type)
+	assert.Equal(t, []*event.Annotation{{Level: "warning", Message: "unused variable", File: "main.go", Line: 3, Step: 0}}, events[0].Annotations)
+}
+
+func TestDaemon_E2ECancel(t *testing.T) {
+	srv, configFile := setupE2E(t)
+
+	id := srv.AddTask(fakegitea.NewTask(`
+name: test
+on: push
+jobs:
+  job:
+    runs-on: e2e
+    steps:
+      - run: echo started && sleep 60
+      - run: echo should not run
+      - if: always()
+        run: echo cleaning up
+      - if: cancelled()
+        run: echo handling cancellation
+      - if: ${{ !cancelled() }}
+        run: echo not cancelled
+`))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- runDaemon(ctx, &daemonArgs{Once: true}, &configFile)(nil, nil)
+	}()
+
+	_, err := srv.WaitForTask(ctx, id, func(t *fakegitea.Task) bool {
+		return strings.Contains(strings.Join(t.Logs, "\n"), "started")
+	})
+	require.NoError(t, err)
+	start := time.Now()
+	require.NoError(t, srv.Cancel(id))
+
+	// the running step is terminated, and the cleanup step runs before the job finishes
+	task, err := srv.WaitForTask(ctx, id, func(t *fakegitea.Task) bool { return t.Finished() })
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), 20*time.Second)
+	require.NoError(t, <-done)
+
+	assert.Equal(t, runnerv1.Result_RESULT_CANCELLED, task.State.Result)
+	require.Len(t, task.State.Steps, 5)
+	assert.Equal(t, runnerv1.Result_RESULT_CANCELLED, task.State.Steps[0].Result)
+	assert.Equal(t, runnerv1.Result_RESULT_SKIPPED, task.State.Steps[1].Result)
+	assert.Equal(t, runnerv1.Result_RESULT_SUCCESS, task.State.Steps[2].Result)
+	assert.Equal(t, runnerv1.Result_RESULT_SUCCESS, task.State.Steps[3].Result)
+	assert.Equal(t, runnerv1.Result_RESULT_SKIPPED, task.State.Steps[4].Result)
+	logs := strings.Join(task.Logs, "\n")
+	assert.Contains(t, logs, "cleaning up")
+	assert.Contains(t, logs, "handling cancellation")
+	assert.NotContains(t, logs, "should not run")
+	assert.NotContains(t, logs, "not cancelled")
+}
+
+func TestDaemon_E2EInstances(t *testing.T) {
+	srv, configFile := setupE2E(t)
+	dir := filepath.Dir(configFile)
+
+	// register another runner to another Gitea instance
+	other := fakegitea.NewServer("other-token")
+	t.Cleanup(other.Close)
+	otherConfigFile := filepath.Join(dir, "other.yaml")
+	otherFile := filepath.Join(dir, ".runner-other")
+	require.NoError(t, os.WriteFile(otherConfigFile, []byte("runner:\n  file: "+otherFile+"\n"), 0o600))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	require.NoError(t, registerNoInteractive(ctx, otherConfigFile, &registerArgs{
+		NoInteractive: true,
+		InstanceAddr:  other.URL(),
+		Token:         "other-token",
+		RunnerName:    "other-runner",
+		Labels:        "other:host",
+	}))
+
+	content, err := os.ReadFile(configFile)
+	require.NoError(t, err)
+	content = []byte(strings.Replace(string(content), "runner:\n", fmt.Sprintf(`runner:
+  capacity: 2
+  instances:
+    - file: %s
+      labels:
+        - another:host
+`, otherFile), 1))
+	require.NoError(t, os.WriteFile(configFile, content, 0o600))
+
+	workflow := `
+name: test
+on: push
+jobs:
+  job:
+    runs-on: %s
+    steps:
+      - run: echo "hello from %s"
+`
+	id := srv.AddTask(fakegitea.NewTask(fmt.Sprintf(workflow, "e2e", "e2e")))
+	otherID := other.AddTask(fakegitea.NewTask(fmt.Sprintf(workflow, "another", "another")))
+
+	daemonCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	done := make(chan error, 1)
+	go func() {
+		done <- runDaemon(daemonCtx, &daemonArgs{}, &configFile)(nil, nil)
+		cancel()
+	}()
+
+	task, err := srv.WaitForTask(ctx, id, func(t *fakegitea.Task) bool { return t.Finished() })
+	require.NoError(t, err)
+	assert.Equal(t, runnerv1.Result_RESULT_SUCCESS, task.State.Result)
+	assert.Contains(t, strings.Join(task.Logs, "\n"), "hello from e2e")
+
+	otherTask, err := other.WaitForTask(ctx, otherID, func(t *fakegitea.Task) bool { return t.Finished() })
+	require.NoError(t, err)
+	assert.Equal(t, runnerv1.Result_RESULT_SUCCESS, otherTask.State.Result)
+	assert.Contains(t, strings.Join(otherTask.Logs, "\n"), "hello from another")
+
+	// the labels of the other registration are declared to its own instance
+	runners := other.Runners()
+	require.Len(t, runners, 1)
+	assert.Equal(t, []string{"another"}, runners[0].Labels)
+
+	stop()
+	require.NoError(t, <-done)
+}
+
+// enableAdmin enables the admin API in the config file, and returns the client of its socket.
+func enableAdmin(t *testing.T, configFile string) *ctlClient {
+	// the path of a Unix socket is limited to about 100 bytes, the one of t.TempDir may be too long
+	dir, err := os.MkdirTemp("", "act_runner")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "admin.sock")
+	f, err := os.OpenFile(configFile, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(f, "admin:\n  enabled: true\n  socket: %s\n", socket)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	return newCtlClient(socket)
+}
+
+// startDaemon runs the daemon in background until the returned function is called, and waits for the admin socket.
+// The returned function can be called more than once.
+func startDaemon(ctx context.Context, t *testing.T, configFile string, admin *ctlClient) (stop func()) {
+	daemonCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- runDaemon(daemonCtx, &daemonArgs{}, &configFile)(nil, nil)
+	}()
+	var exited bool
+	var exitErr error
+	require.Eventually(t, func() bool {
+		select {
+		case exitErr = <-done:
+			exited = true
+			return true
+		default:
+		}
+		conn, err := net.Dial("unix", admin.socket)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, 10*time.Second, 50*time.Millisecond)
+	if exited {
+		cancel()
+		require.FailNow(t, "the daemon exited before listening on the admin socket", "error: %v", exitErr)
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cancel()
+			assert.NoError(t, <-done)
+		})
+	}
+}
+
+func TestDaemon_E2EDrain(t *testing.T) {
+	srv, configFile := setupE2E(t)
+	admin := enableAdmin(t, configFile)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	stop := startDaemon(ctx, t, configFile, admin)
+	defer stop()
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(admin.socket)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	}
+
+	call := func(method, path string) string {
+		var status drainStatus
+		require.NoError(t, admin.do(ctx, method, path, &status))
+		return status.State
+	}
+	assert.Equal(t, drainActive, call(http.MethodGet, "/drain"))
+	assert.Equal(t, drainDrained, call(http.MethodPost, "/drain"))
+
+	// no task is fetched while the runner is drained
+	id := srv.AddTask(fakegitea.NewTask(`
+name: test
+on: push
+jobs:
+  job:
+    runs-on: e2e
+    steps:
+      - run: echo resumed
+`))
+	time.Sleep(500 * time.Millisecond)
+	assert.Zero(t, srv.Task(id).RunnerID)
+	assert.Equal(t, drainDrained, call(http.MethodGet, "/drain"))
+
+	assert.Equal(t, drainActive, call(http.MethodPost, "/resume"))
+	task, err := srv.WaitForTask(ctx, id, func(t *fakegitea.Task) bool { return t.Finished() })
+	require.NoError(t, err)
+	assert.Equal(t, runnerv1.Result_RESULT_SUCCESS, task.State.Result)
+
+	stop()
+	assert.NoFileExists(t, admin.socket)
+}
@@ -0,0 +1,104 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gitea.com/gitea/act_runner/internal/pkg/metrics"
+)
+
+// The states of draining the runner.
+const (
+	drainActive   = "active"   // the runner takes new tasks
+	drainDraining = "draining" // the runner doesn't take new tasks, but some tasks are still running
+	drainDrained  = "drained"  // the runner doesn't take new tasks, and no task is running
+)
+
+// drainer drains and resumes the pollers of all instances served by the daemon, for maintenance of the host.
+type drainer struct {
+	ctx       context.Context
+	instances []*instance
+
+	mu          sync.Mutex
+	cancelWatch context.CancelFunc // cancelWatch stops watching the draining, it's nil if the runner is active.
+}
+
+func newDrainer(ctx context.Context, instances []*instance) *drainer {
+	return &drainer{
+		ctx:       ctx,
+		instances: instances,
+	}
+}
+
+// drain stops taking new tasks, the running tasks finish normally.
+func (d *drainer) drain() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cancelWatch != nil {
+		return
+	}
+	for _, in := range d.instances {
+		in.poller.Drain()
+	}
+	metrics.RunnerDraining.WithLabelValues().Set(1)
+	log.Info("draining the runner, no new task will be taken, the running ones will finish normally")
+
+	ctx, cancel := context.WithCancel(d.ctx)
+	d.cancelWatch = cancel
+	go d.watch(ctx)
+}
+
+// watch logs when the runner is drained.
+func (d *drainer) watch(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		if d.state() == drainDrained {
+			log.Info("the runner is drained, it can be resumed by SIGUSR2 or `POST /resume` of the admin API")
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// resume takes new tasks again.
+func (d *drainer) resume() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cancelWatch == nil {
+		return
+	}
+	d.cancelWatch()
+	d.cancelWatch = nil
+	for _, in := range d.instances {
+		in.poller.Resume()
+	}
+	metrics.RunnerDraining.WithLabelValues().Set(0)
+	log.Info("the runner is resumed, new tasks will be taken")
+}
+
+// state returns the state of draining the runner.
+func (d *drainer) state() string {
+	draining, drained := false, true
+	for _, in := range d.instances {
+		draining = draining || in.poller.Draining()
+		drained = drained && in.poller.Drained()
+	}
+	switch {
+	case !draining:
+		return drainActive
+	case drained:
+		return drainDrained
+	}
+	return drainDraining
+}
@@ -0,0 +1,96 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"slices"
+
+	log "github.com/sirupsen/logrus"
+
+	"gitea.com/gitea/act_runner/internal/app/poll"
+	"gitea.com/gitea/act_runner/internal/app/run"
+	"gitea.com/gitea/act_runner/internal/pkg/config"
+	"gitea.com/gitea/act_runner/internal/pkg/labels"
+)
+
+// instance is a registration served by the daemon, with its own client, runner and poller.
+type instance struct {
+	file string
+
+	reg    *config.Registration
+	labels labels.Labels
+	runner *run.Runner
+	poller *poll.Poller
+}
+
+// instanceConfig returns the config of the i-th registration served by the daemon, with the capacity limited by the one of the runner.
+// The first one is the registration of runner.file, the others are the ones of runner.instances.
+func instanceConfig(cfg *config.Config, i int) config.Instance {
+	if i == 0 {
+		return config.Instance{
+			File:     cfg.Runner.File,
+			Labels:   cfg.Runner.Labels,
+			Capacity: cfg.Runner.Capacity,
+			Weight:   cfg.Runner.Weight,
+		}
+	}
+	c := cfg.Runner.Instances[i-1]
+	if c.Capacity <= 0 || c.Capacity > cfg.Runner.Capacity {
+		c.Capacity = cfg.Runner.Capacity
+	}
+	return c
+}
+
+// loadInstances loads the registration files served by the daemon, and updates the labels in them to the configured ones.
+func loadInstances(cfg *config.Config, tokenKey []byte) ([]*instance, error) {
+	instances := make([]*instance, 0, len(cfg.Runner.Instances)+1)
+	for i := 0; i <= len(cfg.Runner.Instances); i++ {
+		file := instanceConfig(cfg, i).File
+		reg, err := config.LoadRegistration(file, tokenKey)
+		if os.IsNotExist(err) {
+			log.Errorf("registration file %s not found, please register the runner first", file)
+			return nil, err
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to load registration file %s: %w", file, err)
+		}
+		if tokenKey != nil && reg.EncryptedToken == "" {
+			// migrate the registration file created without the token key
+			if err := config.SaveRegistration(file, reg, tokenKey); err != nil {
+				return nil, fmt.Errorf("failed to encrypt the token in registration file %s: %w", file, err)
+			}
+			log.Infof("the token in registration file %s has been encrypted", file)
+		}
+
+		ls := loadLabels(instanceConfig(cfg, i).Labels, reg)
+		if len(ls) == 0 {
+			log.Warnf("no labels configured for registration file %s, runner may not be able to pick up jobs", file)
+		}
+		if !slices.Equal(reg.Labels, ls.ToStrings()) {
+			reg.Labels = ls.ToStrings()
+			if err := config.SaveRegistration(file, reg, tokenKey); err != nil {
+				return nil, fmt.Errorf("failed to save runner config: %w", err)
+			}
+			log.Infof("labels of runner %s updated to: %v", reg.Name, reg.Labels)
+		}
+
+		instances = append(instances, &instance{
+			file:   file,
+			reg:    reg,
+			labels: ls,
+		})
+	}
+	return instances, nil
+}
+
+// requireDocker returns true if any of the instances has a label running jobs in docker.
+func requireDocker(instances []*instance) bool {
+	for _, in := range instances {
+		if in.labels.RequireDocker() {
+			return true
+		}
+	}
+	return false
+}
@@ -6,6 +6,7 @@ package cmd
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
@@ -16,6 +17,7 @@ import (
 	pingv1 "code.gitea.io/actions-proto-go/ping/v1"
 	runnerv1 "code.gitea.io/actions-proto-go/runner/v1"
 	"connectrpc.com/connect"
+	"github.com/avast/retry-go/v4"
 	"github.com/mattn/go-isatty"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -46,7 +48,9 @@ func runRegister(ctx context.Context, regArgs *registerArgs, configFile *string)
 			log.Warnf("Runner in user-mode.")
 		}
 
-		if regArgs.NoInteractive {
+		if regArgs.Bootstrap {
+			return registerBootstrap(ctx, *configFile, regArgs)
+		} else if regArgs.NoInteractive {
 			if err := registerNoInteractive(ctx, *configFile, regArgs); err != nil {
 				return err
 			}
@@ -71,12 +75,21 @@ func runRegister(ctx context.Context, regArgs *registerArgs, configFile *string)
 // registerArgs represents the arguments for register command
 type registerArgs struct {
 	NoInteractive bool
+	Bootstrap     bool
 	InstanceAddr  string
 	Token         string
 	RunnerName    string
 	Labels        string
+	MaxAttempts   int
 }
 
+var (
+	// errUnreachable means the Gitea instance can't be reached.
+	errUnreachable = errors.New("cannot reach the Gitea instance")
+	// errRejected means the Gitea instance has rejected the registration, e.g. the token is invalid.
+	errRejected = errors.New("the registration is rejected")
+)
+
 type registerStage int8
 
 const (
@@ -101,6 +114,12 @@ type registerInputs struct {
 	Token        string
 	RunnerName   string
 	Labels       []string
+
+	// MaxAttempts is the maximum number of attempts to ping the instance, 0 means unlimited.
+	MaxAttempts uint
+	// InitialDelay is the delay after the first failed ping, it's doubled after each one up to MaxDelay.
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
 }
 
 func (r *registerInputs) validate() error {
@@ -288,6 +307,11 @@ func registerNoInteractive(ctx context.Context, configFile string, regArgs *regi
 }
 
 func doRegister(ctx context.Context, cfg *config.Config, inputs *registerInputs) error {
+	tokenKey, err := cfg.Runner.TokenKey.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load token key: %w", err)
+	}
+
 	// initial http client
 	cli := client.New(
 		inputs.InstanceAddr,
@@ -297,28 +321,37 @@ func doRegister(ctx context.Context, cfg *config.Config, inputs *registerInputs)
 		ver.Version(),
 	)
 
-	for {
+	// the delay is doubled after each failed attempt, it's constantly 1 second by default
+	delay, maxDelay := inputs.InitialDelay, inputs.MaxDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	if maxDelay < delay {
+		maxDelay = delay
+	}
+	err = retry.Do(func() error {
 		_, err := cli.Ping(ctx, connect.NewRequest(&pingv1.PingRequest{
 			Data: inputs.RunnerName,
 		}))
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
-		if ctx.Err() != nil {
-			break
-		}
-		if err != nil {
-			log.WithError(err).
-				Errorln("Cannot ping the Gitea instance server")
-			// TODO: if ping failed, retry or exit
-			time.Sleep(time.Second)
-		} else {
-			log.Debugln("Successfully pinged the Gitea instance server")
-			break
-		}
+		return err
+	},
+		retry.Context(ctx),
+		retry.Attempts(inputs.MaxAttempts),
+		retry.Delay(delay),
+		retry.MaxDelay(maxDelay),
+		retry.DelayType(retry.BackOffDelay),
+		retry.LastErrorOnly(true),
+		retry.OnRetry(func(n uint, err error) {
+			log.WithError(err).Errorf("Cannot ping the Gitea instance server, attempt %d", n+1)
+		}),
+	)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUnreachable, err)
 	}
+	log.Debugln("Successfully pinged the Gitea instance server")
 
 	reg := &config.Registration{
 		Name:    inputs.RunnerName,
@@ -342,7 +375,7 @@ func doRegister(ctx context.Context, cfg *config.Config, inputs *registerInputs)
 	}))
 	if err != nil {
 		log.WithError(err).Error("poller: cannot register new runner")
-		return err
+		return fmt.Errorf("%w: %v", errRejected, err)
 	}
 
 	reg.ID = resp.Msg.Runner.Id
@@ -350,7 +383,7 @@ func doRegister(ctx context.Context, cfg *config.Config, inputs *registerInputs)
 	reg.Name = resp.Msg.Runner.Name
 	reg.Token = resp.Msg.Runner.Token
 
-	if err := config.SaveRegistration(cfg.Runner.File, reg); err != nil {
+	if err := config.SaveRegistration(cfg.Runner.File, reg, tokenKey); err != nil {
 		return fmt.Errorf("failed to save runner config: %w", err)
 	}
 	return nil
@@ -0,0 +1,162 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"gitea.com/gitea/act_runner/internal/app/poll"
+	"gitea.com/gitea/act_runner/internal/pkg/config"
+	"gitea.com/gitea/act_runner/internal/pkg/labels"
+)
+
+// reloader applies the changes of the config file to a running daemon.
+type reloader struct {
+	configFile           string
+	configuredDockerHost string
+	tokenKey             []byte
+	instances            []*instance
+	scheduler            *poll.Scheduler
+	dockerRequired       bool // dockerRequired is true if the daemon has checked docker when it started.
+
+	cfg *config.Config
+}
+
+// reload loads the config file again and applies the changes which are safe to apply while running.
+// The settings which need a restart keep their current values.
+// The changed labels of all registrations are declared and saved first, the changes are applied only if all of them succeed,
+// otherwise the declared labels are restored and the daemon keeps running with the current config.
+func (rl *reloader) reload(ctx context.Context) error {
+	next, err := config.LoadDefault(rl.configFile)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if changed := rl.keepRestartOnly(next); len(changed) > 0 {
+		log.Warnf("changes of %s are ignored, they need a restart to take effect", strings.Join(changed, ", "))
+	}
+
+	nextLabels := make([]labels.Labels, len(rl.instances))
+	for i, in := range rl.instances {
+		ls := loadLabels(instanceConfig(next, i).Labels, in.reg)
+		if ls.RequireDocker() && !rl.dockerRequired {
+			log.Warnf("changes of labels of %s are ignored, they need a restart to take effect because docker is required now", in.file)
+			ls = in.labels
+		}
+		nextLabels[i] = ls
+	}
+	if err := rl.declareLabels(ctx, nextLabels); err != nil {
+		return err
+	}
+
+	for i, in := range rl.instances {
+		c := instanceConfig(next, i)
+		ls := nextLabels[i]
+		in.reg.Labels = ls.ToStrings()
+		in.runner.Reload(next, ls)
+		rl.scheduler.SetQueue(in.file, c.Weight, ls.FullNames())
+		in.poller.SetCapacity(c.Capacity)
+		in.labels = ls
+	}
+	initLogging(next)
+	rl.scheduler.SetCapacity(next.Runner.Capacity)
+	rl.scheduler.SetLabelCapacity(next.Runner.LabelCapacity)
+	rl.cfg = next
+
+	for _, in := range rl.instances {
+		log.Infof("configuration reloaded, capacity: %d, labels: %v", next.Runner.Capacity, in.reg.Labels)
+	}
+	return nil
+}
+
+// declareLabels declares and saves the labels of the instances which have been changed.
+// If it fails for any instance, the current labels of the instances done before are declared and saved again.
+func (rl *reloader) declareLabels(ctx context.Context, nextLabels []labels.Labels) (err error) {
+	var done []*instance
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, in := range done {
+			if _, err := in.runner.Declare(ctx, in.labels.Names()); err != nil {
+				log.WithError(err).Errorf("failed to restore the labels %v of %s", in.reg.Labels, in.file)
+			}
+			if err := config.SaveRegistration(in.file, in.reg, rl.tokenKey); err != nil {
+				log.WithError(err).Errorf("failed to restore the labels %v in %s", in.reg.Labels, in.file)
+			}
+		}
+	}()
+
+	for i, in := range rl.instances {
+		ls := nextLabels[i]
+		if slices.Equal(ls.ToStrings(), in.labels.ToStrings()) {
+			continue
+		}
+		done = append(done, in)
+		resp, err := in.runner.Declare(ctx, ls.Names())
+		if err != nil {
+			return fmt.Errorf("failed to declare labels %v of %s: %w", ls.ToStrings(), in.file, err)
+		}
+		log.Infof("runner: %s, with labels: %v, declare successfully", resp.Msg.Runner.Name, resp.Msg.Runner.Labels)
+
+		reg := *in.reg
+		reg.Labels = ls.ToStrings()
+		if err := config.SaveRegistration(in.file, &reg, rl.tokenKey); err != nil {
+			return fmt.Errorf("failed to save runner config: %w", err)
+		}
+	}
+	return nil
+}
+
+// keepRestartOnly resets the settings which can't be changed without a restart to their current values,
+// and returns the names of the ones which have been changed in the config file.
+func (rl *reloader) keepRestartOnly(next *config.Config) []string {
+	cur := rl.cfg
+	var changed []string
+	keep(&changed, "runner.file", cur.Runner.File, &next.Runner.File)
+	keep(&changed, "runner.insecure", cur.Runner.Insecure, &next.Runner.Insecure)
+	keep(&changed, "runner.fetch_timeout", cur.Runner.FetchTimeout, &next.Runner.FetchTimeout)
+	keep(&changed, "runner.fetch_interval", cur.Runner.FetchInterval, &next.Runner.FetchInterval)
+	keep(&changed, "runner.fetch_backoff", cur.Runner.FetchBackoff, &next.Runner.FetchBackoff)
+	keep(&changed, "runner.shutdown_timeout", cur.Runner.ShutdownTimeout, &next.Runner.ShutdownTimeout)
+	keep(&changed, "runner.spool_dir", cur.Runner.SpoolDir, &next.Runner.SpoolDir)
+	keep(&changed, "runner.token_key", cur.Runner.TokenKey, &next.Runner.TokenKey)
+	// the labels and the capacities of the registrations can be changed, but not the registrations themselves
+	if !slices.EqualFunc(cur.Runner.Instances, next.Runner.Instances, func(a, b config.Instance) bool { return a.File == b.File }) {
+		changed = append(changed, "runner.instances")
+		next.Runner.Instances = cur.Runner.Instances
+	}
+	keep(&changed, "cache", cur.Cache, &next.Cache)
+	keep(&changed, "metrics", cur.Metrics, &next.Metrics)
+	keep(&changed, "health", cur.Health, &next.Health)
+	keep(&changed, "pressure", cur.Pressure, &next.Pressure)
+	keep(&changed, "archive", cur.Archive, &next.Archive)
+	keep(&changed, "webhooks", cur.Webhooks, &next.Webhooks)
+	keep(&changed, "secrets", cur.Secrets, &next.Secrets)
+	keep(&changed, "unregister", cur.Unregister, &next.Unregister)
+	keep(&changed, "admin", cur.Admin, &next.Admin)
+
+	// the docker host could have been replaced by the detected one, so compare with the configured one
+	if next.Container.DockerHost != rl.configuredDockerHost {
+		changed = append(changed, "container.docker_host")
+	}
+	next.Container.DockerHost = cur.Container.DockerHost
+	// it could have been enabled by the command line flag
+	next.Runner.Ephemeral = cur.Runner.Ephemeral
+
+	return changed
+}
+
+func keep[T any](changed *[]string, name string, cur T, next *T) {
+	if !reflect.DeepEqual(cur, *next) {
+		*changed = append(*changed, name)
+		*next = cur
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	runnerv1 "code.gitea.io/actions-proto-go/runner/v1"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitea.com/gitea/act_runner/internal/app/poll"
+	"gitea.com/gitea/act_runner/internal/app/run"
+	"gitea.com/gitea/act_runner/internal/pkg/client"
+	"gitea.com/gitea/act_runner/internal/pkg/config"
+	"gitea.com/gitea/act_runner/internal/pkg/fakegitea"
+)
+
+// newTestReloader returns the reloader of the daemon of the config file, the pollers of its registrations are not started.
+func newTestReloader(t *testing.T, configFile string) *reloader {
+	cfg, err := config.LoadDefault(configFile)
+	require.NoError(t, err)
+	instances, err := loadInstances(cfg, nil)
+	require.NoError(t, err)
+	scheduler := poll.NewScheduler(cfg.Runner.Capacity)
+	for i, in := range instances {
+		cli := client.New(in.reg.Address, cfg.Runner.Insecure, in.reg.UUID, in.reg.Token, "test")
+		in.runner = run.NewRunner(cfg, in.reg, cli)
+		in.poller = poll.New(cfg, cli, in.runner)
+		c := instanceConfig(cfg, i)
+		scheduler.SetQueue(in.file, c.Weight, in.labels.FullNames())
+		in.poller.SetScheduler(scheduler, in.file)
+		in.poller.SetCapacity(c.Capacity)
+	}
+	return &reloader{
+		configFile: configFile,
+		instances:  instances,
+		scheduler:  scheduler,
+		cfg:        cfg,
+	}
+}
+
+func TestReloader_KeepRestartOnly(t *testing.T) {
+	cur, err := config.LoadDefault("")
+	require.NoError(t, err)
+	// the docker host detected when the daemon started
+	cur.Container.DockerHost = "unix:///var/run/docker.sock"
+
+	next, err := config.LoadDefault("")
+	require.NoError(t, err)
+	next.Runner.FetchInterval = time.Hour
+	next.Runner.Capacity = 5
+	next.Runner.Envs = map[string]string{"A": "a"}
+	next.Runner.Instances = []config.Instance{{File: ".runner2"}}
+	next.Admin.Enabled = true
+
+	rl := &reloader{cfg: cur}
+	changed := rl.keepRestartOnly(next)
+	assert.Equal(t, []string{"runner.fetch_interval", "runner.instances", "admin"}, changed)
+
+	// the restart-only settings are reverted
+	assert.Equal(t, cur.Runner.FetchInterval, next.Runner.FetchInterval)
+	assert.Empty(t, next.Runner.Instances)
+	assert.False(t, next.Admin.Enabled)
+	assert.Equal(t, "unix:///var/run/docker.sock", next.Container.DockerHost)
+	// the others are applied
+	assert.Equal(t, 5, next.Runner.Capacity)
+	assert.Equal(t, map[string]string{"A": "a"}, next.Runner.Envs)
+
+	next.Container.DockerHost = "tcp://docker:2376"
+	assert.Equal(t, []string{"container.docker_host"}, rl.keepRestartOnly(next))
+	assert.Equal(t, "unix:///var/run/docker.sock", next.Container.DockerHost)
+}
+
+func TestReloader_Reload(t *testing.T) {
+	srv, configFile := setupE2E(t)
+	replaceConfig := func(old, new string) {
+		content, err := os.ReadFile(configFile)
+		require.NoError(t, err)
+		require.Contains(t, string(content), old)
+		require.NoError(t, os.WriteFile(configFile, []byte(strings.Replace(string(content), old, new, 1)), 0o600))
+	}
+	replaceConfig("  labels:\n", "  envs:\n    RELOAD: old\n  labels:\n")
+
+	rl := newTestReloader(t, configFile)
+	in := rl.instances[0]
+	go in.poller.Poll()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		assert.NoError(t, in.poller.Shutdown(ctx))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// the running task keeps the settings it started with
+	release := filepath.Join(t.TempDir(), "release")
+	runningID := srv.AddTask(fakegitea.NewTask(fmt.Sprintf(`
+name: test
+on: push
+jobs:
+  job:
+    runs-on: e2e
+    steps:
+      - run: until [ -f %s ]; do sleep 0.1; done
+      - run: echo "RELOAD=$RELOAD"
+`, release)))
+	_, err := srv.WaitForTask(ctx, runningID, func(t *fakegitea.Task) bool { return t.RunnerID != 0 })
+	require.NoError(t, err)
+
+	replaceConfig("fetch_interval: 100ms", "fetch_interval: 1s\n  capacity: 2")
+	replaceConfig("RELOAD: old", "RELOAD: new")
+	replaceConfig("    - e2e:host\n", "    - e2e:host\n    - extra:host\n")
+
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	require.NoError(t, rl.reload(ctx))
+
+	// the restart-only settings are reported and kept
+	var warnings []string
+	for _, e := range hook.AllEntries() {
+		if e.Level == log.WarnLevel {
+			warnings = append(warnings, e.Message)
+		}
+	}
+	assert.Equal(t, []string{"changes of runner.fetch_interval are ignored, they need a restart to take effect"}, warnings)
+	assert.Equal(t, 100*time.Millisecond, rl.cfg.Runner.FetchInterval)
+	assert.Equal(t, 2, rl.cfg.Runner.Capacity)
+
+	// the labels are declared and saved
+	runners := srv.Runners()
+	require.Len(t, runners, 1)
+	assert.Equal(t, []string{"e2e", "extra"}, runners[0].Labels)
+	reg, err := config.LoadRegistration(in.file, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"e2e:host", "extra:host"}, reg.Labels)
+
+	// the new task runs with the new label, envs and capacity, while the other one is still running
+	id := srv.AddTask(fakegitea.NewTask(`
+name: test
+on: push
+jobs:
+  job:
+    runs-on: extra
+    steps:
+      - run: echo "RELOAD=$RELOAD"
+`))
+	task, err := srv.WaitForTask(ctx, id, func(t *fakegitea.Task) bool { return t.Finished() })
+	require.NoError(t, err)
+	assert.Equal(t, runnerv1.Result_RESULT_SUCCESS, task.State.Result)
+	assert.Contains(t, strings.Join(task.Logs, "\n"), "RELOAD=new")
+	assert.False(t, srv.Task(runningID).Finished())
+
+	require.NoError(t, os.WriteFile(release, nil, 0o600))
+	task, err = srv.WaitForTask(ctx, runningID, func(t *fakegitea.Task) bool { return t.Finished() })
+	require.NoError(t, err)
+	assert.Equal(t, runnerv1.Result_RESULT_SUCCESS, task.State.Result)
+	assert.Contains(t, strings.Join(task.Logs, "\n"), "RELOAD=old")
+}
+
+func TestReloader_ReloadDeclareFailed(t *testing.T) {
+	srv, configFile := setupE2E(t)
+	dir := filepath.Dir(configFile)
+
+	// register another runner to another Gitea instance
+	other := fakegitea.NewServer("other-token")
+	otherConfigFile := filepath.Join(dir, "other.yaml")
+	otherFile := filepath.Join(dir, ".runner-other")
+	require.NoError(t, os.WriteFile(otherConfigFile, []byte("runner:\n  file: "+otherFile+"\n"), 0o600))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	require.NoError(t, registerNoInteractive(ctx, otherConfigFile, &registerArgs{
+		NoInteractive: true,
+		InstanceAddr:  other.URL(),
+		Token:         "other-token",
+		RunnerName:    "other-runner",
+		Labels:        "other:host",
+	}))
+
+	content, err := os.ReadFile(configFile)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(configFile, []byte(strings.Replace(string(content), "runner:\n", fmt.Sprintf(`runner:
+  capacity: 2
+  instances:
+    - file: %s
+`, otherFile), 1)), 0o600))
+	rl := newTestReloader(t, configFile)
+	cfg := rl.cfg
+
+	content, err = os.ReadFile(configFile)
+	require.NoError(t, err)
+	content = []byte(strings.Replace(string(content), "capacity: 2", "capacity: 3", 1))
+	content = []byte(strings.Replace(string(content), "    - file: "+otherFile+"\n", "    - file: "+otherFile+"\n      labels:\n        - another:host\n", 1))
+	content = []byte(strings.Replace(string(content), "    - e2e:host\n", "    - e2e:host\n    - extra:host\n", 1))
+	require.NoError(t, os.WriteFile(configFile, content, 0o600))
+
+	// the other Gitea instance is down, so the labels of the second registration can't be declared
+	other.Close()
+	assert.ErrorContains(t, rl.reload(ctx), "failed to declare labels [another:host] of "+otherFile)
+
+	// nothing is changed, and the labels declared for the first registration are restored
+	assert.Same(t, cfg, rl.cfg)
+	for i, want := range [][]string{{"e2e:host"}, {"other:host"}} {
+		in := rl.instances[i]
+		assert.Equal(t, want, in.labels.ToStrings())
+		assert.Equal(t, want, in.reg.Labels)
+		reg, err := config.LoadRegistration(in.file, nil)
+		require.NoError(t, err)
+		assert.Equal(t, want, reg.Labels)
+	}
+	runners := srv.Runners()
+	require.Len(t, runners, 1)
+	assert.Equal(t, []string{"e2e"}, runners[0].Labels)
+}
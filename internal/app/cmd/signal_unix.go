@@ -0,0 +1,14 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+//go:build !windows
+
+package cmd
+
+import (
+	"os"
+	"syscall"
+)
+
+// drainSignal drains the runner and resumeSignal resumes it.
+var drainSignal, resumeSignal os.Signal = syscall.SIGUSR1, syscall.SIGUSR2
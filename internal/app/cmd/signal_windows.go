@@ -0,0 +1,9 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import "os"
+
+// drainSignal and resumeSignal are nil on Windows since there are no such signals, use the admin API instead.
+var drainSignal, resumeSignal os.Signal
@@ -0,0 +1,114 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"gitea.com/gitea/act_runner/internal/pkg/client"
+	"gitea.com/gitea/act_runner/internal/pkg/config"
+)
+
+// unregisterArgs represents the arguments for unregister command
+type unregisterArgs struct {
+	APIToken string
+	Archive  bool
+	Force    bool
+}
+
+func runUnregister(ctx context.Context, args *unregisterArgs, configFile *string) func(cmd *cobra.Command, args []string) error {
+	return func(_ *cobra.Command, _ []string) error {
+		cfg, err := config.LoadDefault(*configFile)
+		if err != nil {
+			return fmt.Errorf("invalid configuration: %w", err)
+		}
+		initLogging(cfg)
+
+		if args.APIToken != "" {
+			cfg.Unregister.APIToken = args.APIToken
+			cfg.Unregister.APITokenFile = ""
+		}
+		if args.Archive {
+			cfg.Unregister.Archive = true
+		}
+
+		tokenKey, err := cfg.Runner.TokenKey.Load()
+		if err != nil {
+			return fmt.Errorf("failed to load token key: %w", err)
+		}
+		reg, err := config.LoadRegistration(cfg.Runner.File, tokenKey)
+		if os.IsNotExist(err) {
+			log.Infof("registration file %s not found, the runner is not registered", cfg.Runner.File)
+			return nil
+		} else if err != nil {
+			if !args.Force {
+				return fmt.Errorf("failed to load registration file: %w", err)
+			}
+			log.WithError(err).Warn("failed to load registration file, it will be removed without deleting the runner on the Gitea instance")
+			return removeRegistration(cfg.Runner.File, cfg.Unregister.Archive)
+		}
+		return unregister(ctx, cfg, cfg.Runner.File, reg, args.Force)
+	}
+}
+
+// unregister deletes the runner on the Gitea instance if an API token is configured, then removes or archives its registration file.
+// The registration file is kept if the runner fails to be deleted, so it can be retried, unless force is true.
+func unregister(ctx context.Context, cfg *config.Config, file string, reg *config.Registration, force bool) error {
+	token, err := loadAPIToken(cfg.Unregister)
+	if err != nil && !force {
+		return err
+	}
+
+	if token == "" {
+		log.Warnf("no API token configured, runner %q (id %d) is not deleted on %s, please remove it in the web UI", reg.Name, reg.ID, reg.Address)
+	} else if err := client.DeleteRunner(ctx, reg.Address, cfg.Runner.Insecure, token, reg.ID); errors.Is(err, client.ErrUnsupported) {
+		log.Warnf("runner %q (id %d) is not deleted on %s: %v", reg.Name, reg.ID, reg.Address, err)
+	} else if err != nil {
+		if !force {
+			return fmt.Errorf("failed to delete runner %q on %s: %w", reg.Name, reg.Address, err)
+		}
+		log.WithError(err).Warnf("failed to delete runner %q on %s", reg.Name, reg.Address)
+	} else {
+		log.Infof("runner %q (id %d) deleted on %s", reg.Name, reg.ID, reg.Address)
+	}
+
+	return removeRegistration(file, cfg.Unregister.Archive)
+}
+
+// loadAPIToken returns the API token in the config, or the one in the token file.
+func loadAPIToken(cfg config.Unregister) (string, error) {
+	if cfg.APIToken != "" || cfg.APITokenFile == "" {
+		return cfg.APIToken, nil
+	}
+	content, err := os.ReadFile(cfg.APITokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read API token file: %w", err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// removeRegistration deletes the registration file, or renames it with a timestamp suffix if archive is true.
+func removeRegistration(file string, archive bool) error {
+	if archive {
+		archived := file + "." + time.Now().Format("20060102150405")
+		if err := os.Rename(file, archived); err != nil {
+			return fmt.Errorf("failed to archive registration file: %w", err)
+		}
+		log.Infof("registration file %s archived to %s", file, archived)
+		return nil
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove registration file: %w", err)
+	}
+	log.Infof("registration file %s removed", file)
+	return nil
+}
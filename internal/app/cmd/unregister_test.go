@@ -0,0 +1,59 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnregister(t *testing.T) {
+	srv, configFile := setupE2E(t)
+	srv.SetAdminToken("admin-token")
+	file := filepath.Join(filepath.Dir(configFile), ".runner")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the registration file is kept if the runner fails to be deleted
+	err := runUnregister(ctx, &unregisterArgs{APIToken: "wrong-token"}, &configFile)(nil, nil)
+	assert.ErrorContains(t, err, "401 Unauthorized")
+	assert.FileExists(t, file)
+	assert.Len(t, srv.Runners(), 1)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("admin-token\n"), 0o600))
+	content, err := os.ReadFile(configFile)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(configFile, append(content, []byte("unregister:\n  api_token_file: "+tokenFile+"\n")...), 0o600))
+
+	require.NoError(t, runUnregister(ctx, &unregisterArgs{Archive: true}, &configFile)(nil, nil))
+	assert.Empty(t, srv.Runners())
+	assert.NoFileExists(t, file)
+	archived, err := filepath.Glob(file + ".*")
+	require.NoError(t, err)
+	assert.Len(t, archived, 1)
+
+	// it's not an error if the runner isn't registered
+	require.NoError(t, runUnregister(ctx, &unregisterArgs{}, &configFile)(nil, nil))
+}
+
+func TestUnregister_Unsupported(t *testing.T) {
+	srv, configFile := setupE2E(t)
+	file := filepath.Join(filepath.Dir(configFile), ".runner")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the instance doesn't serve the admin API, so the runner can only be removed locally
+	require.NoError(t, runUnregister(ctx, &unregisterArgs{APIToken: "admin-token"}, &configFile)(nil, nil))
+	assert.Len(t, srv.Runners(), 1)
+	assert.NoFileExists(t, file)
+}
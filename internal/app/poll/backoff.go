@@ -0,0 +1,152 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package poll
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gitea.com/gitea/act_runner/internal/pkg/config"
+	"gitea.com/gitea/act_runner/internal/pkg/metrics"
+)
+
+// backoff delays fetching tasks after failures, so the runners don't overwhelm a Gitea instance which is down.
+//
+// The delay doubles after each consecutive failure up to a cap, and half of it is random, so the runners don't retry at the same time.
+// After too many consecutive failures, the circuit breaker opens, and a single attempt is made per cooldown period to probe the instance.
+// All of it is reset as soon as a fetch succeeds.
+//
+// The same error is logged once until it changes or the fetch succeeds, the repeated ones are logged at debug level.
+type backoff struct {
+	interval  time.Duration
+	maxDelay  time.Duration
+	threshold int
+	cooldown  time.Duration
+	circuit   *metrics.Gauge // circuit is 1 while the circuit breaker is open.
+
+	now    func() time.Time
+	sleep  func(ctx context.Context, d time.Duration) error
+	random func() float64
+
+	mu        sync.Mutex
+	failures  int
+	open      bool
+	next      time.Time // next is the time of the next attempt, when there are failures.
+	lastError string
+	repeated  int // repeated is the number of times lastError has been repeated without being logged.
+}
+
+func newBackoff(interval time.Duration, cfg config.FetchBackoff, circuit *metrics.Gauge) *backoff {
+	circuit.Set(0)
+	return &backoff{
+		interval:  interval,
+		maxDelay:  cfg.MaxDelay,
+		threshold: cfg.BreakerThreshold,
+		cooldown:  cfg.BreakerCooldown,
+		circuit:   circuit,
+		now:       time.Now,
+		sleep:     sleep,
+		random:    rand.Float64,
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// wait waits until the next attempt is allowed, or returns the error of ctx if ctx is done first.
+// After failures, only one caller is allowed per delay, the others wait for the result of its attempt.
+func (b *backoff) wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		now := b.now()
+		if b.failures == 0 {
+			b.mu.Unlock()
+			return nil
+		}
+		if !now.Before(b.next) {
+			// reserve the attempt, the next one is allowed after another delay unless this one succeeds
+			b.next = now.Add(b.delayLocked())
+			b.mu.Unlock()
+			return nil
+		}
+		d := b.next.Sub(now)
+		b.mu.Unlock()
+
+		if err := b.sleep(ctx, d); err != nil {
+			return err
+		}
+	}
+}
+
+// success resets the backoff and closes the circuit breaker.
+func (b *backoff) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures == 0 {
+		return
+	}
+	if b.open {
+		log.Infof("fetching tasks has succeeded after %d failures, the circuit breaker is closed", b.failures)
+		b.circuit.Set(0)
+	} else {
+		log.Infof("fetching tasks has succeeded after %d failures", b.failures)
+	}
+	b.failures = 0
+	b.open = false
+	b.next = time.Time{}
+	b.lastError = ""
+	b.repeated = 0
+}
+
+// failure records a failed attempt and delays the next one.
+func (b *backoff) failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if !b.open && b.threshold > 0 && b.failures >= b.threshold {
+		b.open = true
+		log.Warnf("fetching tasks has failed %d times in a row, the circuit breaker is open, it will be probed every %v", b.failures, b.cooldown)
+		b.circuit.Set(1)
+	}
+	delay := b.delayLocked()
+	b.next = b.now().Add(delay)
+
+	if msg := err.Error(); msg != b.lastError {
+		if b.repeated > 0 {
+			log.Errorf("failed to fetch task: %s (repeated %d times)", b.lastError, b.repeated)
+		}
+		log.WithError(err).Errorf("failed to fetch task, retry in %v", delay.Round(time.Millisecond))
+		b.lastError = msg
+		b.repeated = 0
+		return
+	}
+	b.repeated++
+	log.WithError(err).Debugf("failed to fetch task again, %d failures in a row, retry in %v", b.failures, delay.Round(time.Millisecond))
+}
+
+// delayLocked returns the delay after the current failures.
+func (b *backoff) delayLocked() time.Duration {
+	if b.open {
+		return b.cooldown
+	}
+	d := b.interval
+	for i := 1; i < b.failures && d < b.maxDelay; i++ {
+		d *= 2
+	}
+	d = min(d, b.maxDelay)
+	// equal jitter: half of the delay is fixed, so it still grows, and the other half is random
+	return d/2 + time.Duration(b.random()*float64(d/2))
+}
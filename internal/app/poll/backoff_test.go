@@ -0,0 +1,177 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package poll
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	runnerv1 "code.gitea.io/actions-proto-go/runner/v1"
+	"connectrpc.com/connect"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"gitea.com/gitea/act_runner/internal/pkg/client/mocks"
+	"gitea.com/gitea/act_runner/internal/pkg/config"
+	"gitea.com/gitea/act_runner/internal/pkg/metrics"
+)
+
+// fakeClock is a clock which only advances when something sleeps.
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Sleep(_ context.Context, d time.Duration) error {
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+	return nil
+}
+
+func newTestBackoff(random float64) (*backoff, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	b := newBackoff(time.Second, config.FetchBackoff{
+		MaxDelay:         8 * time.Second,
+		BreakerThreshold: 6,
+		BreakerCooldown:  time.Minute,
+	}, metrics.PollCircuitOpen.WithLabelValues("test"))
+	b.now = clock.Now
+	b.sleep = clock.Sleep
+	b.random = func() float64 { return random }
+	return b, clock
+}
+
+func TestBackoff(t *testing.T) {
+	b, clock := newTestBackoff(1)
+	ctx := context.Background()
+	errFetch := errors.New("unavailable")
+
+	// no delay without failures
+	require.NoError(t, b.wait(ctx))
+	require.NoError(t, b.wait(ctx))
+	assert.Empty(t, clock.sleeps)
+
+	// the delay doubles after each failure up to the cap, until the circuit breaker opens
+	for i := 0; i < 7; i++ {
+		b.failure(errFetch)
+		require.NoError(t, b.wait(ctx))
+	}
+	assert.Equal(t, []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second,
+		time.Minute, time.Minute,
+	}, clock.sleeps)
+	assert.True(t, b.open)
+	assert.Equal(t, float64(1), b.circuit.Value())
+
+	// it's reset as soon as a fetch succeeds
+	b.success()
+	assert.False(t, b.open)
+	assert.Zero(t, b.circuit.Value())
+	clock.sleeps = nil
+	require.NoError(t, b.wait(ctx))
+	b.failure(errFetch)
+	require.NoError(t, b.wait(ctx))
+	assert.Equal(t, []time.Duration{time.Second}, clock.sleeps)
+}
+
+func TestBackoff_SingleProbe(t *testing.T) {
+	b, clock := newTestBackoff(1)
+	ctx := context.Background()
+
+	b.failure(errors.New("unavailable"))
+	clock.now = clock.now.Add(time.Hour)
+
+	// the first caller after the delay makes the attempt, the others wait for another delay unless it succeeds
+	require.NoError(t, b.wait(ctx))
+	assert.Empty(t, clock.sleeps)
+	require.NoError(t, b.wait(ctx))
+	assert.Equal(t, []time.Duration{time.Second}, clock.sleeps)
+}
+
+func TestBackoff_Jitter(t *testing.T) {
+	b, clock := newTestBackoff(0)
+	ctx := context.Background()
+
+	// half of the delay is random
+	for i := 0; i < 3; i++ {
+		b.failure(errors.New("unavailable"))
+		require.NoError(t, b.wait(ctx))
+	}
+	assert.Equal(t, []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second}, clock.sleeps)
+}
+
+func TestBackoff_Logs(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	b, _ := newTestBackoff(1)
+
+	logged := func() []string {
+		var ret []string
+		for _, e := range hook.AllEntries() {
+			if e.Level <= log.ErrorLevel {
+				ret = append(ret, e.Message)
+			}
+		}
+		return ret
+	}
+
+	for i := 0; i < 3; i++ {
+		b.failure(errors.New("unavailable"))
+	}
+	assert.Equal(t, []string{"failed to fetch task, retry in 1s"}, logged())
+
+	b.failure(errors.New("unauthenticated"))
+	assert.Equal(t, []string{
+		"failed to fetch task, retry in 1s",
+		"failed to fetch task: unavailable (repeated 2 times)",
+		"failed to fetch task, retry in 8s",
+	}, logged())
+
+	// the same error is logged again after a success
+	b.success()
+	b.failure(errors.New("unauthenticated"))
+	assert.Len(t, logged(), 4)
+}
+
+func TestBackoff_FetchTimeout(t *testing.T) {
+	// Gitea accepts the connections but never answers
+	cli := mocks.NewClient(t)
+	cli.On("FetchTask", mock.Anything, mock.Anything).Return(func(ctx context.Context, _ *connect.Request[runnerv1.FetchTaskRequest]) (*connect.Response[runnerv1.FetchTaskResponse], error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	cfg, err := config.LoadDefault("")
+	require.NoError(t, err)
+	cfg.Runner.FetchTimeout = 10 * time.Millisecond
+	p := &Poller{
+		client:  cli,
+		cfg:     cfg,
+		backoff: newBackoff(time.Second, config.FetchBackoff{BreakerThreshold: 3}, metrics.PollCircuitOpen.WithLabelValues("test")),
+	}
+
+	for i := 0; i < 3; i++ {
+		_, ok := p.fetchTask(context.Background())
+		assert.False(t, ok)
+	}
+	// the timeouts count as failures, so the breaker opens and the health check fails
+	assert.True(t, p.backoff.open)
+	assert.Equal(t, 3, p.backoff.failures)
+	assert.EqualError(t, p.CheckHealth(3), "fetching tasks has failed 3 times in a row")
+
+	// stopping the poller isn't a failure
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, ok := p.fetchTask(ctx)
+	assert.False(t, ok)
+	assert.Equal(t, 3, p.backoff.failures)
+}
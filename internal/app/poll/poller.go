@@ -18,14 +18,38 @@ import (
 	"gitea.com/gitea/act_runner/internal/app/run"
 	"gitea.com/gitea/act_runner/internal/pkg/client"
 	"gitea.com/gitea/act_runner/internal/pkg/config"
+	"gitea.com/gitea/act_runner/internal/pkg/metrics"
+	"gitea.com/gitea/act_runner/internal/pkg/pressure"
 )
 
 type Poller struct {
 	client       client.Client
 	runner       *run.Runner
+	name         string // name is the name of the runner, to label the metrics.
 	cfg          *config.Config
 	tasksVersion atomic.Int64 // tasksVersion used to store the version of the last task fetched from the Gitea.
 
+	started       atomic.Bool
+	workers       atomic.Int64 // workers is the number of running poll goroutines.
+	fetchFailures atomic.Int64 // fetchFailures is the number of consecutive failed fetches.
+	pressured     atomic.Bool  // pressured indicates whether new tasks are held back because of the host resource pressure.
+	busy          atomic.Int64 // busy is the number of poll goroutines which are fetching or running a task.
+
+	pressure  *pressure.Monitor
+	backoff   *backoff
+	scheduler *Scheduler
+	queue     string // queue is the name of the queue of the poller in the scheduler.
+
+	limiter     *rate.Limiter
+	wg          sync.WaitGroup
+	workersMu   sync.Mutex
+	capacity    int                  // capacity is the number of poll goroutines to run.
+	stopWorkers []context.CancelFunc // stopWorkers has a function to stop each poll goroutine.
+
+	drainMu  sync.Mutex
+	draining bool
+	resumed  chan struct{} // resumed is closed when the poller isn't draining.
+
 	pollingCtx      context.Context
 	shutdownPolling context.CancelFunc
 
@@ -42,34 +66,99 @@ func New(cfg *config.Config, client client.Client, runner *run.Runner) *Poller {
 
 	done := make(chan struct{})
 
+	resumed := make(chan struct{})
+	close(resumed)
+
 	return &Poller{
 		client: client,
 		runner: runner,
+		name:   runner.Name(),
 		cfg:    cfg,
 
+		limiter:  rate.NewLimiter(rate.Every(cfg.Runner.FetchInterval), 1),
+		backoff:  newBackoff(cfg.Runner.FetchInterval, cfg.Runner.FetchBackoff, metrics.PollCircuitOpen.WithLabelValues(runner.Name())),
+		capacity: cfg.Runner.Capacity,
+
 		pollingCtx:      pollingCtx,
 		shutdownPolling: shutdownPolling,
 
 		jobsCtx:      jobsCtx,
 		shutdownJobs: shutdownJobs,
 
+		resumed: resumed,
+
 		done: done,
 	}
 }
 
 func (p *Poller) Poll() {
-	limiter := rate.NewLimiter(rate.Every(p.cfg.Runner.FetchInterval), 1)
-	wg := &sync.WaitGroup{}
-	for i := 0; i < p.cfg.Runner.Capacity; i++ {
-		wg.Add(1)
-		go p.poll(wg, limiter)
+	p.workersMu.Lock()
+	p.started.Store(true)
+	if p.cfg.Runner.Ephemeral {
+		// only one goroutine fetches tasks, so no more than one task can be received
+		p.capacity = 1
 	}
-	wg.Wait()
+	p.resizeLocked()
+	p.workersMu.Unlock()
+	p.wg.Wait()
 
 	// signal that we shutdown
 	close(p.done)
 }
 
+// SetPressureMonitor makes the poller take new tasks only when the host resources are within the thresholds of m.
+// It should be called before Poll.
+func (p *Poller) SetPressureMonitor(m *pressure.Monitor) {
+	p.pressure = m
+}
+
+// SetScheduler makes the poller take the slots to run tasks from the queue of s, which are shared with the other pollers of s.
+// It should be called before Poll.
+func (p *Poller) SetScheduler(s *Scheduler, queue string) {
+	p.scheduler = s
+	p.queue = queue
+}
+
+// SetCapacity changes the number of tasks which can run at the same time.
+// The poll goroutines to be stopped finish their running tasks first. It's ignored in ephemeral mode.
+func (p *Poller) SetCapacity(capacity int) {
+	if p.cfg.Runner.Ephemeral {
+		return
+	}
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+	p.capacity = max(capacity, 1)
+	if p.started.Load() {
+		p.resizeLocked()
+	}
+}
+
+// resizeLocked starts or stops poll goroutines to match the capacity.
+func (p *Poller) resizeLocked() {
+	if p.pollingCtx.Err() != nil {
+		return
+	}
+	n := p.capacity
+	for len(p.stopWorkers) < n {
+		ctx, cancel := context.WithCancel(p.pollingCtx)
+		p.stopWorkers = append(p.stopWorkers, cancel)
+		p.wg.Add(1)
+		p.workers.Add(1)
+		go p.poll(ctx)
+	}
+	for len(p.stopWorkers) > n {
+		last := len(p.stopWorkers) - 1
+		p.stopWorkers[last]()
+		p.stopWorkers = p.stopWorkers[:last]
+	}
+}
+
+// Done returns a channel which is closed when all poll goroutines have stopped,
+// it happens after Shutdown is called, or after the task has finished in ephemeral mode.
+func (p *Poller) Done() <-chan struct{} {
+	return p.done
+}
+
 func (p *Poller) Shutdown(ctx context.Context) error {
 	p.shutdownPolling()
 
@@ -99,24 +188,147 @@ func (p *Poller) Shutdown(ctx context.Context) error {
 	}
 }
 
-func (p *Poller) poll(wg *sync.WaitGroup, limiter *rate.Limiter) {
-	defer wg.Done()
+// Drain stops fetching new tasks, the running tasks finish normally.
+func (p *Poller) Drain() {
+	p.drainMu.Lock()
+	defer p.drainMu.Unlock()
+	if !p.draining {
+		p.draining = true
+		p.resumed = make(chan struct{})
+	}
+}
+
+// Resume starts fetching new tasks again after Drain.
+func (p *Poller) Resume() {
+	p.drainMu.Lock()
+	defer p.drainMu.Unlock()
+	if p.draining {
+		p.draining = false
+		close(p.resumed)
+	}
+}
+
+// Draining returns true if the poller has been drained and not resumed.
+func (p *Poller) Draining() bool {
+	p.drainMu.Lock()
+	defer p.drainMu.Unlock()
+	return p.draining
+}
+
+// Drained returns true if the poller is draining, and it's neither fetching nor running any task.
+func (p *Poller) Drained() bool {
+	return p.Draining() && p.busy.Load() == 0
+}
+
+// waitResumed waits until the poller isn't draining, or returns the error of ctx if ctx is done first.
+func (p *Poller) waitResumed(ctx context.Context) error {
+	p.drainMu.Lock()
+	resumed := p.resumed
+	p.drainMu.Unlock()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-resumed:
+		return nil
+	}
+}
+
+// CheckHealth returns an error if all poll goroutines have stopped,
+// or if fetching tasks has failed at least maxFetchFailures times in a row.
+func (p *Poller) CheckHealth(maxFetchFailures int) error {
+	if p.started.Load() && p.workers.Load() == 0 {
+		return errors.New("all poll goroutines have stopped")
+	}
+	if n := p.fetchFailures.Load(); maxFetchFailures > 0 && n >= int64(maxFetchFailures) {
+		return fmt.Errorf("fetching tasks has failed %d times in a row", n)
+	}
+	return nil
+}
+
+func (p *Poller) poll(ctx context.Context) {
+	defer p.wg.Done()
+	defer p.workers.Add(-1)
 	for {
-		if err := limiter.Wait(p.pollingCtx); err != nil {
-			if p.pollingCtx.Err() != nil {
+		if err := p.waitResumed(ctx); err != nil {
+			return
+		}
+		if err := p.limiter.Wait(ctx); err != nil {
+			if ctx.Err() != nil {
 				log.WithError(err).Debug("limiter wait failed")
 			}
 			return
 		}
+		if p.underPressure() {
+			continue
+		}
+		if err := p.backoff.wait(ctx); err != nil {
+			return
+		}
+		var slot *Slot
+		if p.scheduler != nil {
+			var err error
+			if slot, err = p.scheduler.Acquire(ctx, p.queue); err != nil {
+				return
+			}
+		}
+		// count the goroutine as busy before checking the drain state, so the poller isn't reported drained while it's fetching
+		p.busy.Add(1)
+		if p.Draining() {
+			p.busy.Add(-1)
+			if slot != nil {
+				slot.Release()
+			}
+			continue
+		}
+		// stopping the goroutine doesn't cancel the fetch, otherwise the task assigned by Gitea would be lost
 		task, ok := p.fetchTask(p.pollingCtx)
 		if !ok {
+			p.busy.Add(-1)
+			if slot != nil {
+				slot.Release()
+			}
 			continue
 		}
 
+		if slot != nil {
+			if err := slot.Bind(p.jobsCtx, p.runner.LabelOf(task)); err != nil {
+				// the task still runs, so it's reported as cancelled instead of being left on Gitea
+				log.WithError(err).Warnf("task %d was cancelled while waiting for a free slot of its label", task.Id)
+			}
+		}
 		p.runTaskWithRecover(p.jobsCtx, task)
+		p.busy.Add(-1)
+		if slot != nil {
+			slot.Release()
+		}
+
+		if p.cfg.Runner.Ephemeral {
+			p.shutdownPolling()
+			return
+		}
 	}
 }
 
+// underPressure returns true if the host is short of resources to take a new task.
+// It only logs when the state changes, since it's checked before every fetch.
+func (p *Poller) underPressure() bool {
+	if p.pressure == nil {
+		return false
+	}
+	if err := p.pressure.Check(); err != nil {
+		if !p.pressured.Swap(true) {
+			log.Warnf("stop taking new tasks: %v", err)
+			metrics.HostUnderPressure.WithLabelValues(p.name).Set(1)
+		}
+		return true
+	}
+	if p.pressured.Swap(false) {
+		log.Info("resume taking new tasks, the host resources are within the thresholds")
+		metrics.HostUnderPressure.WithLabelValues(p.name).Set(0)
+	}
+	return false
+}
+
 func (p *Poller) runTaskWithRecover(ctx context.Context, task *runnerv1.Task) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -136,16 +348,26 @@ func (p *Poller) fetchTask(ctx context.Context) (*runnerv1.Task, bool) {
 
 	// Load the version value that was in the cache when the request was sent.
 	v := p.tasksVersion.Load()
+	metrics.PollFetchTotal.WithLabelValues(p.name).Inc()
 	resp, err := p.client.FetchTask(reqCtx, connect.NewRequest(&runnerv1.FetchTaskRequest{
 		TasksVersion: v,
 	}))
+	if err != nil && ctx.Err() != nil {
+		// the poll goroutine is stopping, it's neither a success nor a failure
+		return nil, false
+	}
 	if errors.Is(err, context.DeadlineExceeded) {
-		err = nil
+		// Gitea answers a fetch at once, so hitting the timeout means it isn't responding, which is a failure like being down
+		err = fmt.Errorf("no response in %v: %w", p.cfg.Runner.FetchTimeout, err)
 	}
 	if err != nil {
-		log.WithError(err).Error("failed to fetch task")
+		p.backoff.failure(err)
+		metrics.PollFetchErrorsTotal.WithLabelValues(p.name).Inc()
+		p.fetchFailures.Add(1)
 		return nil, false
 	}
+	p.backoff.success()
+	p.fetchFailures.Store(0)
 
 	if resp == nil || resp.Msg == nil {
 		return nil, false
@@ -161,6 +383,7 @@ func (p *Poller) fetchTask(ctx context.Context) (*runnerv1.Task, bool) {
 
 	// got a task, set `tasksVersion` to zero to focre query db in next request.
 	p.tasksVersion.CompareAndSwap(resp.Msg.TasksVersion, 0)
+	metrics.PollTasksFetchedTotal.WithLabelValues(p.name).Inc()
 
 	return resp.Msg.Task, true
 }
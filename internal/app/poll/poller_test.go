@@ -0,0 +1,163 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package poll
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	runnerv1 "code.gitea.io/actions-proto-go/runner/v1"
+	"connectrpc.com/connect"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitea.com/gitea/act_runner/internal/app/run"
+	"gitea.com/gitea/act_runner/internal/pkg/client"
+	"gitea.com/gitea/act_runner/internal/pkg/config"
+	"gitea.com/gitea/act_runner/internal/pkg/fakegitea"
+	"gitea.com/gitea/act_runner/internal/pkg/metrics"
+)
+
+// newTestPoller registers a runner with a host label to a fake Gitea server, and returns a poller of it.
+func newTestPoller(t *testing.T, capacity int) (*fakegitea.Server, *Poller) {
+	srv := fakegitea.NewServer("registration-token")
+	t.Cleanup(srv.Close)
+
+	cfg, err := config.LoadDefault("")
+	require.NoError(t, err)
+	disabled := false
+	cfg.Cache.Enabled = &disabled
+	cfg.Host.WorkdirParent = filepath.Join(t.TempDir(), "work")
+	cfg.Runner.Capacity = capacity
+	cfg.Runner.FetchInterval = 50 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := client.New(srv.URL(), false, "", "", "test").Register(ctx, connect.NewRequest(&runnerv1.RegisterRequest{
+		Name:   "test-runner",
+		Token:  "registration-token",
+		Labels: []string{"test:host"},
+	}))
+	require.NoError(t, err)
+
+	reg := &config.Registration{
+		ID:      resp.Msg.Runner.Id,
+		UUID:    resp.Msg.Runner.Uuid,
+		Name:    resp.Msg.Runner.Name,
+		Token:   resp.Msg.Runner.Token,
+		Address: srv.URL(),
+		Labels:  []string{"test:host"},
+	}
+	cli := client.New(srv.URL(), false, reg.UUID, reg.Token, "test")
+	return srv, New(cfg, cli, run.NewRunner(cfg, reg, cli))
+}
+
+// addWaitingTask queues a task which keeps running until the returned function is called.
+func addWaitingTask(t *testing.T, srv *fakegitea.Server) (id int64, release func()) {
+	file := filepath.Join(t.TempDir(), "release")
+	id = srv.AddTask(fakegitea.NewTask(fmt.Sprintf(`
+name: test
+on: push
+jobs:
+  job:
+    runs-on: test
+    steps:
+      - run: until [ -f %s ]; do sleep 0.1; done
+`, file)))
+	return id, func() {
+		require.NoError(t, os.WriteFile(file, nil, 0o600))
+	}
+}
+
+func fetched(t *fakegitea.Task) bool {
+	return t.RunnerID != 0
+}
+
+func TestPoller_SetCapacity(t *testing.T) {
+	srv, p := newTestPoller(t, 1)
+	go p.Poll()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		assert.NoError(t, p.Shutdown(ctx))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	id1, release1 := addWaitingTask(t, srv)
+	id2, release2 := addWaitingTask(t, srv)
+	_, err := srv.WaitForTask(ctx, id1, fetched)
+	require.NoError(t, err)
+	time.Sleep(300 * time.Millisecond)
+	assert.Zero(t, srv.Task(id2).RunnerID, "no more than one task runs with capacity 1")
+
+	// a new poll goroutine takes the second task
+	p.SetCapacity(2)
+	_, err = srv.WaitForTask(ctx, id2, fetched)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, p.workers.Load())
+
+	// the stopped poll goroutine finishes its running task first
+	p.SetCapacity(1)
+	id3, release3 := addWaitingTask(t, srv)
+	time.Sleep(300 * time.Millisecond)
+	assert.EqualValues(t, 2, p.workers.Load())
+	assert.Zero(t, srv.Task(id3).RunnerID)
+
+	release1()
+	release2()
+	for _, id := range []int64{id1, id2} {
+		task, err := srv.WaitForTask(ctx, id, func(t *fakegitea.Task) bool { return t.Finished() })
+		require.NoError(t, err)
+		assert.Equal(t, runnerv1.Result_RESULT_SUCCESS, task.State.Result)
+	}
+	assert.Eventually(t, func() bool { return p.workers.Load() == 1 }, 10*time.Second, 50*time.Millisecond)
+
+	// the remaining poll goroutine keeps taking tasks
+	_, err = srv.WaitForTask(ctx, id3, fetched)
+	require.NoError(t, err)
+	release3()
+	task, err := srv.WaitForTask(ctx, id3, func(t *fakegitea.Task) bool { return t.Finished() })
+	require.NoError(t, err)
+	assert.Equal(t, runnerv1.Result_RESULT_SUCCESS, task.State.Result)
+}
+
+func TestPoller_CheckHealth(t *testing.T) {
+	t.Run("all workers stopped", func(t *testing.T) {
+		_, p := newTestPoller(t, 2)
+		assert.NoError(t, p.CheckHealth(0), "it's healthy before polling")
+
+		go p.Poll()
+		assert.Eventually(t, func() bool { return p.workers.Load() == 2 }, 10*time.Second, 10*time.Millisecond)
+		assert.NoError(t, p.CheckHealth(0))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		require.NoError(t, p.Shutdown(ctx))
+		assert.EqualError(t, p.CheckHealth(0), "all poll goroutines have stopped")
+	})
+
+	t.Run("max fetch failures reached", func(t *testing.T) {
+		srv, p := newTestPoller(t, 1)
+		// Gitea is down
+		srv.Close()
+		go p.Poll()
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			assert.NoError(t, p.Shutdown(ctx))
+		}()
+
+		assert.Eventually(t, func() bool { return p.CheckHealth(3) != nil }, 10*time.Second, 10*time.Millisecond)
+		assert.ErrorContains(t, p.CheckHealth(3), "fetching tasks has failed")
+		assert.GreaterOrEqual(t, metrics.PollFetchErrorsTotal.WithLabelValues("test-runner").Value(), float64(3), "the failures are counted by runner")
+		assert.NoError(t, p.CheckHealth(0), "the check of fetch failures is disabled")
+		assert.NoError(t, p.CheckHealth(1000))
+	})
+}
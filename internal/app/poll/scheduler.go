@@ -0,0 +1,228 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package poll
+
+import (
+	"context"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Scheduler holds the capacity of the runner, and hands out the slots to run tasks to the pollers of all registrations served by the daemon.
+//
+// A poll goroutine acquires a slot before fetching a task, so a task is never fetched without a slot to run it.
+// When several pollers are waiting, the slots are handed out in proportion to the weights of their queues,
+// by picking the queue which has run the fewest tasks relative to its weight.
+//
+// The tasks of a label can be capped, a task fetched for a capped label waits for its turn while holding the slot,
+// and a queue whose labels are all capped and busy doesn't get any slot, so its poller stops fetching until one of them is free.
+type Scheduler struct {
+	mu            sync.Mutex
+	capacity      int
+	used          int
+	labelCapacity map[string]int
+	labelUsed     map[string]int
+	queues        map[string]*queue
+	vtime         float64       // vtime is the largest served value of the queues when they are charged, an idle queue catches up with it when it's active again.
+	seq           uint64        // seq orders the waiters by their arrival.
+	changed       chan struct{} // changed is closed and replaced when a label slot is released or the capacities are changed.
+}
+
+type queue struct {
+	weight  int
+	labels  []string
+	served  float64 // served is the number of tasks run divided by the weight.
+	waiters []*waiter
+}
+
+type waiter struct {
+	seq     uint64
+	ready   chan struct{}
+	granted bool
+}
+
+// Slot is the right to run a task, it must be released after the task finishes or no task is fetched.
+type Slot struct {
+	s     *Scheduler
+	queue string
+	label string
+	bound bool
+}
+
+func NewScheduler(capacity int) *Scheduler {
+	return &Scheduler{
+		capacity:  max(capacity, 1),
+		labelUsed: map[string]int{},
+		queues:    map[string]*queue{},
+		changed:   make(chan struct{}),
+	}
+}
+
+// SetCapacity changes the number of tasks which can run at the same time, the slots in use beyond it are kept until they are released.
+func (s *Scheduler) SetCapacity(capacity int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.capacity = max(capacity, 1)
+	s.notifyLocked()
+}
+
+// SetLabelCapacity changes the number of tasks of each label which can run at the same time, the labels not in it aren't capped.
+func (s *Scheduler) SetLabelCapacity(capacity map[string]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.labelCapacity = capacity
+	s.notifyLocked()
+}
+
+// SetQueue sets the weight and the label names of a queue, which is the poller of a registration.
+// The label names are the full ones like "ubuntu-22.04+gpu", the same as the ones the tasks are bound to and runner.label_capacity is keyed by.
+func (s *Scheduler) SetQueue(name string, weight int, labels []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.queueLocked(name)
+	q.weight = max(weight, 1)
+	q.labels = labels
+	s.notifyLocked()
+}
+
+func (s *Scheduler) queueLocked(name string) *queue {
+	q, ok := s.queues[name]
+	if !ok {
+		q = &queue{weight: 1}
+		s.queues[name] = q
+	}
+	return q
+}
+
+// Acquire waits until a slot is handed out to the queue, or returns the error of ctx if ctx is done first.
+func (s *Scheduler) Acquire(ctx context.Context, name string) (*Slot, error) {
+	s.mu.Lock()
+	q := s.queueLocked(name)
+	if len(q.waiters) == 0 {
+		q.served = max(q.served, s.vtime)
+	}
+	w := &waiter{seq: s.seq, ready: make(chan struct{})}
+	s.seq++
+	q.waiters = append(q.waiters, w)
+	s.dispatchLocked()
+	s.mu.Unlock()
+
+	slot := &Slot{s: s, queue: name}
+	select {
+	case <-w.ready:
+		return slot, nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	granted := w.granted
+	if !granted {
+		for i, v := range q.waiters {
+			if v == w {
+				q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+				break
+			}
+		}
+	}
+	s.mu.Unlock()
+	if granted {
+		slot.Release()
+	}
+	return nil, ctx.Err()
+}
+
+// dispatchLocked hands out the free slots to the waiters of the queues which have been served least relative to their weights.
+func (s *Scheduler) dispatchLocked() {
+	for s.used < s.capacity {
+		var best *queue
+		for _, q := range s.queues {
+			if len(q.waiters) == 0 || s.blockedLocked(q) {
+				continue
+			}
+			if best == nil || q.served < best.served || (q.served == best.served && q.waiters[0].seq < best.waiters[0].seq) {
+				best = q
+			}
+		}
+		if best == nil {
+			return
+		}
+		w := best.waiters[0]
+		best.waiters = best.waiters[1:]
+		s.used++
+		w.granted = true
+		close(w.ready)
+	}
+}
+
+// blockedLocked returns true if all labels of the queue are capped and busy, so a task fetched for it would have to wait.
+func (s *Scheduler) blockedLocked(q *queue) bool {
+	if len(q.labels) == 0 {
+		return false
+	}
+	for _, label := range q.labels {
+		if c, ok := s.labelCapacity[label]; !ok || s.labelUsed[label] < c {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Scheduler) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+	s.dispatchLocked()
+}
+
+// Bind binds the slot to the label of the task fetched with it, and charges the queue of the slot for the task.
+// If the label is capped, it waits until the label has a free slot, or returns the error of ctx if ctx is done first.
+func (sl *Slot) Bind(ctx context.Context, label string) error {
+	s := sl.s
+	s.mu.Lock()
+	q := s.queueLocked(sl.queue)
+	s.vtime = max(s.vtime, q.served)
+	q.served += 1 / float64(q.weight)
+	logged := false
+	for {
+		if c, ok := s.labelCapacity[label]; !ok || s.labelUsed[label] < c {
+			s.labelUsed[label]++
+			sl.label, sl.bound = label, true
+			s.mu.Unlock()
+			return nil
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		if !logged {
+			log.Infof("the slots of label %q are all busy, the task waits for a free one", label)
+			logged = true
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+		s.mu.Lock()
+	}
+}
+
+// Release frees the slot, and the slot of its label if it's bound.
+func (sl *Slot) Release() {
+	s := sl.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used--
+	if sl.bound {
+		s.labelUsed[sl.label]--
+		sl.bound = false
+	}
+	s.notifyLocked()
+}
+
+// Used returns the number of slots in use.
+func (s *Scheduler) Used() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used
+}
@@ -0,0 +1,134 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package poll
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waiters returns the number of waiters of the queue.
+func (s *Scheduler) waiters(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queueLocked(name).waiters)
+}
+
+func TestScheduler_Capacity(t *testing.T) {
+	s := NewScheduler(2)
+	ctx := context.Background()
+	slot1, err := s.Acquire(ctx, "a")
+	require.NoError(t, err)
+	_, err = s.Acquire(ctx, "b")
+	require.NoError(t, err)
+	assert.Equal(t, 2, s.Used())
+
+	// no slot is free
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = s.Acquire(timeoutCtx, "a")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 0, s.waiters("a"))
+
+	acquired := make(chan error, 1)
+	go func() {
+		_, err := s.Acquire(ctx, "a")
+		acquired <- err
+	}()
+	slot1.Release()
+	require.NoError(t, <-acquired)
+	assert.Equal(t, 2, s.Used())
+
+	// a larger capacity frees slots at once
+	go func() {
+		_, err := s.Acquire(ctx, "b")
+		acquired <- err
+	}()
+	s.SetCapacity(3)
+	require.NoError(t, <-acquired)
+	assert.Equal(t, 3, s.Used())
+}
+
+func TestScheduler_Weights(t *testing.T) {
+	s := NewScheduler(1)
+	s.SetQueue("heavy", 2, nil)
+	s.SetQueue("light", 1, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	holder, err := s.Acquire(ctx, "holder")
+	require.NoError(t, err)
+
+	const n = 9
+	granted := make(chan string, 2*n)
+	for _, name := range []string{"heavy", "light"} {
+		for i := 0; i < n; i++ {
+			go func(name string) {
+				slot, err := s.Acquire(ctx, name)
+				if err != nil {
+					return
+				}
+				_ = slot.Bind(ctx, "")
+				granted <- name
+				slot.Release()
+			}(name)
+		}
+	}
+	require.Eventually(t, func() bool {
+		return s.waiters("heavy") == n && s.waiters("light") == n
+	}, 5*time.Second, 10*time.Millisecond)
+	holder.Release()
+
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		counts[<-granted]++
+	}
+	assert.Equal(t, map[string]int{"heavy": 6, "light": 3}, counts)
+}
+
+func TestScheduler_LabelCapacity(t *testing.T) {
+	s := NewScheduler(3)
+	s.SetLabelCapacity(map[string]int{"gpu": 1})
+	s.SetQueue("gpu", 1, []string{"gpu"})
+	s.SetQueue("mixed", 1, []string{"gpu", "cpu"})
+	ctx := context.Background()
+
+	gpu, err := s.Acquire(ctx, "gpu")
+	require.NoError(t, err)
+	require.NoError(t, gpu.Bind(ctx, "gpu"))
+
+	// the only label of the queue is busy, so it can't fetch tasks
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = s.Acquire(timeoutCtx, "gpu")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// the queue can fetch tasks of other labels, but a task of the busy label waits
+	mixed, err := s.Acquire(ctx, "mixed")
+	require.NoError(t, err)
+	bound := make(chan error, 1)
+	go func() {
+		bound <- mixed.Bind(ctx, "gpu")
+	}()
+	select {
+	case <-bound:
+		t.Fatal("the task of the busy label should wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	gpu.Release()
+	require.NoError(t, <-bound)
+
+	// the label is busy again
+	timeoutCtx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = s.Acquire(timeoutCtx, "gpu")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	mixed.Release()
+	_, err = s.Acquire(ctx, "gpu")
+	require.NoError(t, err)
+}
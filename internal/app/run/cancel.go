@@ -0,0 +1,268 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package run
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/nektos/act/pkg/model"
+	"github.com/rhysd/actionlint"
+	log "github.com/sirupsen/logrus"
+
+	"gitea.com/gitea/act_runner/internal/pkg/report"
+)
+
+// terminateFunc asks the processes of the running step to stop with SIGTERM.
+type terminateFunc func(ctx context.Context) error
+
+// cancelGracefully stops a cancelled job in two phases.
+// First, the running step is terminated, so the job fails and the remaining steps are skipped,
+// except the cleanup ones, which run along with the post steps like the job fails on its own.
+// Then the job is killed if it doesn't finish within the grace period.
+// cleanup reports whether each step is a cleanup step, see cleanupSteps.
+// It returns when ctx is done.
+func cancelGracefully(ctx context.Context, kill context.CancelFunc, grace time.Duration, reporter *report.Reporter, cleanup []bool, terminate terminateFunc) {
+	logStep(reporter, reporter.RunningStep(), "The task is cancelled, the job will be killed if it doesn't finish in %v", grace)
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	terminated := map[int]bool{}
+	for {
+		if i := reporter.RunningStep(); i >= 0 && !terminated[i] && !cleanup[i] {
+			terminated[i] = true
+			reporter.CancelStep(i)
+			if err := terminate(ctx); err != nil {
+				logStep(reporter, i, "Failed to stop the step, killing the job: %v", err)
+				kill()
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			logStep(reporter, reporter.RunningStep(), "The job didn't finish in %v after being cancelled, killing it", grace)
+			kill()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// logStep writes a log line to the step, or to the job if step is -1,
+// since the lines logged by Reporter.Logf are dropped when the steps are running.
+func logStep(reporter *report.Reporter, step int, format string, a ...interface{}) {
+	if step < 0 {
+		reporter.Logf(format, a...)
+		return
+	}
+	_ = reporter.Fire(&log.Entry{
+		Time:    time.Now(),
+		Message: fmt.Sprintf(format, a...),
+		Data:    log.Fields{"stage": "Main", "stepNumber": step, "raw_output": true},
+	})
+}
+
+// cleanupSteps returns whether each step is expected to run after the job is cancelled, see isCleanupStep.
+// It's computed before the job runs, since the conditions of the steps are changed by markCancelled.
+func cleanupSteps(steps []*model.Step) []bool {
+	ret := make([]bool, len(steps))
+	for i, step := range steps {
+		ret[i] = isCleanupStep(step)
+	}
+	return ret
+}
+
+// isCleanupStep returns whether the step is expected to run after the job is cancelled.
+// The condition is evaluated with the status functions only, `always()` and `cancelled()` are true,
+// `failure()` is true since the stopped step fails, and `success()` is false.
+// A step is a cleanup step unless its condition is false whatever the other parts of it are.
+func isCleanupStep(step *model.Step) bool {
+	expr, ok := conditionExpr(step.If.Value)
+	if !ok || strings.TrimSpace(expr) == "" {
+		return false
+	}
+	node, err := actionlint.NewExprParser().Parse(actionlint.NewExprLexer(expr + "}}"))
+	if err != nil {
+		return false
+	}
+	hasStatusCheck := false
+	actionlint.VisitExprNode(node, func(node, _ actionlint.ExprNode, entering bool) {
+		if call, ok := node.(*actionlint.FuncCallNode); entering && ok && isStatusCheck(call.Callee) {
+			hasStatusCheck = true
+		}
+	})
+	// the condition is `success() && (...)` without a status check function
+	if !hasStatusCheck {
+		return false
+	}
+	return evalCancelled(node) != tristateFalse
+}
+
+type tristate int
+
+const (
+	tristateUnknown tristate = iota
+	tristateTrue
+	tristateFalse
+)
+
+// evalCancelled evaluates the condition of a step after the job is cancelled, the values depending on the contexts are unknown.
+func evalCancelled(node actionlint.ExprNode) tristate {
+	switch n := node.(type) {
+	case *actionlint.BoolNode:
+		if n.Value {
+			return tristateTrue
+		}
+		return tristateFalse
+	case *actionlint.FuncCallNode:
+		switch strings.ToLower(n.Callee) {
+		case "always", "cancelled", "failure":
+			return tristateTrue
+		case "success":
+			return tristateFalse
+		}
+	case *actionlint.NotOpNode:
+		switch evalCancelled(n.Operand) {
+		case tristateTrue:
+			return tristateFalse
+		case tristateFalse:
+			return tristateTrue
+		}
+	case *actionlint.LogicalOpNode:
+		left, right := evalCancelled(n.Left), evalCancelled(n.Right)
+		if n.Kind == actionlint.LogicalOpNodeKindAnd {
+			if left == tristateFalse || right == tristateFalse {
+				return tristateFalse
+			}
+			if left == tristateTrue && right == tristateTrue {
+				return tristateTrue
+			}
+		} else {
+			if left == tristateTrue || right == tristateTrue {
+				return tristateTrue
+			}
+			if left == tristateFalse && right == tristateFalse {
+				return tristateFalse
+			}
+		}
+	}
+	return tristateUnknown
+}
+
+func isStatusCheck(name string) bool {
+	switch strings.ToLower(name) {
+	case "success", "always", "cancelled", "failure":
+		return true
+	}
+	return false
+}
+
+// conditionExpr returns the expression of the condition of a step without the "${{ }}" around it.
+// It returns false if the condition mixes expressions with text, which isn't supported.
+func conditionExpr(cond string) (string, bool) {
+	cond = strings.TrimSpace(cond)
+	if strings.HasPrefix(cond, "${{") && strings.HasSuffix(cond, "}}") {
+		cond = cond[len("${{") : len(cond)-len("}}")]
+	}
+	if strings.Contains(cond, "${{") || strings.Contains(cond, "}}") {
+		return "", false
+	}
+	return cond, true
+}
+
+// markCancelled replaces the calls of `cancelled()` in the condition of a step with `always()`,
+// since act doesn't know the job is cancelled and `cancelled()` is always false in it.
+func markCancelled(cond string) string {
+	expr, ok := conditionExpr(cond)
+	if !ok {
+		return cond
+	}
+	tokens, _, err := actionlint.LexExpression(expr + "}}")
+	if err != nil {
+		return cond
+	}
+	var sb strings.Builder
+	last := 0
+	for i := 0; i+2 < len(tokens); i++ {
+		if tokens[i].Kind == actionlint.TokenKindIdent && strings.EqualFold(tokens[i].Value, "cancelled") &&
+			tokens[i+1].Kind == actionlint.TokenKindLeftParen && tokens[i+2].Kind == actionlint.TokenKindRightParen {
+			sb.WriteString(expr[last:tokens[i].Offset])
+			sb.WriteString("always()")
+			last = tokens[i+2].Offset + 1
+		}
+	}
+	if last == 0 {
+		return cond
+	}
+	sb.WriteString(expr[last:])
+	return strings.TrimSpace(sb.String())
+}
+
+// hostTerminator terminates the process groups of the steps running on the host for the task,
+// which are recognized by the runtime token in their environments.
+func hostTerminator(runtimeToken string) terminateFunc {
+	return func(context.Context) error {
+		if runtimeToken == "" {
+			return fmt.Errorf("no runtime token to recognize the processes of the task")
+		}
+		return terminateChildren("ACTIONS_RUNTIME_TOKEN=" + runtimeToken)
+	}
+}
+
+// dockerTerminator sends SIGTERM to all processes in the job container of the task, except its init process.
+func dockerTerminator(dockerHost string, taskID int64) terminateFunc {
+	// see createSimpleContainerName in act, every part of the name only contains letters, digits and "-"
+	name := regexp.MustCompile(fmt.Sprintf(`^/GITEA-ACTIONS-TASK-%d_WORKFLOW-[A-Za-z0-9-]*_JOB-[A-Za-z0-9-]*$`, taskID))
+
+	return func(ctx context.Context) error {
+		opts := []client.Opt{
+			client.FromEnv,
+			client.WithAPIVersionNegotiation(),
+		}
+		if dockerHost != "" && dockerHost != "-" {
+			opts = append(opts, client.WithHost(dockerHost))
+		}
+		cli, err := client.NewClientWithOpts(opts...)
+		if err != nil {
+			return err
+		}
+		defer cli.Close()
+
+		containers, err := cli.ContainerList(ctx, container.ListOptions{
+			Filters: filters.NewArgs(filters.Arg("name", fmt.Sprintf("GITEA-ACTIONS-TASK-%d_", taskID))),
+		})
+		if err != nil {
+			return fmt.Errorf("list containers: %w", err)
+		}
+		for _, c := range containers {
+			for _, n := range c.Names {
+				if !name.MatchString(n) {
+					continue
+				}
+				exec, err := cli.ContainerExecCreate(ctx, c.ID, types.ExecConfig{
+					User: "0",
+					Cmd:  []string{"sh", "-c", "kill -TERM -1"},
+				})
+				if err != nil {
+					return fmt.Errorf("create exec in container %s: %w", n, err)
+				}
+				return cli.ContainerExecStart(ctx, exec.ID, types.ExecStartCheck{Detach: true})
+			}
+		}
+		return fmt.Errorf("no job container of task %d", taskID)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package run
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// terminateChildren sends SIGTERM to the process groups of the child processes which have env in their environments.
+// act starts every step on the host in a new process group, so the processes started by the step are terminated too.
+func terminateChildren(env string) error {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return err
+	}
+	ppid := strconv.Itoa(os.Getpid())
+
+	found := false
+	var errs []error
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// the command name in parentheses could contain spaces, the fields after it are "state ppid ..."
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if len(fields) < 2 || fields[1] != ppid {
+			continue
+		}
+		environ, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "environ"))
+		if err != nil || !containsEnv(environ, env) {
+			continue
+		}
+		found = true
+		if err := syscall.Kill(-pid, syscall.SIGTERM); err != nil && !errors.Is(err, syscall.ESRCH) {
+			errs = append(errs, fmt.Errorf("terminate process group %d: %w", pid, err))
+		}
+	}
+	if !found {
+		return fmt.Errorf("no process of the step is found")
+	}
+	return errors.Join(errs...)
+}
+
+// containsEnv returns whether the NUL-separated environ contains env.
+func containsEnv(environ []byte, env string) bool {
+	for _, v := range bytes.Split(environ, []byte{0}) {
+		if string(v) == env {
+			return true
+		}
+	}
+	return false
+}
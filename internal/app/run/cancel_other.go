@@ -0,0 +1,13 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+//go:build !linux
+
+package run
+
+import "errors"
+
+// terminateChildren is only supported on Linux, the job is killed at once on other platforms.
+func terminateChildren(string) error {
+	return errors.New("stopping a step on the host is not supported on this platform")
+}
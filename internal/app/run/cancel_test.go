@@ -0,0 +1,134 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package run
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	runnerv1 "code.gitea.io/actions-proto-go/runner/v1"
+	"github.com/nektos/act/pkg/model"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+	"gopkg.in/yaml.v3"
+
+	"gitea.com/gitea/act_runner/internal/pkg/report"
+)
+
+func stepIf(cond string) *model.Step {
+	return &model.Step{If: yaml.Node{Value: cond}}
+}
+
+func TestIsCleanupStep(t *testing.T) {
+	for cond, want := range map[string]bool{
+		"":                                false,
+		"github.ref == 'refs/heads/main'": false,
+		"success()":                       false,
+		"always()":                        true,
+		"cancelled()":                     true,
+		"${{ cancelled() }}":              true,
+		"failure()":                       true,
+		"!cancelled()":                    false,
+		"${{ !cancelled() }}":             false,
+		"!always()":                       false,
+		"always() && github.event_name == 'push'": true,
+		"cancelled() || failure()":                true,
+		"success() || cancelled()":                true,
+		"success() && always()":                   false,
+		"Always()":                                true,
+		"contains(github.ref, 'always()')":        false,
+		"${{ always() }} text":                    false,
+		"always(":                                 false,
+	} {
+		assert.Equal(t, want, isCleanupStep(stepIf(cond)), "if: %s", cond)
+	}
+}
+
+func TestMarkCancelled(t *testing.T) {
+	for cond, want := range map[string]string{
+		"":                                       "",
+		"always()":                               "always()",
+		"cancelled()":                            "always()",
+		"${{ !cancelled() }}":                    "!always()",
+		"Cancelled( ) && env.A == 'cancelled()'": "always() && env.A == 'cancelled()'",
+		"${{ always() }} text":                   "${{ always() }} text",
+	} {
+		assert.Equal(t, want, markCancelled(cond), "if: %s", cond)
+	}
+}
+
+func TestCancelGracefully(t *testing.T) {
+	newReporter := func(t *testing.T, steps int) *report.Reporter {
+		taskCtx, err := structpb.NewStruct(map[string]interface{}{})
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		r := report.NewReporter(ctx, cancel, nil, &runnerv1.Task{Context: taskCtx})
+		r.ResetSteps(steps)
+		return r
+	}
+	step := func(i int, fields log.Fields) *log.Entry {
+		data := log.Fields{"stage": "Main", "stepNumber": i}
+		for k, v := range fields {
+			data[k] = v
+		}
+		return &log.Entry{Time: time.Now(), Data: data}
+	}
+
+	t.Run("terminate the running step", func(t *testing.T) {
+		reporter := newReporter(t, 2)
+		require.NoError(t, reporter.Fire(step(0, log.Fields{"raw_output": true})))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var killed, terminated atomic.Int32
+		done := make(chan struct{})
+		go func() {
+			cancelGracefully(ctx, func() { killed.Add(1) }, time.Minute, reporter, []bool{false, true}, func(context.Context) error {
+				terminated.Add(1)
+				return nil
+			})
+			close(done)
+		}()
+		require.Eventually(t, func() bool { return terminated.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+		// the stopped step is reported as cancelled, and the cleanup step isn't terminated
+		require.NoError(t, reporter.Fire(step(0, log.Fields{"stepResult": "failure"})))
+		require.NoError(t, reporter.Fire(step(1, log.Fields{"raw_output": true})))
+		time.Sleep(1500 * time.Millisecond)
+		cancel()
+		<-done
+		assert.EqualValues(t, 1, terminated.Load())
+		assert.Zero(t, killed.Load())
+		assert.Equal(t, runnerv1.Result_RESULT_CANCELLED, reporter.State().Steps[0].Result)
+	})
+
+	t.Run("kill if the step can't be terminated", func(t *testing.T) {
+		reporter := newReporter(t, 1)
+		require.NoError(t, reporter.Fire(step(0, log.Fields{"raw_output": true})))
+
+		killed := false
+		cancelGracefully(context.Background(), func() { killed = true }, time.Minute, reporter, []bool{false}, func(context.Context) error {
+			return errors.New("no process")
+		})
+		assert.True(t, killed)
+	})
+
+	t.Run("kill after the grace period", func(t *testing.T) {
+		reporter := newReporter(t, 1)
+		require.NoError(t, reporter.Fire(step(0, log.Fields{"raw_output": true})))
+
+		killed := false
+		start := time.Now()
+		cancelGracefully(context.Background(), func() { killed = true }, 100*time.Millisecond, reporter, []bool{true}, func(context.Context) error {
+			return errors.New("the cleanup step should not be terminated")
+		})
+		assert.True(t, killed)
+		assert.Less(t, time.Since(start), 5*time.Second)
+	})
+}
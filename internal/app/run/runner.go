@@ -6,10 +6,13 @@ package run
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	runnerv1 "code.gitea.io/actions-proto-go/runner/v1"
@@ -23,7 +26,9 @@ import (
 
 	"gitea.com/gitea/act_runner/internal/pkg/client"
 	"gitea.com/gitea/act_runner/internal/pkg/config"
+	"gitea.com/gitea/act_runner/internal/pkg/event"
 	"gitea.com/gitea/act_runner/internal/pkg/labels"
+	"gitea.com/gitea/act_runner/internal/pkg/metrics"
 	"gitea.com/gitea/act_runner/internal/pkg/report"
 	"gitea.com/gitea/act_runner/internal/pkg/ver"
 )
@@ -32,29 +37,36 @@ import (
 type Runner struct {
 	name string
 
-	cfg *config.Config
+	client  client.Client
+	spool   *report.Spool
+	archive *report.Archive
+	events  *event.Emitter
+	secrets *config.SecretResolver
 
-	client client.Client
-	labels labels.Labels
-	envs   map[string]string
+	// cacheURL is the address of the cache server, it's empty if the cache is disabled.
+	cacheURL string
+
+	// systemEnvs are the environments set by the runner, they take precedence over the configured ones.
+	systemEnvs map[string]string
+	settings   atomic.Pointer[settings]
 
 	runningTasks sync.Map
 }
 
+// settings are the parts of the runner which can be reloaded,
+// a task keeps using the settings it started with until it finishes.
+type settings struct {
+	cfg          *config.Config
+	labels       labels.Labels
+	envs         map[string]string
+	pickPlatform func(runsOn []string) string
+}
+
 func NewRunner(cfg *config.Config, reg *config.Registration, cli client.Client) *Runner {
-	ls := labels.Labels{}
-	for _, v := range reg.Labels {
-		if l, err := labels.Parse(v); err == nil {
-			ls = append(ls, l)
-		}
-	}
-	envs := make(map[string]string, len(cfg.Runner.Envs))
-	for k, v := range cfg.Runner.Envs {
-		envs[k] = v
-	}
+	cacheURL := ""
 	if cfg.Cache.Enabled == nil || *cfg.Cache.Enabled {
 		if cfg.Cache.ExternalServer != "" {
-			envs["ACTIONS_CACHE_URL"] = cfg.Cache.ExternalServer
+			cacheURL = cfg.Cache.ExternalServer
 		} else {
 			cacheHandler, err := artifactcache.StartHandler(
 				cfg.Cache.Dir,
@@ -66,11 +78,85 @@ func NewRunner(cfg *config.Config, reg *config.Registration, cli client.Client)
 				log.Errorf("cannot init cache server, it will be disabled: %v", err)
 				// go on
 			} else {
-				envs["ACTIONS_CACHE_URL"] = cacheHandler.ExternalURL() + "/"
+				cacheURL = cacheHandler.ExternalURL() + "/"
 			}
 		}
 	}
 
+	var archive *report.Archive
+	if cfg.Archive.Enabled {
+		a, err := report.NewArchive(cfg.Archive)
+		if err != nil {
+			log.Errorf("cannot init archive, tasks will not be archived: %v", err)
+			// go on
+		} else {
+			archive = a
+		}
+	}
+
+	events := event.NewEmitter()
+	for _, c := range cfg.Webhooks {
+		w, err := event.NewWebhook(c)
+		if err != nil {
+			log.Errorf("cannot init webhook %q, it will be disabled: %v", c.URL, err)
+			continue
+		}
+		events.Add(w)
+	}
+
+	r := &Runner{
+		archive:  archive,
+		events:   events,
+		secrets:  config.NewSecretResolver(cfg.Secrets),
+		cacheURL: cacheURL,
+	}
+	r.init(cfg, reg, cli, cfg.Runner.SpoolDir)
+	return r
+}
+
+// NewInstance returns a runner for another registration served by the same daemon,
+// it shares the cache server, the archive, the event sinks and the secret cache with r.
+// The logs of its tasks are spooled in a subdirectory of the spool directory named after the UUID of the registration.
+func (r *Runner) NewInstance(reg *config.Registration, cli client.Client) *Runner {
+	cfg := r.settings.Load().cfg
+	spoolDir := ""
+	if cfg.Runner.SpoolDir != "" {
+		spoolDir = filepath.Join(cfg.Runner.SpoolDir, reg.UUID)
+	}
+	instance := &Runner{
+		archive:  r.archive,
+		events:   r.events,
+		secrets:  r.secrets,
+		cacheURL: r.cacheURL,
+	}
+	instance.init(cfg, reg, cli, spoolDir)
+	return instance
+}
+
+// init sets up the parts of the runner which belong to the registration.
+func (r *Runner) init(cfg *config.Config, reg *config.Registration, cli client.Client, spoolDir string) {
+	ls := labels.Labels{}
+	for _, v := range reg.Labels {
+		if l, err := labels.Parse(v); err == nil {
+			ls = append(ls, l)
+		}
+	}
+
+	if spoolDir != "" {
+		s, err := report.NewSpool(spoolDir)
+		if err != nil {
+			log.Errorf("cannot init spool, logs will not be persisted: %v", err)
+			// go on
+		} else {
+			r.spool = s
+		}
+	}
+
+	envs := map[string]string{}
+	if r.cacheURL != "" {
+		envs["ACTIONS_CACHE_URL"] = r.cacheURL
+	}
+
 	// set artifact gitea api
 	artifactGiteaAPI := strings.TrimSuffix(cli.Address(), "/") + "/api/actions_pipeline/"
 	envs["ACTIONS_RUNTIME_URL"] = artifactGiteaAPI
@@ -80,25 +166,98 @@ func NewRunner(cfg *config.Config, reg *config.Registration, cli client.Client)
 	envs["GITEA_ACTIONS"] = "true"
 	envs["GITEA_ACTIONS_RUNNER_VERSION"] = ver.Version()
 
-	return &Runner{
-		name:   reg.Name,
-		cfg:    cfg,
-		client: cli,
-		labels: ls,
-		envs:   envs,
+	r.name = reg.Name
+	r.client = cli
+	r.systemEnvs = envs
+	r.Reload(cfg, ls)
+}
+
+// Reload replaces the configuration and the labels used by the tasks started from now on,
+// the running tasks are not affected.
+func (r *Runner) Reload(cfg *config.Config, ls labels.Labels) {
+	pickPlatform, err := ls.PlatformPicker(cfg.Runner.DefaultPlatform)
+	if err != nil {
+		// It should not happen, because config.LoadDefault has checked it.
+		log.WithError(err).Warn("invalid default platform, the legacy default platform will be used")
+		pickPlatform = ls.PickPlatform
+	}
+
+	envs := make(map[string]string, len(cfg.Runner.Envs)+len(r.systemEnvs))
+	for k, v := range cfg.Runner.Envs {
+		envs[k] = v
+	}
+	for k, v := range r.systemEnvs {
+		envs[k] = v
+	}
+
+	r.settings.Store(&settings{
+		cfg:          cfg,
+		labels:       ls,
+		envs:         envs,
+		pickPlatform: pickPlatform,
+	})
+}
+
+// StartSpool replays the spooled logs and states of the previous tasks in background, if the spool is enabled.
+// It must be called before running any task.
+func (r *Runner) StartSpool(ctx context.Context) error {
+	if r.spool == nil {
+		return nil
 	}
+	return r.spool.Start(ctx, r.client, time.Minute)
+}
+
+// CloseEvents waits for the emitted events to be delivered until ctx is done.
+func (r *Runner) CloseEvents(ctx context.Context) error {
+	return r.events.Close(ctx)
+}
+
+// Name returns the name of the registration of the runner.
+func (r *Runner) Name() string {
+	return r.name
+}
+
+// LabelOf returns the full name of the label matching the job of the task, like "ubuntu-22.04+gpu", or an empty string if there isn't one.
+func (r *Runner) LabelOf(task *runnerv1.Task) string {
+	workflow, jobID, err := generateWorkflow(task)
+	if err != nil {
+		return ""
+	}
+	job := workflow.GetJob(jobID)
+	if job == nil {
+		return ""
+	}
+	if label := r.settings.Load().labels.Match(job.RunsOn()); label != nil {
+		return label.Name
+	}
+	return ""
 }
 
 func (r *Runner) Run(ctx context.Context, task *runnerv1.Task) error {
 	if _, ok := r.runningTasks.Load(task.Id); ok {
 		return fmt.Errorf("task %d is already running", task.Id)
 	}
-	r.runningTasks.Store(task.Id, struct{}{})
-	defer r.runningTasks.Delete(task.Id)
+	metrics.TasksRunning.WithLabelValues(r.name).Inc()
+	defer metrics.TasksRunning.WithLabelValues(r.name).Dec()
 
-	ctx, cancel := context.WithTimeout(ctx, r.cfg.Runner.Timeout)
+	r.events.Emit(r.taskEvent(task, event.TaskReceived))
+
+	st := r.settings.Load()
+	ctx, cancel := context.WithTimeout(ctx, st.cfg.Runner.Timeout)
 	defer cancel()
 	reporter := report.NewReporter(ctx, cancel, r.client, task)
+	reporter.SetSpool(r.spool)
+	rt := &runningTask{task: task, reporter: reporter, startedAt: time.Now(), done: make(chan struct{})}
+	r.runningTasks.Store(task.Id, rt)
+	defer r.runningTasks.Delete(task.Id)
+	defer close(rt.done)
+	if r.archive != nil {
+		if w, err := r.archive.Create(task); err != nil {
+			log.WithError(err).Warnf("failed to create archive of task %d", task.Id)
+		} else {
+			reporter.SetArchive(w)
+		}
+	}
 	var runErr error
 	defer func() {
 		lastWords := ""
@@ -106,14 +265,43 @@ func (r *Runner) Run(ctx context.Context, task *runnerv1.Task) error {
 			lastWords = runErr.Error()
 		}
 		_ = reporter.Close(lastWords)
+		state := reporter.State()
+		observeJob(r.name, state)
+
+		e := r.taskEvent(task, event.JobFinished)
+		if state.Result == runnerv1.Result_RESULT_CANCELLED || errors.Is(ctx.Err(), context.Canceled) {
+			e.Type = event.TaskCancelled
+		}
+		e.Result = resultName(state.Result)
+		if state.StartedAt != nil {
+			startedAt := state.StartedAt.AsTime()
+			e.StartedAt = &startedAt
+		}
+		// the error could contain the secrets, like the output of a failed command
+		e.Message = reporter.Mask(lastWords)
+		for _, a := range reporter.Annotations() {
+			e.Annotations = append(e.Annotations, &event.Annotation{
+				Level:     a.Level,
+				Message:   a.Message,
+				Title:     a.Title,
+				File:      a.File,
+				Line:      a.Line,
+				EndLine:   a.EndLine,
+				Col:       a.Col,
+				EndColumn: a.EndColumn,
+				Step:      a.Step,
+			})
+		}
+		r.events.Emit(e)
 	}()
 	reporter.RunDaemon()
-	runErr = r.run(ctx, task, reporter)
+	runErr = r.run(ctx, rt, st)
 
 	return nil
 }
 
-func (r *Runner) run(ctx context.Context, task *runnerv1.Task, reporter *report.Reporter) (err error) {
+func (r *Runner) run(ctx context.Context, rt *runningTask, st *settings) (err error) {
+	task, reporter := rt.task, rt.reporter
 	defer func() {
 		if r := recover(); r != nil {
 			err = fmt.Errorf("panic: %v", r)
@@ -133,6 +321,56 @@ func (r *Runner) run(ctx context.Context, task *runnerv1.Task, reporter *report.
 	}
 	job := workflow.GetJob(jobID)
 	reporter.ResetSteps(len(job.Steps))
+	steps := make([]string, 0, len(job.Steps))
+	for _, step := range job.Steps {
+		steps = append(steps, step.String())
+	}
+	rt.setSteps(steps)
+	cleanup := cleanupSteps(job.Steps)
+	// cancelling is set once the task is cancelled gracefully, then `cancelled()` is true in the conditions of the remaining steps
+	var cancelling, marked atomic.Bool
+	reporter.AddStepListener(func(index int, step *runnerv1.StepState) {
+		e := r.taskEvent(task, event.StepStarted)
+		e.Time = step.StartedAt.AsTime()
+		e.Step = &event.Step{Index: index, Name: steps[index]}
+		if step.Result != runnerv1.Result_RESULT_UNSPECIFIED {
+			e.Type = event.StepFinished
+			e.Time = step.StoppedAt.AsTime()
+			e.Step.Result = resultName(step.Result)
+
+			// act reports the result of a step on the goroutine running the steps before it evaluates the condition of the next one,
+			// so the conditions can be changed here without racing with act
+			if cancelling.Load() && !marked.Swap(true) {
+				for _, s := range job.Steps[index+1:] {
+					s.If.Value = markCancelled(s.If.Value)
+				}
+			}
+		}
+		r.events.Emit(e)
+	})
+
+	runsOn := job.RunsOn()
+	label := st.labels.Match(runsOn)
+	if label == nil {
+		if partial := st.labels.PartialMatch(runsOn); partial != nil {
+			return fmt.Errorf("runs-on %v only matches a part of label %q, it requires all of %v", runsOn, partial.Name, partial.Requires())
+		}
+		if st.cfg.Runner.DefaultPlatform == labels.DefaultPlatformReject {
+			return fmt.Errorf("runs-on %v doesn't match any label of the runner", runsOn)
+		}
+		reporter.Logf("runs-on %v doesn't match any label of the runner, fall back to the default platform %q", runsOn, st.pickPlatform(runsOn))
+	}
+	containerCfg := st.cfg.Container
+	resources := containerCfg.Resources
+	var profileEnvs map[string]string
+	if label != nil {
+		if profile := st.cfg.ProfileFor(label.Name); profile != "" {
+			reporter.Logf("use the container profile %q of label %q", profile, label.Name)
+		}
+		containerCfg, profileEnvs = st.cfg.ContainerFor(label.Name)
+		resources = containerCfg.ResourcesFor(label.Name)
+	}
+	containerOptions := strings.TrimSpace(containerCfg.Options + " " + applyResources(job, resources))
 
 	taskContext := task.Context.Fields
 
@@ -168,7 +406,19 @@ func (r *Runner) run(ctx context.Context, task *runnerv1.Task, reporter *report.
 		// use task token to action api token for previous Gitea Server Versions
 		giteaRuntimeToken = preset.Token
 	}
-	r.envs["ACTIONS_RUNTIME_TOKEN"] = giteaRuntimeToken
+	envs := maps.Clone(st.envs)
+	for k, v := range profileEnvs {
+		// the environments set by the runner take precedence
+		if _, ok := r.systemEnvs[k]; !ok {
+			envs[k] = v
+		}
+	}
+	envs, secrets, err := r.secrets.ResolveEnvs(ctx, envs)
+	if err != nil {
+		return err
+	}
+	reporter.AddMasks(secrets...)
+	envs["ACTIONS_RUNTIME_TOKEN"] = giteaRuntimeToken
 
 	eventJSON, err := json.Marshal(preset.Event)
 	if err != nil {
@@ -183,16 +433,16 @@ func (r *Runner) run(ctx context.Context, task *runnerv1.Task, reporter *report.
 	runnerConfig := &runner.Config{
 		// On Linux, Workdir will be like "/<parent_directory>/<owner>/<repo>"
 		// On Windows, Workdir will be like "\<parent_directory>\<owner>\<repo>"
-		Workdir:        filepath.FromSlash(fmt.Sprintf("/%s/%s", strings.TrimLeft(r.cfg.Container.WorkdirParent, "/"), preset.Repository)),
+		Workdir:        filepath.FromSlash(fmt.Sprintf("/%s/%s", strings.TrimLeft(st.cfg.Container.WorkdirParent, "/"), preset.Repository)),
 		BindWorkdir:    false,
-		ActionCacheDir: filepath.FromSlash(r.cfg.Host.WorkdirParent),
+		ActionCacheDir: filepath.FromSlash(st.cfg.Host.WorkdirParent),
 
 		ReuseContainers:       false,
-		ForcePull:             r.cfg.Container.ForcePull,
-		ForceRebuild:          r.cfg.Container.ForceRebuild,
+		ForcePull:             st.cfg.Container.ForcePull,
+		ForceRebuild:          st.cfg.Container.ForceRebuild,
 		LogOutput:             true,
 		JSONLogger:            false,
-		Env:                   r.envs,
+		Env:                   envs,
 		Secrets:               task.Secrets,
 		GitHubInstance:        strings.TrimSuffix(r.client.Address(), "/"),
 		AutoRemove:            true,
@@ -201,15 +451,15 @@ func (r *Runner) run(ctx context.Context, task *runnerv1.Task, reporter *report.
 		EventJSON:             string(eventJSON),
 		ContainerNamePrefix:   fmt.Sprintf("GITEA-ACTIONS-TASK-%d", task.Id),
 		ContainerMaxLifetime:  maxLifetime,
-		ContainerNetworkMode:  container.NetworkMode(r.cfg.Container.Network),
-		ContainerOptions:      r.cfg.Container.Options,
-		ContainerDaemonSocket: r.cfg.Container.DockerHost,
-		Privileged:            r.cfg.Container.Privileged,
+		ContainerNetworkMode:  container.NetworkMode(containerCfg.Network),
+		ContainerOptions:      containerOptions,
+		ContainerDaemonSocket: containerCfg.DockerHost,
+		Privileged:            containerCfg.Privileged,
 		DefaultActionInstance: taskContext["gitea_default_actions_url"].GetStringValue(),
-		PlatformPicker:        r.labels.PickPlatform,
+		PlatformPicker:        st.pickPlatform,
 		Vars:                  task.Vars,
-		ValidVolumes:          r.cfg.Container.ValidVolumes,
-		InsecureSkipTLS:       r.cfg.Runner.Insecure,
+		ValidVolumes:          containerCfg.ValidVolumes,
+		InsecureSkipTLS:       st.cfg.Runner.Insecure,
 	}
 
 	rr, err := runner.New(runnerConfig)
@@ -219,10 +469,25 @@ func (r *Runner) run(ctx context.Context, task *runnerv1.Task, reporter *report.
 	executor := rr.NewPlanExecutor(plan)
 
 	reporter.Logf("workflow prepared")
+	r.events.Emit(r.taskEvent(task, event.WorkflowPrepared))
 
 	// add logger recorders
 	ctx = common.WithLoggerHook(ctx, reporter)
 
+	// kill stops the job at once, the reporter keeps working to report the final state
+	ctx, kill := context.WithCancel(ctx)
+	defer kill()
+	if grace := st.cfg.Runner.CancelGrace; grace > 0 {
+		terminate := dockerTerminator(st.cfg.Container.DockerHost, task.Id)
+		if st.pickPlatform(runsOn) == labels.HostPlatform {
+			terminate = hostTerminator(giteaRuntimeToken)
+		}
+		reporter.SetCancelHandler(func() {
+			cancelling.Store(true)
+			go cancelGracefully(ctx, kill, grace, reporter, cleanup, terminate)
+		})
+	}
+
 	if !log.IsLevelEnabled(log.DebugLevel) {
 		ctx = runner.WithJobLoggerFactory(ctx, NullLogger{})
 	}
@@ -232,6 +497,37 @@ func (r *Runner) run(ctx context.Context, task *runnerv1.Task, reporter *report.
 	return execErr
 }
 
+// taskEvent returns an event of the task with the common fields set.
+func (r *Runner) taskEvent(task *runnerv1.Task, typ event.Type) *event.Event {
+	fields := task.Context.GetFields()
+	return &event.Event{
+		Type:       typ,
+		Time:       time.Now(),
+		Runner:     r.name,
+		TaskID:     task.Id,
+		Repository: fields["repository"].GetStringValue(),
+		Workflow:   fields["workflow"].GetStringValue(),
+		Job:        fields["job"].GetStringValue(),
+		RunID:      fields["run_id"].GetStringValue(),
+		RunNumber:  fields["run_number"].GetStringValue(),
+	}
+}
+
+// resultName returns the name of the result, like "success".
+func resultName(result runnerv1.Result) string {
+	return strings.ToLower(strings.TrimPrefix(result.String(), "RESULT_"))
+}
+
+// observeJob records the result and the duration of a finished job of the runner.
+func observeJob(runner string, state *runnerv1.TaskState) {
+	result := resultName(state.Result)
+	metrics.JobsTotal.WithLabelValues(runner, result).Inc()
+	if state.StartedAt != nil && state.StoppedAt != nil {
+		duration := state.StoppedAt.AsTime().Sub(state.StartedAt.AsTime())
+		metrics.JobDurationSeconds.WithLabelValues(runner, result).Observe(duration.Seconds())
+	}
+}
+
 func (r *Runner) Declare(ctx context.Context, labels []string) (*connect.Response[runnerv1.DeclareResponse], error) {
 	return r.client.Declare(ctx, connect.NewRequest(&runnerv1.DeclareRequest{
 		Version: ver.Version(),
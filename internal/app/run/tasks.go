@@ -0,0 +1,101 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package run
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	runnerv1 "code.gitea.io/actions-proto-go/runner/v1"
+
+	"gitea.com/gitea/act_runner/internal/pkg/config"
+	"gitea.com/gitea/act_runner/internal/pkg/report"
+)
+
+// runningTask is a task being run, it's kept in Runner.runningTasks for the introspection of the runner.
+type runningTask struct {
+	task      *runnerv1.Task
+	reporter  *report.Reporter
+	startedAt time.Time
+	done      chan struct{} // done is closed when the task has finished and its final logs have been written.
+
+	mu    sync.Mutex
+	steps []string // steps are the names of the steps of the job, they are known once the job is planned.
+}
+
+func (t *runningTask) setSteps(steps []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.steps = steps
+}
+
+// TaskInfo describes a running task.
+type TaskInfo struct {
+	ID        int64     `json:"id"`
+	Runner    string    `json:"runner"`
+	Repo      string    `json:"repo"`
+	Workflow  string    `json:"workflow"`
+	Job       string    `json:"job"`
+	StartedAt time.Time `json:"started_at"`
+	StepIndex int       `json:"step_index"` // StepIndex is the index of the running step, or -1 if no step is running.
+	Step      string    `json:"step"`       // Step is the name of the running step.
+}
+
+func (t *runningTask) info(runner string) TaskInfo {
+	fields := t.task.Context.GetFields()
+	info := TaskInfo{
+		ID:        t.task.Id,
+		Runner:    runner,
+		Repo:      fields["repository"].GetStringValue(),
+		Workflow:  fields["workflow"].GetStringValue(),
+		Job:       fields["job"].GetStringValue(),
+		StartedAt: t.startedAt,
+		StepIndex: t.reporter.RunningStep(),
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if info.StepIndex >= 0 && info.StepIndex < len(t.steps) {
+		info.Step = t.steps[info.StepIndex]
+	}
+	return info
+}
+
+// Tasks returns the running tasks ordered by ID.
+func (r *Runner) Tasks() []TaskInfo {
+	var ret []TaskInfo
+	r.runningTasks.Range(func(_, v interface{}) bool {
+		ret = append(ret, v.(*runningTask).info(r.name))
+		return true
+	})
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+// CancelTask cancels the running task like it's cancelled on Gitea, it returns false if the task isn't running.
+func (r *Runner) CancelTask(id int64) bool {
+	v, ok := r.runningTasks.Load(id)
+	if !ok {
+		return false
+	}
+	v.(*runningTask).reporter.Cancel()
+	return true
+}
+
+// TaskLogs returns the function reading the log rows of the running task, and a channel closed when the task finishes.
+// The function returns the rows starting at the index from, and the index of the first returned row,
+// it keeps working after the task finishes. It returns false if the task isn't running.
+func (r *Runner) TaskLogs(id int64) (logs func(from int) ([]*runnerv1.LogRow, int), done <-chan struct{}, ok bool) {
+	v, ok := r.runningTasks.Load(id)
+	if !ok {
+		return nil, nil, false
+	}
+	rt := v.(*runningTask)
+	return rt.reporter.Logs, rt.done, true
+}
+
+// Config returns the configuration used by the tasks started from now on.
+func (r *Runner) Config() *config.Config {
+	return r.settings.Load().cfg
+}
@@ -12,6 +12,8 @@ import (
 	runnerv1 "code.gitea.io/actions-proto-go/runner/v1"
 	"github.com/nektos/act/pkg/model"
 	"gopkg.in/yaml.v3"
+
+	"gitea.com/gitea/act_runner/internal/pkg/config"
 )
 
 func generateWorkflow(task *runnerv1.Task) (*model.Workflow, string, error) {
@@ -52,3 +54,30 @@ func generateWorkflow(task *runnerv1.Task) (*model.Workflow, string, error) {
 
 	return workflow, jobID, nil
 }
+
+// applyResources appends the options of the resource limits to the options of the containers of the job,
+// so the limits can't be overridden by the workflow.
+// The options for the job container are returned if the workflow doesn't specify any, they should be added to the options of the runner.
+func applyResources(job *model.Job, resources config.ContainerResources) string {
+	if options := resources.Service.Options(); options != "" {
+		for _, service := range job.Services {
+			if service != nil {
+				service.Options = strings.TrimSpace(service.Options + " " + options)
+			}
+		}
+	}
+
+	options := resources.Job.Options()
+	if options == "" || job.RawContainer.Kind != yaml.MappingNode {
+		return options
+	}
+	content := job.RawContainer.Content
+	for i := 0; i+1 < len(content); i += 2 {
+		if content[i].Value == "options" && content[i+1].Kind == yaml.ScalarNode {
+			content[i+1].Value = strings.TrimSpace(content[i+1].Value + " " + options)
+			content[i+1].Tag = "!!str"
+			return ""
+		}
+	}
+	return options
+}
@@ -4,12 +4,15 @@
 package run
 
 import (
+	"strings"
 	"testing"
 
 	runnerv1 "code.gitea.io/actions-proto-go/runner/v1"
 	"github.com/nektos/act/pkg/model"
 	"github.com/stretchr/testify/require"
 	"gotest.tools/v3/assert"
+
+	"gitea.com/gitea/act_runner/internal/pkg/config"
 )
 
 func Test_generateWorkflow(t *testing.T) {
@@ -72,3 +75,54 @@ jobs:
 		})
 	}
 }
+
+func Test_applyResources(t *testing.T) {
+	resources := config.ContainerResources{
+		Job:     config.Resources{Memory: "1GiB"},
+		Service: config.Resources{CPUs: 0.5},
+	}
+	read := func(t *testing.T, payload string) *model.Job {
+		workflow, err := model.ReadWorkflow(strings.NewReader(payload))
+		require.NoError(t, err)
+		return workflow.GetJob("job")
+	}
+
+	t.Run("without container options", func(t *testing.T) {
+		job := read(t, `
+on: push
+jobs:
+  job:
+    runs-on: ubuntu-latest
+    container: node:20
+    services:
+      db:
+        image: postgres
+    steps:
+      - run: echo
+`)
+		assert.Equal(t, "--memory=1073741824", applyResources(job, resources))
+		assert.Equal(t, "--cpus=0.5", job.Services["db"].Options)
+	})
+
+	t.Run("with container options", func(t *testing.T) {
+		job := read(t, `
+on: push
+jobs:
+  job:
+    runs-on: ubuntu-latest
+    container:
+      image: node:20
+      options: --memory=8g
+    services:
+      db:
+        image: postgres
+        options: --cpus=4
+    steps:
+      - run: echo
+`)
+		// the limits come last, so they take precedence
+		assert.Equal(t, "", applyResources(job, resources))
+		assert.Equal(t, "--memory=8g --memory=1073741824", job.Container().Options)
+		assert.Equal(t, "--cpus=4 --cpus=0.5", job.Services["db"].Options)
+	})
+}
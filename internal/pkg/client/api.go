@@ -0,0 +1,46 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ErrUnsupported is returned if the Gitea instance doesn't support the API, or the runner doesn't exist on it,
+// Gitea responds with 404 Not Found in both cases.
+var ErrUnsupported = errors.New("the Gitea instance doesn't support the API or the runner doesn't exist")
+
+// DeleteRunner deletes the runner with the admin API of Gitea, apiToken is an access token of an administrator.
+// There isn't a method in the runner API to do it, since a runner shouldn't be able to remove itself with its own token.
+func DeleteRunner(ctx context.Context, endpoint string, insecure bool, apiToken string, id int64) error {
+	url := fmt.Sprintf("%s/api/v1/admin/actions/runners/%d", strings.TrimRight(endpoint, "/"), id)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "token "+apiToken)
+
+	resp, err := getHTTPClient(endpoint, insecure).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return ErrUnsupported
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if msg := strings.TrimSpace(string(body)); msg != "" {
+		return fmt.Errorf("delete runner %d: %s: %s", id, resp.Status, msg)
+	}
+	return fmt.Errorf("delete runner %d: %s", id, resp.Status)
+}
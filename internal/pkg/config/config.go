@@ -9,9 +9,12 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/docker/go-units"
 	"github.com/joho/godotenv"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
+
+	"gitea.com/gitea/act_runner/internal/pkg/labels"
 )
 
 // Log represents the configuration for logging.
@@ -30,7 +33,23 @@ type Runner struct {
 	Insecure        bool              `yaml:"insecure"`         // Insecure indicates whether the runner operates in an insecure mode.
 	FetchTimeout    time.Duration     `yaml:"fetch_timeout"`    // FetchTimeout specifies the timeout duration for fetching resources.
 	FetchInterval   time.Duration     `yaml:"fetch_interval"`   // FetchInterval specifies the interval duration for fetching resources.
+	FetchBackoff    FetchBackoff      `yaml:"fetch_backoff"`    // FetchBackoff specifies how fetching tasks is delayed after failures.
 	Labels          []string          `yaml:"labels"`           // Labels specify the labels of the runner. Labels are declared on each startup
+	SpoolDir        string            `yaml:"spool_dir"`        // SpoolDir specifies the directory to persist unsent logs and states of tasks. If it's empty, they are kept in memory only.
+	DefaultPlatform string            `yaml:"default_platform"` // DefaultPlatform specifies how to run jobs which don't match any label, it could be "host", "docker://<image>" or "reject".
+	Ephemeral       bool              `yaml:"ephemeral"`        // Ephemeral indicates whether the runner exits after running a single task, and removes its registration file.
+	CancelGrace     time.Duration     `yaml:"cancel_grace"`     // CancelGrace specifies how long a cancelled task can take to stop its running step and run the cleanup steps before it's killed. A negative value means it's killed at once.
+	TokenKey        TokenKey          `yaml:"token_key"`        // TokenKey specifies where the key to encrypt the runner token in the registration file is read from.
+	Instances       []Instance        `yaml:"instances"`        // Instances represent the other registrations served by the daemon besides the one of File.
+	Weight          int               `yaml:"weight"`           // Weight specifies the share of the capacity for the registration of File when the registrations compete for it. Defaults to 1.
+	LabelCapacity   map[string]int    `yaml:"label_capacity"`   // LabelCapacity specifies how many tasks of each label can run at the same time, keyed by the full label name, like "ubuntu-22.04+gpu".
+}
+
+// FetchBackoff represents the configuration for delaying fetching tasks after failures.
+type FetchBackoff struct {
+	MaxDelay         time.Duration `yaml:"max_delay"`         // MaxDelay specifies the maximum delay between attempts, the delay starts from the fetch interval and doubles after each failure.
+	BreakerThreshold int           `yaml:"breaker_threshold"` // BreakerThreshold specifies the number of consecutive failures to open the circuit breaker. A negative value disables it.
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown"`  // BreakerCooldown specifies the delay between attempts while the circuit breaker is open.
 }
 
 // Cache represents the configuration for caching.
@@ -53,6 +72,9 @@ type Container struct {
 	DockerHost    string   `yaml:"docker_host"`    // DockerHost specifies the Docker host. It overrides the value specified in environment variable DOCKER_HOST.
 	ForcePull     bool     `yaml:"force_pull"`     // Pull docker image(s) even if already present
 	ForceRebuild  bool     `yaml:"force_rebuild"`  // Rebuild docker image(s) even if already present
+
+	Resources      ContainerResources            `yaml:"resources"`       // Resources specifies the resource limits of the job containers and the service containers.
+	LabelResources map[string]ContainerResources `yaml:"label_resources"` // LabelResources overrides the resource limits for the jobs matching the labels, keyed by the label name.
 }
 
 // Host represents the configuration for the host.
@@ -60,6 +82,70 @@ type Host struct {
 	WorkdirParent string `yaml:"workdir_parent"` // WorkdirParent specifies the parent directory for the host's working directory.
 }
 
+// Metrics represents the configuration for the Prometheus metrics endpoint.
+type Metrics struct {
+	Enabled bool   `yaml:"enabled"` // Enabled indicates whether the metrics endpoint is served.
+	Addr    string `yaml:"addr"`    // Addr specifies the address the metrics endpoint listens on.
+}
+
+// Health represents the configuration for the liveness and readiness endpoints.
+type Health struct {
+	Enabled          bool   `yaml:"enabled"`            // Enabled indicates whether the /healthz and /readyz endpoints are served.
+	Addr             string `yaml:"addr"`               // Addr specifies the address the endpoints listen on. It can be the same as the metrics address.
+	MaxFetchFailures int    `yaml:"max_fetch_failures"` // MaxFetchFailures specifies the number of consecutive failed fetches after which the runner is reported as not alive.
+}
+
+// Admin represents the configuration for the local admin API served on a Unix socket.
+type Admin struct {
+	Enabled bool   `yaml:"enabled"` // Enabled indicates whether the admin API is served.
+	Socket  string `yaml:"socket"`  // Socket specifies the path of the Unix socket, it's only accessible by the owner.
+}
+
+// Pressure represents the thresholds of host resources, no new task is taken while any of them is exceeded.
+type Pressure struct {
+	Enabled       bool    `yaml:"enabled"`         // Enabled indicates whether the runner takes new tasks only when the host has enough free resources.
+	MaxLoad       float64 `yaml:"max_load"`        // MaxLoad specifies the maximum 1-minute load average per CPU. 0 means no limit.
+	MinFreeMemory string  `yaml:"min_free_memory"` // MinFreeMemory specifies the minimum available memory, like "2GiB". Empty means no limit.
+	MinFreeDisk   string  `yaml:"min_free_disk"`   // MinFreeDisk specifies the minimum free disk space for the working directories and the Docker data root, like "10GiB". Empty means no limit.
+}
+
+// Archive represents the configuration for the local archive of task transcripts.
+type Archive struct {
+	Enabled  bool          `yaml:"enabled"`   // Enabled indicates whether the log rows, step states and results of tasks are written to local files.
+	Dir      string        `yaml:"dir"`       // Dir specifies the directory of the archive files.
+	Compress bool          `yaml:"compress"`  // Compress indicates whether the archive files are gzip-compressed.
+	MaxAge   time.Duration `yaml:"max_age"`   // MaxAge specifies how long the archive files are kept. 0 means forever.
+	MaxFiles int           `yaml:"max_files"` // MaxFiles specifies the maximum number of archive files to keep. 0 means no limit.
+}
+
+// Webhook represents the configuration for an HTTP endpoint which receives the lifecycle events of tasks.
+type Webhook struct {
+	URL        string        `yaml:"url"`         // URL specifies the endpoint the events are posted to.
+	Secret     string        `yaml:"secret"`      // Secret is used to sign the body with HMAC-SHA256. If it's empty, the body isn't signed.
+	Events     []string      `yaml:"events"`      // Events specify the types of events to send. If it's empty, all events are sent.
+	Timeout    time.Duration `yaml:"timeout"`     // Timeout specifies the timeout of each request.
+	MaxRetries int           `yaml:"max_retries"` // MaxRetries specifies the maximum number of retries of a failed request.
+}
+
+// Bootstrap represents the registration of the runner driven by the config file, see `act_runner register --bootstrap`.
+type Bootstrap struct {
+	Instance     string        `yaml:"instance"`      // Instance specifies the address of the Gitea instance.
+	Token        string        `yaml:"token"`         // Token specifies the registration token.
+	TokenFile    string        `yaml:"token_file"`    // TokenFile specifies the file containing the registration token, it's used if Token is empty.
+	Name         string        `yaml:"name"`          // Name specifies the name of the runner, it's a Go template, like "runner-{{ .Hostname }}".
+	MaxAttempts  int           `yaml:"max_attempts"`  // MaxAttempts specifies the maximum number of attempts to reach the instance. A negative value means unlimited.
+	InitialDelay time.Duration `yaml:"initial_delay"` // InitialDelay specifies the delay after the first failed attempt, it's doubled after each one.
+	MaxDelay     time.Duration `yaml:"max_delay"`     // MaxDelay specifies the maximum delay between attempts.
+}
+
+// Unregister represents the configuration for removing the runner, see `act_runner unregister`.
+type Unregister struct {
+	OnShutdown   bool   `yaml:"on_shutdown"`    // OnShutdown indicates whether to unregister the runner when the daemon shuts down gracefully.
+	APIToken     string `yaml:"api_token"`      // APIToken specifies an access token of an administrator, which is used to delete the runner on the Gitea instance.
+	APITokenFile string `yaml:"api_token_file"` // APITokenFile specifies the file containing the access token, it's used if APIToken is empty.
+	Archive      bool   `yaml:"archive"`        // Archive indicates whether to keep the registration file with a timestamp suffix instead of deleting it.
+}
+
 // Config represents the overall configuration.
 type Config struct {
 	Log       Log       `yaml:"log"`       // Log represents the configuration for logging.
@@ -67,6 +153,18 @@ type Config struct {
 	Cache     Cache     `yaml:"cache"`     // Cache represents the configuration for caching.
 	Container Container `yaml:"container"` // Container represents the configuration for the container.
 	Host      Host      `yaml:"host"`      // Host represents the configuration for the host.
+	Metrics   Metrics   `yaml:"metrics"`   // Metrics represents the configuration for the Prometheus metrics endpoint.
+	Health    Health    `yaml:"health"`    // Health represents the configuration for the liveness and readiness endpoints.
+	Admin     Admin     `yaml:"admin"`     // Admin represents the configuration for the local admin API.
+	Pressure  Pressure  `yaml:"pressure"`  // Pressure represents the thresholds of host resources for taking new tasks.
+	Archive   Archive   `yaml:"archive"`   // Archive represents the configuration for the local archive of task transcripts.
+	Webhooks  []Webhook `yaml:"webhooks"`  // Webhooks represent the HTTP endpoints which receive the lifecycle events of tasks.
+
+	Profiles map[string]Profile `yaml:"profiles"` // Profiles represent the container configurations bound to labels, keyed by the profile name.
+	Secrets  Secrets            `yaml:"secrets"`  // Secrets represents the configuration for resolving the secret references in environment variables.
+
+	Bootstrap  Bootstrap  `yaml:"bootstrap"`  // Bootstrap represents the registration of the runner driven by the config file.
+	Unregister Unregister `yaml:"unregister"` // Unregister represents the configuration for removing the runner.
 }
 
 // LoadDefault returns the default configuration.
@@ -128,12 +226,98 @@ func LoadDefault(file string) (*Config, error) {
 		home, _ := os.UserHomeDir()
 		cfg.Host.WorkdirParent = filepath.Join(home, ".cache", "act")
 	}
+	if cfg.Runner.CancelGrace == 0 {
+		cfg.Runner.CancelGrace = 10 * time.Second
+	}
 	if cfg.Runner.FetchTimeout <= 0 {
 		cfg.Runner.FetchTimeout = 5 * time.Second
 	}
 	if cfg.Runner.FetchInterval <= 0 {
 		cfg.Runner.FetchInterval = 2 * time.Second
 	}
+	if cfg.Runner.FetchBackoff.MaxDelay <= 0 {
+		cfg.Runner.FetchBackoff.MaxDelay = time.Minute
+	}
+	if cfg.Runner.FetchBackoff.BreakerThreshold == 0 {
+		cfg.Runner.FetchBackoff.BreakerThreshold = 10
+	}
+	if cfg.Runner.FetchBackoff.BreakerCooldown <= 0 {
+		cfg.Runner.FetchBackoff.BreakerCooldown = 2 * time.Minute
+	}
+	if cfg.Archive.Enabled && cfg.Archive.Dir == "" {
+		home, _ := os.UserHomeDir()
+		cfg.Archive.Dir = filepath.Join(home, ".cache", "act_runner", "archive")
+	}
+	for i := range cfg.Webhooks {
+		if cfg.Webhooks[i].Timeout <= 0 {
+			cfg.Webhooks[i].Timeout = 10 * time.Second
+		}
+		if cfg.Webhooks[i].MaxRetries < 0 {
+			cfg.Webhooks[i].MaxRetries = 0
+		}
+	}
+	if cfg.Secrets.CacheTTL == 0 {
+		cfg.Secrets.CacheTTL = 5 * time.Minute
+	}
+	if cfg.Secrets.Timeout <= 0 {
+		cfg.Secrets.Timeout = 10 * time.Second
+	}
+	if cfg.Bootstrap.Name == "" {
+		cfg.Bootstrap.Name = "{{ .Hostname }}"
+	}
+	if cfg.Bootstrap.MaxAttempts == 0 {
+		cfg.Bootstrap.MaxAttempts = 10
+	}
+	if cfg.Bootstrap.InitialDelay <= 0 {
+		cfg.Bootstrap.InitialDelay = time.Second
+	}
+	if cfg.Bootstrap.MaxDelay <= 0 {
+		cfg.Bootstrap.MaxDelay = time.Minute
+	}
+	if cfg.Metrics.Addr == "" {
+		cfg.Metrics.Addr = ":9101"
+	}
+	if cfg.Health.Addr == "" {
+		cfg.Health.Addr = ":9101"
+	}
+	if cfg.Health.MaxFetchFailures <= 0 {
+		cfg.Health.MaxFetchFailures = 10
+	}
+	if cfg.Admin.Socket == "" {
+		cfg.Admin.Socket = "act_runner.sock"
+	}
+
+	if _, err := labels.ParseDefaultPlatform(cfg.Runner.DefaultPlatform); err != nil {
+		return nil, fmt.Errorf("invalid runner.default_platform: %w", err)
+	}
+	if cfg.Pressure.MaxLoad < 0 {
+		return nil, fmt.Errorf("invalid pressure.max_load: %v is negative", cfg.Pressure.MaxLoad)
+	}
+	if cfg.Pressure.MinFreeMemory != "" {
+		if _, err := units.RAMInBytes(cfg.Pressure.MinFreeMemory); err != nil {
+			return nil, fmt.Errorf("invalid pressure.min_free_memory: %w", err)
+		}
+	}
+	if cfg.Pressure.MinFreeDisk != "" {
+		if _, err := units.RAMInBytes(cfg.Pressure.MinFreeDisk); err != nil {
+			return nil, fmt.Errorf("invalid pressure.min_free_disk: %w", err)
+		}
+	}
+	if err := cfg.Runner.TokenKey.validate(); err != nil {
+		return nil, fmt.Errorf("invalid runner.token_key: %w", err)
+	}
+	if err := cfg.validateInstances(); err != nil {
+		return nil, fmt.Errorf("invalid %w", err)
+	}
+	if err := cfg.Container.validateResources(); err != nil {
+		return nil, fmt.Errorf("invalid %w", err)
+	}
+	if err := cfg.validateProfiles(); err != nil {
+		return nil, fmt.Errorf("invalid %w", err)
+	}
+	if err := cfg.validateSecretRefs(); err != nil {
+		return nil, fmt.Errorf("invalid %w", err)
+	}
 
 	// although `container.network_mode` will be deprecated, but we have to be compatible with it for now.
 	if cfg.Container.NetworkMode != "" && cfg.Container.Network == "" {
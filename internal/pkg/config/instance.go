@@ -0,0 +1,66 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// Instance represents another registration served by the daemon, like one to another Gitea instance or organization.
+// The tasks of all registrations share the capacity of the runner.
+type Instance struct {
+	File     string   `yaml:"file"`     // File specifies the registration file.
+	Labels   []string `yaml:"labels"`   // Labels specify the labels of the registration, the ones in the registration file are used if it's empty.
+	Capacity int      `yaml:"capacity"` // Capacity specifies how many tasks of the registration can run at the same time, it's limited by the capacity of the runner.
+	Weight   int      `yaml:"weight"`   // Weight specifies the share of the capacity for the registration when the registrations compete for it. Defaults to 1.
+}
+
+// ValidateEphemeral checks that an ephemeral runner doesn't serve other registrations.
+// It's checked when the config is loaded, call it again if the runner is made ephemeral after that.
+func (c *Config) ValidateEphemeral() error {
+	if c.Runner.Ephemeral && len(c.Runner.Instances) > 0 {
+		return errors.New("runner.instances: an ephemeral runner can't serve other registrations")
+	}
+	return nil
+}
+
+// validateInstances checks that each registration file is served only once, and the weights and the capacities aren't negative.
+func (c *Config) validateInstances() error {
+	if c.Runner.Weight < 0 {
+		return fmt.Errorf("runner.weight: %d is negative", c.Runner.Weight)
+	}
+	for label, capacity := range c.Runner.LabelCapacity {
+		if label == "" {
+			return errors.New("runner.label_capacity: empty label name")
+		}
+		if capacity <= 0 {
+			return fmt.Errorf("runner.label_capacity.%s: %d is not positive", label, capacity)
+		}
+	}
+	if len(c.Runner.Instances) == 0 {
+		return nil
+	}
+	if err := c.ValidateEphemeral(); err != nil {
+		return err
+	}
+	files := map[string]bool{filepath.Clean(c.Runner.File): true}
+	for i, instance := range c.Runner.Instances {
+		if instance.File == "" {
+			return fmt.Errorf("runner.instances[%d].file: it's empty", i)
+		}
+		if files[filepath.Clean(instance.File)] {
+			return fmt.Errorf("runner.instances[%d].file: %s is served more than once", i, instance.File)
+		}
+		files[filepath.Clean(instance.File)] = true
+		if instance.Capacity < 0 {
+			return fmt.Errorf("runner.instances[%d].capacity: %d is negative", i, instance.Capacity)
+		}
+		if instance.Weight < 0 {
+			return fmt.Errorf("runner.instances[%d].weight: %d is negative", i, instance.Weight)
+		}
+	}
+	return nil
+}
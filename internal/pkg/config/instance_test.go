@@ -0,0 +1,82 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_validateInstances(t *testing.T) {
+	tests := []struct {
+		name    string
+		runner  Runner
+		wantErr string
+	}{
+		{
+			name:   "no instance",
+			runner: Runner{File: ".runner", Ephemeral: true},
+		},
+		{
+			name:   "valid",
+			runner: Runner{File: ".runner", Instances: []Instance{{File: ".runner-a", Capacity: 2}, {File: "data/.runner"}}},
+		},
+		{
+			name:    "empty file",
+			runner:  Runner{File: ".runner", Instances: []Instance{{Capacity: 2}}},
+			wantErr: "runner.instances[0].file: it's empty",
+		},
+		{
+			name:    "the file of the runner",
+			runner:  Runner{File: ".runner", Instances: []Instance{{File: "./.runner"}}},
+			wantErr: "runner.instances[0].file: ./.runner is served more than once",
+		},
+		{
+			name:    "duplicate files",
+			runner:  Runner{File: ".runner", Instances: []Instance{{File: ".runner-a"}, {File: ".runner-a"}}},
+			wantErr: "runner.instances[1].file: .runner-a is served more than once",
+		},
+		{
+			name:    "negative capacity",
+			runner:  Runner{File: ".runner", Instances: []Instance{{File: ".runner-a", Capacity: -1}}},
+			wantErr: "runner.instances[0].capacity: -1 is negative",
+		},
+		{
+			name:    "negative weight",
+			runner:  Runner{File: ".runner", Instances: []Instance{{File: ".runner-a", Weight: -1}}},
+			wantErr: "runner.instances[0].weight: -1 is negative",
+		},
+		{
+			name:    "negative weight of the runner",
+			runner:  Runner{File: ".runner", Weight: -1},
+			wantErr: "runner.weight: -1 is negative",
+		},
+		{
+			name:   "label capacity",
+			runner: Runner{File: ".runner", LabelCapacity: map[string]int{"gpu-sim": 1}},
+		},
+		{
+			name:    "zero label capacity",
+			runner:  Runner{File: ".runner", LabelCapacity: map[string]int{"gpu-sim": 0}},
+			wantErr: "runner.label_capacity.gpu-sim: 0 is not positive",
+		},
+		{
+			name:    "ephemeral",
+			runner:  Runner{File: ".runner", Ephemeral: true, Instances: []Instance{{File: ".runner-a"}}},
+			wantErr: "runner.instances: an ephemeral runner can't serve other registrations",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Runner: tt.runner}
+			err := cfg.validateInstances()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// readKeyring reads the payload of a "user" key from the session keyring or the user keyring,
+// like the one added by `keyctl add user <description> <key> @u`.
+func readKeyring(description string) ([]byte, error) {
+	var id int
+	var err error
+	for _, ring := range []int{unix.KEY_SPEC_SESSION_KEYRING, unix.KEY_SPEC_USER_KEYRING} {
+		if id, err = unix.KeyctlSearch(ring, "user", description, 0); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	if n > len(buf) {
+		return nil, errors.New("the key changed while being read")
+	}
+	return buf[:n], nil
+}
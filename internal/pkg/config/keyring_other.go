@@ -0,0 +1,12 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+//go:build !linux
+
+package config
+
+import "errors"
+
+func readKeyring(string) ([]byte, error) {
+	return nil, errors.New("the kernel keyring is only supported on Linux")
+}
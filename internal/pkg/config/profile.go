@@ -0,0 +1,98 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Profile represents the container configuration for the jobs of some labels, the fields which are not set fall back to the ones of Container.
+type Profile struct {
+	Labels       []string          `yaml:"labels"`        // Labels specify the names of the labels whose jobs use the profile.
+	Network      string            `yaml:"network"`       // Network specifies the network for the container.
+	Privileged   *bool             `yaml:"privileged"`    // Privileged indicates whether the container runs in privileged mode. It is a pointer to distinguish between false and not set.
+	Options      string            `yaml:"options"`       // Options specifies additional options for the container, it replaces the options of Container.
+	ValidVolumes []string          `yaml:"valid_volumes"` // ValidVolumes specifies the volumes (including bind mounts) can be mounted to containers, it replaces the ones of Container.
+	DockerHost   string            `yaml:"docker_host"`   // DockerHost specifies the Docker socket mounted to the job containers, "-" means not to mount it.
+	Envs         map[string]string `yaml:"envs"`          // Envs stores environment variables for the jobs, they take precedence over the ones of Runner.
+}
+
+// ProfileFor returns the name of the profile bound to the label, or an empty string if there isn't one.
+func (c *Config) ProfileFor(label string) string {
+	for name, p := range c.Profiles {
+		for _, l := range p.Labels {
+			if l == label {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// ContainerFor returns the container configuration and the extra environment variables for the jobs of the label,
+// with the profile bound to the label applied.
+func (c *Config) ContainerFor(label string) (Container, map[string]string) {
+	ret := c.Container
+	name := c.ProfileFor(label)
+	if name == "" {
+		return ret, nil
+	}
+	p := c.Profiles[name]
+	if p.Network != "" {
+		ret.Network = p.Network
+	}
+	if p.Privileged != nil {
+		ret.Privileged = *p.Privileged
+	}
+	if p.Options != "" {
+		ret.Options = p.Options
+	}
+	if p.ValidVolumes != nil {
+		ret.ValidVolumes = p.ValidVolumes
+	}
+	if p.DockerHost != "" {
+		ret.DockerHost = p.DockerHost
+	}
+	return ret, p.Envs
+}
+
+// validateProfiles checks that each label is bound to one profile at most, and the containers of the profiles are valid.
+func (c *Config) validateProfiles() error {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bound := map[string]string{}
+	for _, name := range names {
+		p := c.Profiles[name]
+		if len(p.Labels) == 0 {
+			return fmt.Errorf("profiles.%s: no label is bound to it", name)
+		}
+		for _, label := range p.Labels {
+			if label == "" {
+				return fmt.Errorf("profiles.%s: empty label name", name)
+			}
+			if other, ok := bound[label]; ok {
+				return fmt.Errorf("profiles.%s: label %q is already bound to profile %q", name, label, other)
+			}
+			bound[label] = name
+		}
+		// the runner always connects to the Docker daemon of container.docker_host, a profile can only change the mounted socket
+		if i := strings.Index(p.DockerHost, "://"); i >= 0 {
+			if scheme := p.DockerHost[:i]; !strings.EqualFold(scheme, "unix") && !strings.EqualFold(scheme, "npipe") {
+				return fmt.Errorf("profiles.%s.docker_host: the %s socket can't be mounted to the job containers", name, scheme)
+			}
+		}
+
+		container, _ := c.ContainerFor(p.Labels[0])
+		if err := container.validateResources(); err != nil {
+			return fmt.Errorf("profiles.%s: %w", name, err)
+		}
+	}
+	return nil
+}
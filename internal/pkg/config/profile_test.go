@@ -0,0 +1,90 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_ContainerFor(t *testing.T) {
+	privileged := true
+	cfg := &Config{
+		Container: Container{
+			Network:      "bridge",
+			Options:      "--add-host=gitea:host-gateway",
+			ValidVolumes: []string{"data"},
+			DockerHost:   "unix:///var/run/docker.sock",
+		},
+		Profiles: map[string]Profile{
+			"dind": {
+				Labels:       []string{"ubuntu-dind"},
+				Privileged:   &privileged,
+				ValidVolumes: []string{},
+				DockerHost:   "-",
+				Envs:         map[string]string{"DOCKER_TLS_CERTDIR": ""},
+			},
+		},
+	}
+
+	c, envs := cfg.ContainerFor("ubuntu-latest")
+	assert.Equal(t, cfg.Container, c)
+	assert.Nil(t, envs)
+	assert.Equal(t, "", cfg.ProfileFor("ubuntu-latest"))
+
+	c, envs = cfg.ContainerFor("ubuntu-dind")
+	assert.Equal(t, "dind", cfg.ProfileFor("ubuntu-dind"))
+	assert.Equal(t, Container{
+		Network:      "bridge",
+		Privileged:   true,
+		Options:      "--add-host=gitea:host-gateway",
+		ValidVolumes: []string{},
+		DockerHost:   "-",
+	}, c)
+	assert.Equal(t, map[string]string{"DOCKER_TLS_CERTDIR": ""}, envs)
+	assert.False(t, cfg.Container.Privileged)
+}
+
+func TestLoadDefault_Profiles(t *testing.T) {
+	load := func(t *testing.T, content string) error {
+		file := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+		_, err := LoadDefault(file)
+		return err
+	}
+
+	assert.NoError(t, load(t, `
+profiles:
+  dind:
+    labels: [ubuntu-dind]
+    privileged: true
+`))
+	assert.EqualError(t, load(t, `
+profiles:
+  a:
+    labels: [ubuntu-dind]
+  b:
+    labels: [ubuntu-dind]
+`), `invalid profiles.b: label "ubuntu-dind" is already bound to profile "a"`)
+	assert.EqualError(t, load(t, `
+profiles:
+  remote:
+    labels: [ubuntu-latest]
+    docker_host: tcp://docker:2375
+`), "invalid profiles.remote.docker_host: the tcp socket can't be mounted to the job containers")
+	assert.EqualError(t, load(t, `
+container:
+  resources:
+    job:
+      memory: 4GiB
+profiles:
+  big:
+    labels: [ubuntu-latest]
+    options: --memory=8g
+`), "invalid profiles.big: container.options: --memory conflicts with container.resources, set the limit in container.resources instead")
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import "slices"
+
+// redacted replaces the secrets in the config shown to the users.
+const redacted = "<redacted>"
+
+// Redacted returns a copy of the config with the values which could contain secrets redacted:
+// the tokens, the webhook URLs and secrets, the options of the containers and the values of the environment variables.
+// The secret references are kept since they don't contain the secrets.
+func (c *Config) Redacted() *Config {
+	ret := *c
+	redact := func(v *string) {
+		if *v != "" {
+			*v = redacted
+		}
+	}
+	redactEnvs := func(envs map[string]string) map[string]string {
+		if envs == nil {
+			return nil
+		}
+		ret := make(map[string]string, len(envs))
+		for k, v := range envs {
+			if _, _, ok := ParseSecretRef(v); !ok {
+				redact(&v)
+			}
+			ret[k] = v
+		}
+		return ret
+	}
+
+	redact(&ret.Bootstrap.Token)
+	redact(&ret.Unregister.APIToken)
+	redact(&ret.Secrets.Vault.Token)
+	ret.Runner.Envs = redactEnvs(c.Runner.Envs)
+	// the options could pass secrets to the containers, like "-e TOKEN=..."
+	redact(&ret.Container.Options)
+	// the URL of a webhook could contain a token, like the ones of Slack
+	ret.Webhooks = slices.Clone(c.Webhooks)
+	for i := range ret.Webhooks {
+		redact(&ret.Webhooks[i].URL)
+		redact(&ret.Webhooks[i].Secret)
+	}
+	if c.Profiles != nil {
+		ret.Profiles = make(map[string]Profile, len(c.Profiles))
+		for name, p := range c.Profiles {
+			redact(&p.Options)
+			p.Envs = redactEnvs(p.Envs)
+			ret.Profiles[name] = p
+		}
+	}
+	return &ret
+}
@@ -0,0 +1,53 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_Redacted(t *testing.T) {
+	cfg := &Config{
+		Runner: Runner{Envs: map[string]string{"PLAIN": "value", "REF": "file:///run/secrets/token"}},
+		Container: Container{
+			Network: "host",
+			Options: "-e TOKEN=secret",
+		},
+		Bootstrap: Bootstrap{
+			Instance: "https://gitea.com",
+			Token:    "registration-token",
+		},
+		Unregister: Unregister{APIToken: "api-token"},
+		Webhooks:   []Webhook{{URL: "https://hooks.example.com/T000/B000/token", Secret: "webhook-secret"}},
+		Profiles: map[string]Profile{"gpu": {
+			Labels:  []string{"gpu"},
+			Options: "--gpus all -e KEY=secret",
+			Envs:    map[string]string{"KEY": "value"},
+		}},
+	}
+	ret := cfg.Redacted()
+
+	assert.Equal(t, map[string]string{"PLAIN": "<redacted>", "REF": "file:///run/secrets/token"}, ret.Runner.Envs)
+	assert.Equal(t, "host", ret.Container.Network)
+	assert.Equal(t, "<redacted>", ret.Container.Options)
+	assert.Equal(t, "https://gitea.com", ret.Bootstrap.Instance)
+	assert.Equal(t, "<redacted>", ret.Bootstrap.Token)
+	assert.Equal(t, "<redacted>", ret.Unregister.APIToken)
+	assert.Empty(t, ret.Secrets.Vault.Token)
+	assert.Equal(t, "<redacted>", ret.Webhooks[0].URL)
+	assert.Equal(t, "<redacted>", ret.Webhooks[0].Secret)
+	assert.Equal(t, []string{"gpu"}, ret.Profiles["gpu"].Labels)
+	assert.Equal(t, "<redacted>", ret.Profiles["gpu"].Options)
+	assert.Equal(t, map[string]string{"KEY": "<redacted>"}, ret.Profiles["gpu"].Envs)
+
+	// the original config is not changed
+	assert.Equal(t, "value", cfg.Runner.Envs["PLAIN"])
+	assert.Equal(t, "-e TOKEN=secret", cfg.Container.Options)
+	assert.Equal(t, "https://hooks.example.com/T000/B000/token", cfg.Webhooks[0].URL)
+	assert.Equal(t, "webhook-secret", cfg.Webhooks[0].Secret)
+	assert.Equal(t, "--gpus all -e KEY=secret", cfg.Profiles["gpu"].Options)
+	assert.Equal(t, "value", cfg.Profiles["gpu"].Envs["KEY"])
+}
@@ -5,24 +5,34 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
+	"runtime"
+
+	log "github.com/sirupsen/logrus"
 )
 
 const registrationWarning = "This file is automatically generated by act-runner. Do not edit it manually unless you know what you are doing. Removing this file will cause act runner to re-register as a new runner."
 
+// registrationFileMode is the permission of the registration file, since the token grants access to the tasks.
+const registrationFileMode = 0o600
+
 // Registration is the registration information for a runner
 type Registration struct {
 	Warning string `json:"WARNING"` // Warning message to display, it's always the registrationWarning constant
 
-	ID      int64    `json:"id"`
-	UUID    string   `json:"uuid"`
-	Name    string   `json:"name"`
-	Token   string   `json:"token"`
-	Address string   `json:"address"`
-	Labels  []string `json:"labels"`
+	ID             int64    `json:"id"`
+	UUID           string   `json:"uuid"`
+	Name           string   `json:"name"`
+	Token          string   `json:"token,omitempty"`
+	EncryptedToken string   `json:"encrypted_token,omitempty"` // EncryptedToken is the token encrypted with the token key, Token is empty in the file if it's set.
+	Address        string   `json:"address"`
+	Labels         []string `json:"labels"`
 }
 
-func LoadRegistration(file string) (*Registration, error) {
+// LoadRegistration loads the registration file, the token is decrypted with key if it's encrypted.
+// The permission of the file is restricted to the owner if it isn't.
+func LoadRegistration(file string, key []byte) (*Registration, error) {
 	f, err := os.Open(file)
 	if err != nil {
 		return nil, err
@@ -36,19 +46,56 @@ func LoadRegistration(file string) (*Registration, error) {
 
 	reg.Warning = ""
 
+	if reg.EncryptedToken != "" {
+		if key == nil {
+			return nil, errors.New("the token is encrypted, but runner.token_key is not configured")
+		}
+		token, err := decryptToken(key, reg.EncryptedToken, reg.UUID)
+		if err != nil {
+			return nil, err
+		}
+		reg.Token = token
+	}
+
+	if info, err := f.Stat(); err == nil && runtime.GOOS != "windows" && info.Mode().Perm()&^registrationFileMode != 0 {
+		log.Warnf("the permission of registration file %s is %v, restrict it to %v", file, info.Mode().Perm(), os.FileMode(registrationFileMode))
+		if err := f.Chmod(registrationFileMode); err != nil {
+			return nil, err
+		}
+	}
+
 	return &reg, nil
 }
 
-func SaveRegistration(file string, reg *Registration) error {
-	f, err := os.Create(file)
+// SaveRegistration saves the registration file, the token is encrypted with key if key is not nil.
+func SaveRegistration(file string, reg *Registration, key []byte) error {
+	reg.Warning = registrationWarning
+	reg.EncryptedToken = ""
+
+	saved := *reg
+	if key != nil {
+		encrypted, err := encryptToken(key, reg.Token, reg.UUID)
+		if err != nil {
+			return err
+		}
+		saved.Token = ""
+		saved.EncryptedToken = encrypted
+		reg.EncryptedToken = encrypted
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, registrationFileMode)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-
-	reg.Warning = registrationWarning
+	// the permission of an existing file is not changed by OpenFile
+	if runtime.GOOS != "windows" {
+		if err := f.Chmod(registrationFileMode); err != nil {
+			return err
+		}
+	}
 
 	enc := json.NewEncoder(f)
 	enc.SetIndent("", "  ")
-	return enc.Encode(reg)
+	return enc.Encode(&saved)
 }
@@ -0,0 +1,110 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistration_Plaintext(t *testing.T) {
+	file := filepath.Join(t.TempDir(), ".runner")
+	reg := &Registration{ID: 1, UUID: "uuid", Name: "runner", Token: "runner-token", Address: "https://gitea.com", Labels: []string{"ubuntu"}}
+	require.NoError(t, SaveRegistration(file, reg, nil))
+
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `"token": "runner-token"`)
+	assert.NotContains(t, string(content), "encrypted_token")
+
+	loaded, err := LoadRegistration(file, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "runner-token", loaded.Token)
+	assert.Empty(t, loaded.EncryptedToken)
+}
+
+func TestRegistration_Encrypted(t *testing.T) {
+	t.Setenv("RUNNER_TOKEN_KEY", "a random key")
+	key, err := TokenKey{Env: "RUNNER_TOKEN_KEY"}.Load()
+	require.NoError(t, err)
+
+	file := filepath.Join(t.TempDir(), ".runner")
+	reg := &Registration{ID: 1, UUID: "uuid", Name: "runner", Token: "runner-token"}
+	require.NoError(t, SaveRegistration(file, reg, key))
+	assert.Equal(t, "runner-token", reg.Token)
+
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), "runner-token")
+	assert.Contains(t, string(content), `"encrypted_token": "aes-256-gcm:`)
+
+	loaded, err := LoadRegistration(file, key)
+	require.NoError(t, err)
+	assert.Equal(t, "runner-token", loaded.Token)
+
+	_, err = LoadRegistration(file, nil)
+	assert.EqualError(t, err, "the token is encrypted, but runner.token_key is not configured")
+	otherKey, err := TokenKey{File: writeFile(t, "another key\n")}.Load()
+	require.NoError(t, err)
+	_, err = LoadRegistration(file, otherKey)
+	assert.EqualError(t, err, "decrypt the token: the token key is wrong or the file is corrupted")
+
+	// the encrypted token is bound to the runner
+	require.NoError(t, os.WriteFile(file, []byte(strings.Replace(string(content), `"uuid": "uuid"`, `"uuid": "another-uuid"`, 1)), 0o600))
+	_, err = LoadRegistration(file, key)
+	assert.EqualError(t, err, "decrypt the token: the token key is wrong or the file is corrupted")
+}
+
+func TestRegistration_Permission(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file permissions are not supported on Windows")
+	}
+	file := filepath.Join(t.TempDir(), ".runner")
+	require.NoError(t, os.WriteFile(file, []byte(`{"token": "runner-token"}`), 0o644))
+
+	_, err := LoadRegistration(file, nil)
+	require.NoError(t, err)
+	info, err := os.Stat(file)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	require.NoError(t, os.Chmod(file, 0o666))
+	require.NoError(t, SaveRegistration(file, &Registration{Token: "runner-token"}, nil))
+	info, err = os.Stat(file)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
+
+func TestTokenKey_Load(t *testing.T) {
+	key, err := TokenKey{}.Load()
+	require.NoError(t, err)
+	assert.Nil(t, key)
+
+	// the trailing newline of a key file is ignored
+	key1, err := TokenKey{File: writeFile(t, "secret-key\n")}.Load()
+	require.NoError(t, err)
+	t.Setenv("RUNNER_TOKEN_KEY", "secret-key")
+	key2, err := TokenKey{Env: "RUNNER_TOKEN_KEY"}.Load()
+	require.NoError(t, err)
+	assert.Len(t, key1, 32)
+	assert.Equal(t, key1, key2)
+
+	_, err = TokenKey{Env: "RUNNER_TOKEN_KEY_NOT_SET"}.Load()
+	assert.EqualError(t, err, "environment variable RUNNER_TOKEN_KEY_NOT_SET of the token key is not set")
+	_, err = TokenKey{File: writeFile(t, "\n")}.Load()
+	assert.EqualError(t, err, "the token key is empty")
+	assert.EqualError(t, TokenKey{Env: "A", File: "b"}.validate(), "only one of env, file and keyring can be set")
+}
+
+func writeFile(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+	return file
+}
@@ -0,0 +1,240 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-units"
+	"github.com/kballard/go-shellquote"
+	"github.com/spf13/pflag"
+)
+
+// minMemory is the minimum memory limit accepted by Docker.
+const minMemory = 6 * units.MiB
+
+// Resources represents the resource limits of a container, the zero values mean no limit.
+type Resources struct {
+	CPUs        float64  `yaml:"cpus"`         // CPUs specifies how much of the CPUs the container can use, like 1.5.
+	Memory      string   `yaml:"memory"`       // Memory specifies the memory limit, like "4GiB".
+	PidsLimit   int64    `yaml:"pids_limit"`   // PidsLimit specifies the maximum number of processes in the container.
+	ShmSize     string   `yaml:"shm_size"`     // ShmSize specifies the size of /dev/shm, like "1GiB".
+	Ulimits     []string `yaml:"ulimits"`      // Ulimits specify the ulimits, like "nofile=1024:2048".
+	StorageSize string   `yaml:"storage_size"` // StorageSize specifies the size of the writable layer, it's only supported by some storage drivers.
+}
+
+// ContainerResources represents the resource limits of the job container and the service containers of a job.
+type ContainerResources struct {
+	Job     Resources `yaml:"job"`     // Job represents the resource limits of the job container.
+	Service Resources `yaml:"service"` // Service represents the resource limits of each service container.
+}
+
+// Override returns the limits with the ones set in o taking precedence.
+func (r Resources) Override(o Resources) Resources {
+	if o.CPUs != 0 {
+		r.CPUs = o.CPUs
+	}
+	if o.Memory != "" {
+		r.Memory = o.Memory
+	}
+	if o.PidsLimit != 0 {
+		r.PidsLimit = o.PidsLimit
+	}
+	if o.ShmSize != "" {
+		r.ShmSize = o.ShmSize
+	}
+	if o.StorageSize != "" {
+		r.StorageSize = o.StorageSize
+	}
+	if len(o.Ulimits) > 0 {
+		ulimits := make([]string, 0, len(r.Ulimits)+len(o.Ulimits))
+		for _, v := range r.Ulimits {
+			if !hasUlimit(o.Ulimits, ulimitName(v)) {
+				ulimits = append(ulimits, v)
+			}
+		}
+		r.Ulimits = append(ulimits, o.Ulimits...)
+	}
+	return r
+}
+
+func ulimitName(v string) string {
+	name, _, _ := strings.Cut(v, "=")
+	return strings.TrimSpace(name)
+}
+
+func hasUlimit(ulimits []string, name string) bool {
+	for _, v := range ulimits {
+		if ulimitName(v) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// IsZero reports whether no limit is set.
+func (r Resources) IsZero() bool {
+	return r.CPUs == 0 && r.Memory == "" && r.PidsLimit == 0 && r.ShmSize == "" && len(r.Ulimits) == 0 && r.StorageSize == ""
+}
+
+// Validate checks the limits, so that invalid ones are rejected before being passed to Docker.
+func (r Resources) Validate() error {
+	if r.CPUs < 0 {
+		return fmt.Errorf("cpus: %v is negative", r.CPUs)
+	}
+	if r.PidsLimit < 0 {
+		return fmt.Errorf("pids_limit: %d is negative", r.PidsLimit)
+	}
+	memory, err := parseSize(r.Memory)
+	if err != nil {
+		return fmt.Errorf("memory: %w", err)
+	}
+	if memory > 0 && memory < minMemory {
+		return fmt.Errorf("memory: %s is less than the minimum %s", r.Memory, units.BytesSize(minMemory))
+	}
+	shmSize, err := parseSize(r.ShmSize)
+	if err != nil {
+		return fmt.Errorf("shm_size: %w", err)
+	}
+	// /dev/shm is a tmpfs, its pages are charged to the memory of the container
+	if memory > 0 && shmSize > memory {
+		return fmt.Errorf("shm_size: %s is larger than memory %s", r.ShmSize, r.Memory)
+	}
+	if _, err := parseSize(r.StorageSize); err != nil {
+		return fmt.Errorf("storage_size: %w", err)
+	}
+	names := map[string]bool{}
+	for _, v := range r.Ulimits {
+		ulimit, err := units.ParseUlimit(v)
+		if err != nil {
+			return fmt.Errorf("ulimits: %w", err)
+		}
+		if names[ulimit.Name] {
+			return fmt.Errorf("ulimits: %q is set more than once", ulimit.Name)
+		}
+		names[ulimit.Name] = true
+	}
+	return nil
+}
+
+// parseSize parses a size like "4GiB", 0 is returned for an empty string.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	size, err := units.RAMInBytes(s)
+	if err != nil {
+		return 0, err
+	}
+	if size <= 0 {
+		return 0, fmt.Errorf("%q is not positive", s)
+	}
+	return size, nil
+}
+
+// Options returns the options of `docker run` which set the limits, the limits must have been validated.
+func (r Resources) Options() string {
+	var options []string
+	if r.CPUs > 0 {
+		options = append(options, "--cpus="+strconv.FormatFloat(r.CPUs, 'f', -1, 64))
+	}
+	if memory, _ := parseSize(r.Memory); memory > 0 {
+		options = append(options, fmt.Sprintf("--memory=%d", memory))
+	}
+	if r.PidsLimit > 0 {
+		options = append(options, fmt.Sprintf("--pids-limit=%d", r.PidsLimit))
+	}
+	if shmSize, _ := parseSize(r.ShmSize); shmSize > 0 {
+		options = append(options, fmt.Sprintf("--shm-size=%d", shmSize))
+	}
+	for _, v := range r.Ulimits {
+		if ulimit, err := units.ParseUlimit(v); err == nil {
+			options = append(options, "--ulimit="+ulimit.String())
+		}
+	}
+	if storageSize, _ := parseSize(r.StorageSize); storageSize > 0 {
+		options = append(options, fmt.Sprintf("--storage-opt=size=%d", storageSize))
+	}
+	return strings.Join(options, " ")
+}
+
+// ResourcesFor returns the resource limits for the jobs of the label, the limits of the label override the default ones.
+func (c *Container) ResourcesFor(label string) ContainerResources {
+	ret := c.Resources
+	if o, ok := c.LabelResources[label]; ok {
+		ret.Job = ret.Job.Override(o.Job)
+		ret.Service = ret.Service.Override(o.Service)
+	}
+	return ret
+}
+
+// resourceOptionFlags are the options of `docker run` which conflict with the resource limits, with their shorthands.
+var resourceOptionFlags = []struct{ name, shorthand string }{
+	{"cpus", ""},
+	{"memory", "m"},
+	{"pids-limit", ""},
+	{"shm-size", ""},
+	{"storage-opt", ""},
+}
+
+// resourceOption returns the option in options which conflicts with the resource limits, like "--memory",
+// or an empty string if there is none.
+// The options are split and parsed with pflag like act does, so all the forms, like "-m4g" or "-itm 4g", are recognized.
+func resourceOption(options string) (string, error) {
+	args, err := shellquote.Split(options)
+	if err != nil {
+		return "", err
+	}
+	flags := pflag.NewFlagSet("container_options", pflag.ContinueOnError)
+	flags.ParseErrorsWhitelist.UnknownFlags = true
+	flags.Usage = func() {}
+	for _, f := range resourceOptionFlags {
+		flags.StringP(f.name, f.shorthand, "", "")
+	}
+	if err := flags.Parse(args); err != nil {
+		return "", err
+	}
+	for _, f := range resourceOptionFlags {
+		if flags.Changed(f.name) {
+			return "--" + f.name, nil
+		}
+	}
+	return "", nil
+}
+
+// validateResources checks the resource limits of the container and of each label.
+func (c *Container) validateResources() error {
+	check := func(prefix string, r ContainerResources) error {
+		if err := r.Job.Validate(); err != nil {
+			return fmt.Errorf("%s.job.%w", prefix, err)
+		}
+		if err := r.Service.Validate(); err != nil {
+			return fmt.Errorf("%s.service.%w", prefix, err)
+		}
+		return nil
+	}
+	if err := check("container.resources", c.Resources); err != nil {
+		return err
+	}
+	for label := range c.LabelResources {
+		if err := check(fmt.Sprintf("container.label_resources.%s", label), c.ResourcesFor(label)); err != nil {
+			return err
+		}
+	}
+
+	// it's ambiguous which one takes effect if a limit is set in both places
+	if !c.Resources.Job.IsZero() || len(c.LabelResources) > 0 {
+		flag, err := resourceOption(c.Options)
+		if err != nil {
+			return fmt.Errorf("container.options: %w", err)
+		}
+		if flag != "" {
+			return errors.New("container.options: " + flag + " conflicts with container.resources, set the limit in container.resources instead")
+		}
+	}
+	return nil
+}
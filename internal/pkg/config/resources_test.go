@@ -0,0 +1,133 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResources_Validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources Resources
+		wantErr   string
+	}{
+		{name: "empty", resources: Resources{}},
+		{name: "valid", resources: Resources{CPUs: 2, Memory: "4GiB", PidsLimit: 100, ShmSize: "1g", Ulimits: []string{"nofile=1024:2048"}, StorageSize: "10G"}},
+		{name: "negative cpus", resources: Resources{CPUs: -1}, wantErr: "cpus: -1 is negative"},
+		{name: "negative pids limit", resources: Resources{PidsLimit: -1}, wantErr: "pids_limit: -1 is negative"},
+		{name: "invalid memory", resources: Resources{Memory: "lots"}, wantErr: "memory: invalid size: 'lots'"},
+		{name: "too little memory", resources: Resources{Memory: "1MiB"}, wantErr: "memory: 1MiB is less than the minimum 6MiB"},
+		{name: "shm larger than memory", resources: Resources{Memory: "1g", ShmSize: "2g"}, wantErr: "shm_size: 2g is larger than memory 1g"},
+		{name: "invalid ulimit", resources: Resources{Ulimits: []string{"nofile=2048:1024"}}, wantErr: "ulimits: ulimit soft limit must be less than or equal to hard limit: 2048 > 1024"},
+		{name: "duplicate ulimit", resources: Resources{Ulimits: []string{"nofile=1024", "nofile=2048"}}, wantErr: `ulimits: "nofile" is set more than once`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.resources.Validate()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResources_Options(t *testing.T) {
+	r := Resources{CPUs: 1.5, Memory: "4GiB", PidsLimit: 100, ShmSize: "64m", Ulimits: []string{"nofile=1024:2048"}, StorageSize: "10G"}
+	assert.Equal(t, "--cpus=1.5 --memory=4294967296 --pids-limit=100 --shm-size=67108864 --ulimit=nofile=1024:2048 --storage-opt=size=10737418240", r.Options())
+	assert.Equal(t, "", Resources{}.Options())
+}
+
+func TestResourceOption(t *testing.T) {
+	for options, want := range map[string]string{
+		"":                                 "",
+		"--add-host=gitea:host-gateway":    "",
+		"--memory=4g":                      "--memory",
+		"--memory 4g":                      "--memory",
+		"-m 4g":                            "--memory",
+		"-m4g":                             "--memory",
+		"-m=4g":                            "--memory",
+		"-it -m4g":                         "--memory",
+		"-itm 4g":                          "--memory",
+		"--privileged --memory=4g -e A=b":  "--memory",
+		"-e MEMORY=--memory=4g":            "",
+		"--cpus 2 --network host":          "--cpus",
+		"--storage-opt size=10G":           "--storage-opt",
+		"--pids-limit=100 --shm-size=64m":  "--pids-limit",
+		"--env 'A=--shm-size=64m' --rm":    "",
+		"--mount type=tmpfs,dst=/tmp -m1g": "--memory",
+	} {
+		got, err := resourceOption(options)
+		require.NoError(t, err, options)
+		assert.Equal(t, want, got, options)
+	}
+}
+
+func TestContainer_ResourcesFor(t *testing.T) {
+	c := &Container{
+		Resources: ContainerResources{
+			Job:     Resources{CPUs: 2, Memory: "4GiB", Ulimits: []string{"nofile=1024", "nproc=512"}},
+			Service: Resources{Memory: "1GiB"},
+		},
+		LabelResources: map[string]ContainerResources{
+			"large": {Job: Resources{Memory: "16GiB", Ulimits: []string{"nofile=4096"}}},
+		},
+	}
+	assert.Equal(t, c.Resources, c.ResourcesFor("ubuntu-latest"))
+	assert.Equal(t, ContainerResources{
+		Job:     Resources{CPUs: 2, Memory: "16GiB", Ulimits: []string{"nproc=512", "nofile=4096"}},
+		Service: Resources{Memory: "1GiB"},
+	}, c.ResourcesFor("large"))
+}
+
+func TestLoadDefault_Resources(t *testing.T) {
+	load := func(t *testing.T, content string) error {
+		file := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+		_, err := LoadDefault(file)
+		return err
+	}
+
+	assert.NoError(t, load(t, `
+container:
+  resources:
+    job:
+      memory: 4GiB
+  label_resources:
+    large:
+      job:
+        memory: 16GiB
+`))
+	assert.EqualError(t, load(t, `
+container:
+  resources:
+    job:
+      memory: 1GiB
+  label_resources:
+    large:
+      job:
+        shm_size: 2GiB
+`), "invalid container.label_resources.large.job.shm_size: 2GiB is larger than memory 1GiB")
+	assert.EqualError(t, load(t, `
+container:
+  options: --memory=8g --add-host=gitea:host-gateway
+  resources:
+    job:
+      memory: 4GiB
+`), "invalid container.options: --memory conflicts with container.resources, set the limit in container.resources instead")
+	assert.EqualError(t, load(t, `
+container:
+  options: -it -m4g
+  resources:
+    job:
+      cpus: 2
+`), "invalid container.options: --memory conflicts with container.resources, set the limit in container.resources instead")
+}
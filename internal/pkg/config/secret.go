@@ -0,0 +1,344 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kballard/go-shellquote"
+)
+
+// Secrets represents the configuration for resolving the secret references in the environment variables of the runner.
+type Secrets struct {
+	CacheTTL time.Duration `yaml:"cache_ttl"` // CacheTTL specifies how long a resolved secret is cached. A negative value means no caching.
+	Timeout  time.Duration `yaml:"timeout"`   // Timeout specifies the timeout of resolving a secret.
+	Vault    Vault         `yaml:"vault"`     // Vault represents the configuration for reading secrets from HashiCorp Vault.
+}
+
+// Vault represents the configuration for reading secrets from HashiCorp Vault.
+type Vault struct {
+	Addr      string `yaml:"addr"`       // Addr specifies the address of the Vault server. If it's empty, the environment variable VAULT_ADDR is used.
+	Token     string `yaml:"token"`      // Token specifies the token to authenticate with. If it's empty, the environment variable VAULT_TOKEN is used.
+	TokenFile string `yaml:"token_file"` // TokenFile specifies the file containing the token, it takes precedence over Token.
+	Namespace string `yaml:"namespace"`  // Namespace specifies the Vault Enterprise namespace.
+}
+
+// A SecretProvider resolves the secret references of a scheme, like "file".
+type SecretProvider interface {
+	// Resolve returns the secret, ref is the part of the reference after "<scheme>://".
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// ParseSecretRef returns the scheme and the rest of v if v is a reference to a secret,
+// like "file:///run/secrets/token", "exec://pass show ci/token" or "vault://secret/data/ci#token".
+func ParseSecretRef(v string) (scheme, ref string, ok bool) {
+	scheme, ref, ok = strings.Cut(v, "://")
+	if !ok {
+		return "", "", false
+	}
+	switch scheme {
+	case "file", "exec", "vault":
+		return scheme, ref, true
+	}
+	return "", "", false
+}
+
+// unescapeSecretRef returns v without the leading backslash if v is an escaped secret reference, like "\\file://foo",
+// so a literal value looking like a reference can be set.
+func unescapeSecretRef(v string) (string, bool) {
+	if rest, ok := strings.CutPrefix(v, `\`); ok {
+		if _, _, ok := ParseSecretRef(rest); ok {
+			return rest, true
+		}
+	}
+	return v, false
+}
+
+// validateSecretRef checks the syntax of a secret reference, so an invalid one is rejected when the config is loaded.
+func validateSecretRef(scheme, ref string) error {
+	switch scheme {
+	case "file", "exec":
+		if ref == "" {
+			return errors.New("empty reference")
+		}
+		if scheme == "exec" {
+			if _, err := shellquote.Split(ref); err != nil {
+				return err
+			}
+		}
+	case "vault":
+		path, key, ok := strings.Cut(ref, "#")
+		if !ok || path == "" || key == "" {
+			return errors.New(`the reference should be like "vault://<path>#<key>"`)
+		}
+	}
+	return nil
+}
+
+// validateSecretRefs checks the secret references in the environment variables of the runner and the profiles.
+func (c *Config) validateSecretRefs() error {
+	check := func(prefix string, envs map[string]string) error {
+		for k, v := range envs {
+			if scheme, ref, ok := ParseSecretRef(v); ok {
+				if err := validateSecretRef(scheme, ref); err != nil {
+					return fmt.Errorf("%s.%s: %w", prefix, k, err)
+				}
+			}
+		}
+		return nil
+	}
+	if err := check("runner.envs", c.Runner.Envs); err != nil {
+		return err
+	}
+	for name, p := range c.Profiles {
+		if err := check("profiles."+name+".envs", p.Envs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type cachedSecret struct {
+	value   string
+	expires time.Time
+}
+
+// SecretResolver resolves the secret references in the environment variables with the providers of their schemes,
+// the resolved values are cached for a while, so a task doesn't wait for the providers each time.
+type SecretResolver struct {
+	providers map[string]SecretProvider
+	ttl       time.Duration
+	timeout   time.Duration
+	now       func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cachedSecret
+}
+
+func NewSecretResolver(cfg Secrets) *SecretResolver {
+	return &SecretResolver{
+		providers: map[string]SecretProvider{
+			"file":  fileProvider{},
+			"exec":  execProvider{},
+			"vault": newVaultProvider(cfg.Vault),
+		},
+		ttl:     cfg.CacheTTL,
+		timeout: cfg.Timeout,
+		now:     time.Now,
+		cache:   map[string]cachedSecret{},
+	}
+}
+
+// SetProvider replaces the provider of the scheme.
+func (r *SecretResolver) SetProvider(scheme string, p SecretProvider) {
+	r.providers[scheme] = p
+}
+
+// Resolve returns the secret of the reference v.
+func (r *SecretResolver) Resolve(ctx context.Context, v string) (string, error) {
+	scheme, ref, ok := ParseSecretRef(v)
+	if !ok {
+		return "", fmt.Errorf("%q is not a secret reference", v)
+	}
+	p, ok := r.providers[scheme]
+	if !ok {
+		return "", fmt.Errorf("no provider for scheme %q", scheme)
+	}
+
+	r.mu.Lock()
+	cached, ok := r.cache[v]
+	r.mu.Unlock()
+	if ok && r.now().Before(cached.expires) {
+		return cached.value, nil
+	}
+
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	value, err := p.Resolve(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	if r.ttl > 0 {
+		r.mu.Lock()
+		r.cache[v] = cachedSecret{value: value, expires: r.now().Add(r.ttl)}
+		r.mu.Unlock()
+	}
+	return value, nil
+}
+
+// ResolveEnvs returns a copy of envs with the secret references replaced by the secrets,
+// and the resolved secrets, which should be masked in logs.
+func (r *SecretResolver) ResolveEnvs(ctx context.Context, envs map[string]string) (map[string]string, []string, error) {
+	keys := make([]string, 0, len(envs))
+	for k := range envs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ret := make(map[string]string, len(envs))
+	var secrets []string
+	for _, k := range keys {
+		v := envs[k]
+		if literal, ok := unescapeSecretRef(v); ok {
+			v = literal
+		} else if _, _, ok := ParseSecretRef(v); ok {
+			secret, err := r.Resolve(ctx, v)
+			if err != nil {
+				return nil, nil, fmt.Errorf("resolve env %s: %w", k, err)
+			}
+			v = secret
+			secrets = append(secrets, secret)
+		}
+		ret[k] = v
+	}
+	return ret, secrets, nil
+}
+
+// fileProvider reads the secret from a file, like the ones mounted by Docker or Kubernetes.
+type fileProvider struct{}
+
+func (fileProvider) Resolve(_ context.Context, ref string) (string, error) {
+	content, err := os.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// execProvider runs a command and uses its output as the secret.
+type execProvider struct{}
+
+func (execProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	args, err := shellquote.Split(ref)
+	if err != nil {
+		return "", fmt.Errorf("parse command: %w", err)
+	}
+	if len(args) == 0 {
+		return "", errors.New("empty command")
+	}
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("run %s: %w: %s", args[0], err, msg)
+		}
+		return "", fmt.Errorf("run %s: %w", args[0], err)
+	}
+	return strings.TrimRight(string(output), "\r\n"), nil
+}
+
+// vaultProvider reads the secret from the KV secrets engine of Vault, both version 1 and 2 are supported.
+// The reference is like "secret/data/ci#token", where "secret/data/ci" is the API path and "token" is the key.
+type vaultProvider struct {
+	cfg    Vault
+	client *http.Client
+}
+
+func newVaultProvider(cfg Vault) *vaultProvider {
+	return &vaultProvider{
+		cfg:    cfg,
+		client: &http.Client{},
+	}
+}
+
+func (p *vaultProvider) token() (string, error) {
+	if p.cfg.TokenFile != "" {
+		content, err := os.ReadFile(p.cfg.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("read vault token: %w", err)
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+	if p.cfg.Token != "" {
+		return p.cfg.Token, nil
+	}
+	return os.Getenv("VAULT_TOKEN"), nil
+}
+
+func (p *vaultProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	path, key, ok := strings.Cut(ref, "#")
+	if !ok || path == "" || key == "" {
+		return "", errors.New(`the reference should be like "vault://<path>#<key>"`)
+	}
+	addr := p.cfg.Addr
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if addr == "" {
+		return "", errors.New("the address of vault is not configured")
+	}
+	token, err := p.token()
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.JoinPath(addr, "v1", path)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if p.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.cfg.Namespace)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Data   map[string]interface{} `json:"data"`
+		Errors []string               `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return "", fmt.Errorf("decode vault response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(body.Errors) > 0 {
+			return "", fmt.Errorf("read %s from vault: %s: %s", path, resp.Status, strings.Join(body.Errors, "; "))
+		}
+		return "", fmt.Errorf("read %s from vault: %s", path, resp.Status)
+	}
+
+	data := body.Data
+	// the secret is in data.data with the KV secrets engine version 2
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data[key]; !ok {
+			data = nested
+		}
+	}
+	switch v := data[key].(type) {
+	case nil:
+		return "", fmt.Errorf("no key %q in %s", key, path)
+	case string:
+		return v, nil
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSecretRef(t *testing.T) {
+	scheme, ref, ok := ParseSecretRef("vault://secret/data/ci#token")
+	assert.True(t, ok)
+	assert.Equal(t, "vault", scheme)
+	assert.Equal(t, "secret/data/ci#token", ref)
+
+	_, _, ok = ParseSecretRef("https://example.com")
+	assert.False(t, ok)
+	_, _, ok = ParseSecretRef("plain value")
+	assert.False(t, ok)
+}
+
+// fakeVault is a stand-in of the Vault HTTP API, with a KV version 1 engine at "kv" and a version 2 one at "secret".
+func fakeVault(t *testing.T, token string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != token {
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"permission denied"}})
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/kv/ci":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{"password": "v1-password"},
+			})
+		case "/v1/secret/data/ci":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{
+					"data":     map[string]interface{}{"password": "v2-password", "port": 5432},
+					"metadata": map[string]interface{}{"version": 3},
+				},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{}})
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSecretResolver_Vault(t *testing.T) {
+	srv := fakeVault(t, "root-token")
+	ctx := context.Background()
+
+	r := NewSecretResolver(Secrets{Vault: Vault{Addr: srv.URL, Token: "root-token"}})
+	v, err := r.Resolve(ctx, "vault://kv/ci#password")
+	require.NoError(t, err)
+	assert.Equal(t, "v1-password", v)
+	v, err = r.Resolve(ctx, "vault://secret/data/ci#password")
+	require.NoError(t, err)
+	assert.Equal(t, "v2-password", v)
+	v, err = r.Resolve(ctx, "vault://secret/data/ci#port")
+	require.NoError(t, err)
+	assert.Equal(t, "5432", v)
+
+	_, err = r.Resolve(ctx, "vault://secret/data/ci#missing")
+	assert.EqualError(t, err, `no key "missing" in secret/data/ci`)
+	_, err = r.Resolve(ctx, "vault://secret/data/other#password")
+	assert.EqualError(t, err, "read secret/data/other from vault: 404 Not Found")
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("wrong-token\n"), 0o600))
+	r = NewSecretResolver(Secrets{Vault: Vault{Addr: srv.URL, Token: "root-token", TokenFile: tokenFile}})
+	_, err = r.Resolve(ctx, "vault://kv/ci#password")
+	assert.EqualError(t, err, "read kv/ci from vault: 403 Forbidden: permission denied")
+}
+
+func TestSecretResolver_FileAndExec(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(file, []byte("from-file\n"), 0o600))
+
+	r := NewSecretResolver(Secrets{})
+	v, err := r.Resolve(context.Background(), "file://"+file)
+	require.NoError(t, err)
+	assert.Equal(t, "from-file", v)
+
+	if runtime.GOOS == "windows" {
+		t.Skip("echo is not an executable on Windows")
+	}
+	v, err = r.Resolve(context.Background(), `exec://echo "from exec"`)
+	require.NoError(t, err)
+	assert.Equal(t, "from exec", v)
+	_, err = r.Resolve(context.Background(), "exec://false")
+	assert.EqualError(t, err, "run false: exit status 1")
+}
+
+type countingProvider struct {
+	calls int
+}
+
+func (p *countingProvider) Resolve(_ context.Context, ref string) (string, error) {
+	p.calls++
+	return ref + "-secret", nil
+}
+
+func TestSecretResolver_ResolveEnvs(t *testing.T) {
+	now := time.Now()
+	p := &countingProvider{}
+	r := NewSecretResolver(Secrets{CacheTTL: time.Minute})
+	r.SetProvider("vault", p)
+	r.now = func() time.Time { return now }
+
+	envs := map[string]string{
+		"PLAIN":   "value",
+		"URL":     "https://example.com",
+		"TOKEN":   "vault://ci#token",
+		"LITERAL": `\vault://ci#token`,
+		"ESCAPED": `\value`,
+	}
+	resolved, secrets, err := r.ResolveEnvs(context.Background(), envs)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"PLAIN":   "value",
+		"URL":     "https://example.com",
+		"TOKEN":   "ci#token-secret",
+		"LITERAL": "vault://ci#token",
+		"ESCAPED": `\value`,
+	}, resolved)
+	assert.Equal(t, []string{"ci#token-secret"}, secrets)
+	assert.Equal(t, "vault://ci#token", envs["TOKEN"])
+
+	// the secret is cached until the TTL expires
+	_, _, err = r.ResolveEnvs(context.Background(), envs)
+	require.NoError(t, err)
+	assert.Equal(t, 1, p.calls)
+	now = now.Add(2 * time.Minute)
+	_, _, err = r.ResolveEnvs(context.Background(), envs)
+	require.NoError(t, err)
+	assert.Equal(t, 2, p.calls)
+
+	_, _, err = r.ResolveEnvs(context.Background(), map[string]string{"MISSING": "file:///nonexistent/secret"})
+	assert.ErrorContains(t, err, "resolve env MISSING: open /nonexistent/secret")
+}
+
+func TestLoadDefault_SecretRefs(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(`
+runner:
+  envs:
+    TOKEN: vault://secret/data/ci
+`), 0o600))
+	_, err := LoadDefault(file)
+	assert.EqualError(t, err, `invalid runner.envs.TOKEN: the reference should be like "vault://<path>#<key>"`)
+
+	// an escaped reference is a literal value
+	require.NoError(t, os.WriteFile(file, []byte(`
+runner:
+  envs:
+    TOKEN: \vault://secret/data/ci
+`), 0o600))
+	cfg, err := LoadDefault(file)
+	require.NoError(t, err)
+	assert.Equal(t, `\vault://secret/data/ci`, cfg.Runner.Envs["TOKEN"])
+}
@@ -0,0 +1,127 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package config
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// encryptedTokenPrefix is the prefix of an encrypted token, it indicates the algorithm for future changes.
+const encryptedTokenPrefix = "aes-256-gcm:"
+
+// TokenKey represents where the key to encrypt the runner token in the registration file is read from.
+// At most one of the sources can be set, the token is stored in plaintext if none is set.
+type TokenKey struct {
+	Env     string `yaml:"env"`     // Env specifies the environment variable containing the key.
+	File    string `yaml:"file"`    // File specifies the file containing the key.
+	Keyring string `yaml:"keyring"` // Keyring specifies the description of a "user" key in the Linux kernel keyring containing the key.
+}
+
+// IsSet reports whether a source of the key is set.
+func (k TokenKey) IsSet() bool {
+	return k.Env != "" || k.File != "" || k.Keyring != ""
+}
+
+func (k TokenKey) validate() error {
+	n := 0
+	for _, v := range []string{k.Env, k.File, k.Keyring} {
+		if v != "" {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.New("only one of env, file and keyring can be set")
+	}
+	return nil
+}
+
+// Load reads the key, nil is returned if no source is set.
+// The key could be of any length, it's hashed to a 256-bit key, so it should be random enough, like the output of `openssl rand -base64 32`.
+func (k TokenKey) Load() ([]byte, error) {
+	var material []byte
+	switch {
+	case k.Env != "":
+		v, ok := os.LookupEnv(k.Env)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s of the token key is not set", k.Env)
+		}
+		material = []byte(v)
+	case k.File != "":
+		content, err := os.ReadFile(k.File)
+		if err != nil {
+			return nil, fmt.Errorf("read token key: %w", err)
+		}
+		material = content
+	case k.Keyring != "":
+		content, err := readKeyring(k.Keyring)
+		if err != nil {
+			return nil, fmt.Errorf("read token key %q from keyring: %w", k.Keyring, err)
+		}
+		material = content
+	default:
+		return nil, nil
+	}
+
+	material = bytes.TrimSpace(material)
+	if len(material) == 0 {
+		return nil, errors.New("the token key is empty")
+	}
+	key := sha256.Sum256(material)
+	return key[:], nil
+}
+
+// encryptToken encrypts the token with AES-GCM, the UUID of the runner is authenticated along with it,
+// so the encrypted token can't be used for another runner.
+func encryptToken(key []byte, token, uuid string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(token), []byte(uuid))
+	return encryptedTokenPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptToken(key []byte, encrypted, uuid string) (string, error) {
+	data, ok := strings.CutPrefix(encrypted, encryptedTokenPrefix)
+	if !ok {
+		return "", errors.New("unsupported encryption of the token")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", fmt.Errorf("decode the token: %w", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("the encrypted token is truncated")
+	}
+	token, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(uuid))
+	if err != nil {
+		return "", errors.New("decrypt the token: the token key is wrong or the file is corrupted")
+	}
+	return string(token), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -32,3 +32,27 @@ func CheckIfDockerRunning(ctx context.Context, configDockerHost string) error {
 
 	return nil
 }
+
+// GetDockerRootDir returns the data root directory of the docker daemon.
+func GetDockerRootDir(ctx context.Context, configDockerHost string) (string, error) {
+	opts := []client.Opt{
+		client.FromEnv,
+	}
+
+	if configDockerHost != "" {
+		opts = append(opts, client.WithHost(configDockerHost))
+	}
+
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return "", err
+	}
+	defer cli.Close()
+
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return "", fmt.Errorf("cannot get the info of the docker daemon: %w", err)
+	}
+
+	return info.DockerRootDir, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+// Package event delivers the lifecycle events of tasks to external sinks, such as webhooks.
+package event
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Type is the type of an event.
+type Type string
+
+const (
+	TaskReceived     Type = "task_received"
+	WorkflowPrepared Type = "workflow_prepared"
+	StepStarted      Type = "step_started"
+	StepFinished     Type = "step_finished"
+	JobFinished      Type = "job_finished"
+	TaskCancelled    Type = "task_cancelled"
+)
+
+// Types are all types of events.
+var Types = []Type{TaskReceived, WorkflowPrepared, StepStarted, StepFinished, JobFinished, TaskCancelled}
+
+// Event is a lifecycle event of a task.
+type Event struct {
+	Type        Type          `json:"type"`
+	Time        time.Time     `json:"time"`
+	Runner      string        `json:"runner"`
+	TaskID      int64         `json:"task_id"`
+	Repository  string        `json:"repository,omitempty"`
+	Workflow    string        `json:"workflow,omitempty"`
+	Job         string        `json:"job,omitempty"`
+	RunID       string        `json:"run_id,omitempty"`
+	RunNumber   string        `json:"run_number,omitempty"`
+	Step        *Step         `json:"step,omitempty"`       // Step is set for step_started and step_finished.
+	Result      string        `json:"result,omitempty"`     // Result is set for step_finished, job_finished and task_cancelled, like "success".
+	StartedAt   *time.Time    `json:"started_at,omitempty"` // StartedAt is set for job_finished and task_cancelled, if the task has started.
+	Message     string        `json:"message,omitempty"`
+	Annotations []*Annotation `json:"annotations,omitempty"` // Annotations is set for job_finished and task_cancelled, if the task has created any.
+}
+
+// Step describes the step of a step event.
+type Step struct {
+	Index  int    `json:"index"`
+	Name   string `json:"name"`
+	Result string `json:"result,omitempty"`
+}
+
+// Annotation is an annotation created by a task.
+type Annotation struct {
+	Level     string `json:"level"`
+	Message   string `json:"message"`
+	Title     string `json:"title,omitempty"`
+	File      string `json:"file,omitempty"`
+	Line      int    `json:"line,omitempty"`
+	EndLine   int    `json:"end_line,omitempty"`
+	Col       int    `json:"col,omitempty"`
+	EndColumn int    `json:"end_column,omitempty"`
+	Step      int    `json:"step"` // Step is the index of the step which created the annotation, -1 if it's not created by a step.
+}
+
+// A Sink receives events.
+type Sink interface {
+	Send(ctx context.Context, e *Event) error
+}
+
+// queueSize is the number of events which can wait for a sink, more events are dropped.
+const queueSize = 256
+
+// Emitter delivers events to sinks in background, so a slow sink doesn't block the task.
+// Each sink receives the events in the order they were emitted.
+type Emitter struct {
+	mu     sync.Mutex
+	queues []chan *Event
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewEmitter(sinks ...Sink) *Emitter {
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &Emitter{ctx: ctx, cancel: cancel}
+	for _, s := range sinks {
+		e.Add(s)
+	}
+	return e
+}
+
+// Add adds a sink, it can't be called after Close.
+func (e *Emitter) Add(sink Sink) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	queue := make(chan *Event, queueSize)
+	e.queues = append(e.queues, queue)
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		for ev := range queue {
+			if err := sink.Send(e.ctx, ev); err != nil {
+				log.WithError(err).Warnf("failed to send %s event of task %d", ev.Type, ev.TaskID)
+			}
+		}
+	}()
+}
+
+// Emit queues the event for all sinks without blocking, it's dropped for the sinks whose queues are full.
+func (e *Emitter) Emit(ev *Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, queue := range e.queues {
+		select {
+		case queue <- ev:
+		default:
+			log.Warnf("dropped %s event of task %d, the sink is too slow", ev.Type, ev.TaskID)
+		}
+	}
+}
+
+// Close waits for the queued events to be delivered until ctx is done, then the remaining ones are abandoned.
+// No event should be emitted after it's called.
+func (e *Emitter) Close(ctx context.Context) error {
+	e.mu.Lock()
+	for _, queue := range e.queues {
+		close(queue)
+	}
+	e.queues = nil
+	e.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		e.cancel()
+		return nil
+	case <-ctx.Done():
+		e.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
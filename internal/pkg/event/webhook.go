@@ -0,0 +1,142 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package event
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/avast/retry-go/v4"
+
+	"gitea.com/gitea/act_runner/internal/pkg/config"
+	"gitea.com/gitea/act_runner/internal/pkg/ver"
+)
+
+const (
+	// HeaderEvent is the header of the event type.
+	HeaderEvent = "X-Runner-Event"
+	// HeaderDelivery is the header of a unique ID of the delivery, it's the same for all retries.
+	HeaderDelivery = "X-Runner-Delivery"
+	// HeaderSignature is the header of the HMAC-SHA256 signature of the body, like "sha256=<hex>".
+	// It's only sent if a secret is configured.
+	HeaderSignature = "X-Runner-Signature-256"
+)
+
+// Webhook is a Sink which posts the events as JSON to an HTTP endpoint.
+type Webhook struct {
+	url        string
+	secret     []byte
+	events     []Type
+	client     *http.Client
+	maxRetries int
+	retryDelay time.Duration
+}
+
+func NewWebhook(cfg config.Webhook) (*Webhook, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("url is required")
+	}
+	w := &Webhook{
+		url:        cfg.URL,
+		secret:     []byte(cfg.Secret),
+		client:     &http.Client{Timeout: cfg.Timeout},
+		maxRetries: cfg.MaxRetries,
+		retryDelay: time.Second,
+	}
+	for _, v := range cfg.Events {
+		if !slices.Contains(Types, Type(v)) {
+			return nil, fmt.Errorf("unknown event %q", v)
+		}
+		w.events = append(w.events, Type(v))
+	}
+	return w, nil
+}
+
+// Sign returns the signature of the body with the secret, in the format of the signature header.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send posts the event, it's retried with exponential backoff if the endpoint can't be reached,
+// responds 429 or a server error. The events which are not subscribed are ignored.
+func (w *Webhook) Send(ctx context.Context, e *Event) error {
+	if len(w.events) > 0 && !slices.Contains(w.events, e.Type) {
+		return nil
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	delivery := hex.EncodeToString(id)
+
+	return retry.Do(func() error {
+		return w.post(ctx, e.Type, delivery, body)
+	},
+		retry.Context(ctx),
+		retry.Attempts(uint(w.maxRetries)+1),
+		retry.Delay(w.retryDelay),
+		retry.DelayType(retry.BackOffDelay),
+		retry.RetryIf(func(err error) bool {
+			var statusErr *statusError
+			return !errors.As(err, &statusErr) || statusErr.retryable()
+		}),
+		retry.LastErrorOnly(true),
+	)
+}
+
+func (w *Webhook) post(ctx context.Context, typ Type, delivery string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return retry.Unrecoverable(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "act_runner/"+ver.Version())
+	req.Header.Set(HeaderEvent, string(typ))
+	req.Header.Set(HeaderDelivery, delivery)
+	if len(w.secret) > 0 {
+		req.Header.Set(HeaderSignature, Sign(w.secret, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &statusError{code: resp.StatusCode}
+	}
+	return nil
+}
+
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", e.code)
+}
+
+func (e *statusError) retryable() bool {
+	return e.code == http.StatusTooManyRequests || e.code >= 500
+}
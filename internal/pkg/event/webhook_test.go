@@ -0,0 +1,120 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitea.com/gitea/act_runner/internal/pkg/config"
+)
+
+func TestWebhook_Send(t *testing.T) {
+	var mu sync.Mutex
+	var attempts int
+	var deliveries []string
+	var received []*Event
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, Sign([]byte("s3cr3t"), body), r.Header.Get(HeaderSignature))
+		deliveries = append(deliveries, r.Header.Get(HeaderDelivery))
+		if attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		e := &Event{}
+		assert.NoError(t, json.Unmarshal(body, e))
+		assert.Equal(t, string(e.Type), r.Header.Get(HeaderEvent))
+		assert.NotContains(t, string(body), "started_at", "unset times are omitted")
+		received = append(received, e)
+	}))
+	defer srv.Close()
+
+	w, err := NewWebhook(config.Webhook{URL: srv.URL, Secret: "s3cr3t", Events: []string{"job_finished"}, MaxRetries: 2})
+	require.NoError(t, err)
+	w.retryDelay = time.Millisecond
+
+	require.NoError(t, w.Send(context.Background(), &Event{Type: StepStarted, TaskID: 1}))
+	require.NoError(t, w.Send(context.Background(), &Event{Type: JobFinished, TaskID: 1, Result: "success"}))
+
+	require.Len(t, received, 1)
+	assert.Equal(t, JobFinished, received[0].Type)
+	assert.Equal(t, "success", received[0].Result)
+	// the retry is the same delivery
+	require.Len(t, deliveries, 2)
+	assert.Equal(t, deliveries[0], deliveries[1])
+}
+
+func TestWebhook_SendNotRetryable(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		assert.Empty(t, r.Header.Get(HeaderSignature))
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	w, err := NewWebhook(config.Webhook{URL: srv.URL, MaxRetries: 3})
+	require.NoError(t, err)
+	w.retryDelay = time.Millisecond
+
+	assert.EqualError(t, w.Send(context.Background(), &Event{Type: TaskReceived}), "unexpected status 400")
+	assert.Equal(t, 1, attempts)
+}
+
+func TestNewWebhook_Invalid(t *testing.T) {
+	_, err := NewWebhook(config.Webhook{})
+	assert.Error(t, err)
+	_, err = NewWebhook(config.Webhook{URL: "http://example.com", Events: []string{"unknown"}})
+	assert.Error(t, err)
+}
+
+type sinkFunc func(ctx context.Context, e *Event) error
+
+func (f sinkFunc) Send(ctx context.Context, e *Event) error {
+	return f(ctx, e)
+}
+
+func TestEmitter(t *testing.T) {
+	var got []Type
+	release := make(chan struct{})
+	emitter := NewEmitter(sinkFunc(func(_ context.Context, e *Event) error {
+		<-release
+		got = append(got, e.Type)
+		return nil
+	}))
+
+	// emitting doesn't wait for the sink
+	for _, typ := range Types {
+		emitter.Emit(&Event{Type: typ})
+	}
+	close(release)
+
+	require.NoError(t, emitter.Close(context.Background()))
+	assert.Equal(t, Types, got)
+}
+
+func TestEmitter_CloseTimeout(t *testing.T) {
+	emitter := NewEmitter(sinkFunc(func(ctx context.Context, _ *Event) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	emitter.Emit(&Event{Type: TaskReceived})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, emitter.Close(ctx), context.DeadlineExceeded)
+}
@@ -0,0 +1,432 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+// Package fakegitea provides an in-process stand-in for the runner API of Gitea,
+// so the runner can be tested end-to-end without a Gitea instance or network access.
+package fakegitea
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	pingv1 "code.gitea.io/actions-proto-go/ping/v1"
+	"code.gitea.io/actions-proto-go/ping/v1/pingv1connect"
+	runnerv1 "code.gitea.io/actions-proto-go/runner/v1"
+	"code.gitea.io/actions-proto-go/runner/v1/runnerv1connect"
+	"connectrpc.com/connect"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"gitea.com/gitea/act_runner/internal/pkg/client"
+)
+
+// Runner is a runner registered to the server.
+type Runner struct {
+	ID      int64
+	UUID    string
+	Token   string
+	Name    string
+	Version string
+	Labels  []string // Labels are the ones declared by the runner, or registered if it hasn't declared.
+}
+
+// Task is a task queued in the server, and what the runner has reported about it.
+type Task struct {
+	Task      *runnerv1.Task
+	RunnerID  int64               // RunnerID is the ID of the runner which has fetched it, 0 if it's still queued.
+	Logs      []string            // Logs are the contents of the log rows.
+	LogsDone  bool                // LogsDone is true when the runner has reported that there are no more logs.
+	State     *runnerv1.TaskState // State is the state reported by the runner.
+	Outputs   map[string]string
+	Cancelled bool // Cancelled is true if the task has been cancelled by Cancel.
+	Notified  bool // Notified is true if the runner has been told that the task is cancelled.
+}
+
+// Finished returns whether the runner has reported the result and all logs of the task.
+func (t *Task) Finished() bool {
+	return t.LogsDone && t.State != nil && t.State.Result != runnerv1.Result_RESULT_UNSPECIFIED
+}
+
+// Server implements the RunnerService and PingService of Gitea in memory, and serves them over HTTP on a local address.
+type Server struct {
+	registrationToken string
+	srv               *httptest.Server
+
+	mu           sync.Mutex
+	changed      chan struct{} // changed is closed and replaced whenever something changes
+	adminToken   string        // adminToken is the access token accepted by the admin API, which isn't served if it's empty.
+	runners      []*Runner
+	tasks        map[int64]*Task
+	queue        []int64
+	nextTaskID   int64
+	nextRunnerID int64
+	tasksVersion int64
+}
+
+// NewServer starts a server which accepts registrations with registrationToken.
+func NewServer(registrationToken string) *Server {
+	s := &Server{
+		registrationToken: registrationToken,
+		changed:           make(chan struct{}),
+		tasks:             map[int64]*Task{},
+	}
+
+	mux := http.NewServeMux()
+	for _, register := range []func() (string, http.Handler){
+		func() (string, http.Handler) { return pingv1connect.NewPingServiceHandler(s) },
+		func() (string, http.Handler) { return runnerv1connect.NewRunnerServiceHandler(s) },
+	} {
+		path, handler := register()
+		mux.Handle("/api/actions"+path, http.StripPrefix("/api/actions", handler))
+	}
+	mux.HandleFunc("/api/v1/admin/actions/runners/", s.deleteRunner)
+	s.srv = httptest.NewServer(mux)
+	return s
+}
+
+// SetAdminToken makes the server serve the admin API with the access token, like a Gitea version supporting it.
+func (s *Server) SetAdminToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.adminToken = token
+}
+
+// URL returns the address of the Gitea instance to register the runner to.
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// NewTask returns a task running the only job of workflow, with the context of a push event.
+func NewTask(workflow string) *runnerv1.Task {
+	taskCtx, err := structpb.NewStruct(map[string]interface{}{
+		"repository":       "owner/repo",
+		"repository_owner": "owner",
+		"workflow":         "test.yaml",
+		"run_id":           "1",
+		"run_number":       "1",
+		"event_name":       "push",
+		"event":            map[string]interface{}{},
+		"ref":              "refs/heads/main",
+		"ref_name":         "main",
+		"ref_type":         "branch",
+		"sha":              strings.Repeat("0", 40),
+		"actor":            "user",
+		"token":            randomHex(20),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return &runnerv1.Task{
+		WorkflowPayload: []byte(workflow),
+		Context:         taskCtx,
+	}
+}
+
+// AddTask queues the task to be fetched by a runner, and returns its ID, which is assigned if it's 0.
+func (s *Server) AddTask(task *runnerv1.Task) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task = proto.Clone(task).(*runnerv1.Task)
+	if task.Id == 0 {
+		s.nextTaskID++
+		task.Id = s.nextTaskID
+	} else if task.Id > s.nextTaskID {
+		s.nextTaskID = task.Id
+	}
+	s.tasks[task.Id] = &Task{Task: task}
+	s.queue = append(s.queue, task.Id)
+	s.tasksVersion++
+	s.notifyLocked()
+	return task.Id
+}
+
+// Cancel cancels the task like a user does in the web UI,
+// the runner is told when it reports the state of the task next time.
+func (s *Server) Cancel(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tasks[id]
+	if !ok {
+		return fmt.Errorf("task %d not found", id)
+	}
+	t.Cancelled = true
+	s.notifyLocked()
+	return nil
+}
+
+// Task returns a copy of the task.
+func (s *Server) Task(id int64) *Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tasks[id]
+	if !ok {
+		return nil
+	}
+	return t.clone()
+}
+
+// Runners returns copies of the registered runners.
+func (s *Server) Runners() []*Runner {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ret := make([]*Runner, 0, len(s.runners))
+	for _, r := range s.runners {
+		c := *r
+		ret = append(ret, &c)
+	}
+	return ret
+}
+
+// WaitForTask waits until cond is true for the task, and returns a copy of it.
+func (s *Server) WaitForTask(ctx context.Context, id int64, cond func(t *Task) bool) (*Task, error) {
+	for {
+		s.mu.Lock()
+		t, ok := s.tasks[id]
+		if ok && cond(t) {
+			t = t.clone()
+			s.mu.Unlock()
+			return t, nil
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("wait for task %d: %w", id, ctx.Err())
+		case <-changed:
+		}
+	}
+}
+
+func (t *Task) clone() *Task {
+	c := *t
+	c.Task = proto.Clone(t.Task).(*runnerv1.Task)
+	c.Logs = append([]string(nil), t.Logs...)
+	if t.State != nil {
+		c.State = proto.Clone(t.State).(*runnerv1.TaskState)
+	}
+	c.Outputs = make(map[string]string, len(t.Outputs))
+	for k, v := range t.Outputs {
+		c.Outputs[k] = v
+	}
+	return &c
+}
+
+func (s *Server) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// runnerLocked returns the runner which sent the request.
+func (s *Server) runnerLocked(header http.Header) (*Runner, error) {
+	uuid, token := header.Get(client.UUIDHeader), header.Get(client.TokenHeader)
+	for _, r := range s.runners {
+		if r.UUID == uuid && r.Token == token {
+			return r, nil
+		}
+	}
+	return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("unregistered runner"))
+}
+
+// deleteRunner serves DELETE /api/v1/admin/actions/runners/{id} of the admin API.
+func (s *Server) deleteRunner(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.adminToken == "" || req.Method != http.MethodDelete {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Header.Get("Authorization") != "token "+s.adminToken {
+		http.Error(w, "invalid access token", http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(req.URL.Path, "/api/v1/admin/actions/runners/"), 10, 64)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	for i, r := range s.runners {
+		if r.ID == id {
+			s.runners = append(s.runners[:i], s.runners[i+1:]...)
+			s.notifyLocked()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	http.NotFound(w, req)
+}
+
+func (s *Server) Ping(_ context.Context, req *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+	return connect.NewResponse(&pingv1.PingResponse{
+		Data: "Hello, " + req.Msg.Data + "!",
+	}), nil
+}
+
+func (s *Server) Register(_ context.Context, req *connect.Request[runnerv1.RegisterRequest]) (*connect.Response[runnerv1.RegisterResponse], error) {
+	if req.Msg.Token != s.registrationToken {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("runner registration token not found"))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextRunnerID++
+	r := &Runner{
+		ID:      s.nextRunnerID,
+		UUID:    randomHex(16),
+		Token:   randomHex(20),
+		Name:    req.Msg.Name,
+		Version: req.Msg.Version,
+		Labels:  req.Msg.Labels,
+	}
+	s.runners = append(s.runners, r)
+	s.notifyLocked()
+	return connect.NewResponse(&runnerv1.RegisterResponse{Runner: r.proto()}), nil
+}
+
+func (s *Server) Declare(_ context.Context, req *connect.Request[runnerv1.DeclareRequest]) (*connect.Response[runnerv1.DeclareResponse], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.runnerLocked(req.Header())
+	if err != nil {
+		return nil, err
+	}
+	r.Version = req.Msg.Version
+	r.Labels = req.Msg.Labels
+	s.notifyLocked()
+	return connect.NewResponse(&runnerv1.DeclareResponse{Runner: r.proto()}), nil
+}
+
+func (s *Server) FetchTask(_ context.Context, req *connect.Request[runnerv1.FetchTaskRequest]) (*connect.Response[runnerv1.FetchTaskResponse], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.runnerLocked(req.Header())
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &runnerv1.FetchTaskResponse{TasksVersion: s.tasksVersion}
+	if len(s.queue) > 0 && req.Msg.TasksVersion != s.tasksVersion {
+		t := s.tasks[s.queue[0]]
+		s.queue = s.queue[1:]
+		t.RunnerID = r.ID
+		resp.Task = proto.Clone(t.Task).(*runnerv1.Task)
+		s.notifyLocked()
+	}
+	return connect.NewResponse(resp), nil
+}
+
+func (s *Server) UpdateTask(_ context.Context, req *connect.Request[runnerv1.UpdateTaskRequest]) (*connect.Response[runnerv1.UpdateTaskResponse], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.fetchedTaskLocked(req.Header(), req.Msg.GetState().GetId())
+	if err != nil {
+		return nil, err
+	}
+
+	if t.Outputs == nil {
+		t.Outputs = map[string]string{}
+	}
+	for k, v := range req.Msg.Outputs {
+		if _, ok := t.Outputs[k]; !ok {
+			t.Outputs[k] = v
+		}
+	}
+	sent := make([]string, 0, len(t.Outputs))
+	for k := range t.Outputs {
+		sent = append(sent, k)
+	}
+
+	// like Gitea, the state of a finished task can't be changed anymore
+	if t.State == nil || t.State.Result == runnerv1.Result_RESULT_UNSPECIFIED {
+		t.State = proto.Clone(req.Msg.State).(*runnerv1.TaskState)
+	}
+	s.notifyLocked()
+
+	state := &runnerv1.TaskState{Id: t.Task.Id, Result: t.State.Result}
+	if t.Cancelled {
+		state.Result = runnerv1.Result_RESULT_CANCELLED
+		t.Notified = true
+	}
+	return connect.NewResponse(&runnerv1.UpdateTaskResponse{
+		State:       state,
+		SentOutputs: sent,
+	}), nil
+}
+
+func (s *Server) UpdateLog(_ context.Context, req *connect.Request[runnerv1.UpdateLogRequest]) (*connect.Response[runnerv1.UpdateLogResponse], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.fetchedTaskLocked(req.Header(), req.Msg.TaskId)
+	if err != nil {
+		return nil, err
+	}
+
+	ack := int64(len(t.Logs))
+	if req.Msg.Index > ack {
+		// there is a gap, ask the runner to send from the end of the received logs
+		return connect.NewResponse(&runnerv1.UpdateLogResponse{AckIndex: ack}), nil
+	}
+	// the rows could have been resent after they were acked, skip the received ones
+	for _, row := range req.Msg.Rows[min(ack-req.Msg.Index, int64(len(req.Msg.Rows))):] {
+		t.Logs = append(t.Logs, row.Content)
+	}
+	if req.Msg.NoMore {
+		t.LogsDone = true
+	}
+	s.notifyLocked()
+	return connect.NewResponse(&runnerv1.UpdateLogResponse{AckIndex: int64(len(t.Logs))}), nil
+}
+
+// fetchedTaskLocked returns the task if it has been fetched by the runner which sent the request.
+func (s *Server) fetchedTaskLocked(header http.Header, id int64) (*Task, error) {
+	r, err := s.runnerLocked(header)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := s.tasks[id]
+	if !ok || t.RunnerID != r.ID {
+		return nil, connect.NewError(connect.CodeNotFound, fmt.Errorf("task %d not found", id))
+	}
+	return t, nil
+}
+
+func (r *Runner) proto() *runnerv1.Runner {
+	return &runnerv1.Runner{
+		Id:      r.ID,
+		Uuid:    r.UUID,
+		Token:   r.Token,
+		Name:    r.Name,
+		Version: r.Version,
+		Labels:  r.Labels,
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,79 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+// Package health provides the liveness and readiness probes of the runner daemon.
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Check reports an error if the component it checks is not healthy.
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Probe is a http handler which responds 200 when all of its checks pass, and 503 otherwise.
+type Probe struct {
+	mu      sync.Mutex
+	checks  []namedCheck
+	timeout time.Duration
+}
+
+// NewProbe creates a Probe, timeout limits the duration of each check.
+func NewProbe(timeout time.Duration) *Probe {
+	return &Probe{timeout: timeout}
+}
+
+// Add registers a check, the name is used to report which check has failed.
+func (p *Probe) Add(name string, check Check) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.checks = append(p.checks, namedCheck{name: name, check: check})
+}
+
+// Check runs all checks and returns the failures, keyed by check name.
+func (p *Probe) Check(ctx context.Context) map[string]error {
+	p.mu.Lock()
+	checks := p.checks
+	p.mu.Unlock()
+
+	failures := map[string]error{}
+	for _, c := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, p.timeout)
+		err := c.check(checkCtx)
+		cancel()
+		if err != nil {
+			failures[c.name] = err
+		}
+	}
+	return failures
+}
+
+func (p *Probe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	failures := p.Check(r.Context())
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(failures) == 0 {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok\n"))
+		return
+	}
+
+	lines := make([]string, 0, len(failures))
+	for name, err := range failures {
+		lines = append(lines, fmt.Sprintf("%s: %v", name, err))
+	}
+	sort.Strings(lines)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = w.Write([]byte(strings.Join(lines, "\n") + "\n"))
+}
@@ -0,0 +1,51 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbe_ServeHTTP(t *testing.T) {
+	serve := func(p *Probe) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		return rec
+	}
+
+	t.Run("no checks", func(t *testing.T) {
+		rec := serve(NewProbe(time.Second))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "ok\n", rec.Body.String())
+	})
+
+	t.Run("failed checks", func(t *testing.T) {
+		p := NewProbe(time.Second)
+		p.Add("docker", func(context.Context) error { return errors.New("cannot ping") })
+		p.Add("poller", func(context.Context) error { return nil })
+		p.Add("declare", func(context.Context) error { return errors.New("not declared") })
+
+		rec := serve(p)
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		assert.Equal(t, "declare: not declared\ndocker: cannot ping\n", rec.Body.String())
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		p := NewProbe(10 * time.Millisecond)
+		p.Add("slow", func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		rec := serve(p)
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		assert.Contains(t, rec.Body.String(), "slow: context deadline exceeded")
+	})
+}
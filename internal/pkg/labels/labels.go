@@ -5,12 +5,28 @@ package labels
 
 import (
 	"fmt"
+	"slices"
 	"strings"
 )
 
 const (
 	SchemeHost   = "host"
 	SchemeDocker = "docker"
+
+	// schemeK8s is rejected with a clear error, since act can only run the containers of jobs with Docker.
+	schemeK8s = "k8s"
+)
+
+const (
+	// LegacyDefaultPlatform is used when no label matches runs-on and no default platform is configured.
+	LegacyDefaultPlatform = "gitea/runner-images:ubuntu-latest"
+	// DefaultPlatformReject means jobs which don't match any label are not run.
+	DefaultPlatformReject = "reject"
+
+	// HostPlatform is the platform of act which runs jobs on the host.
+	HostPlatform = "-self-hosted"
+	// nameSeparator joins the names a label requires, like "ubuntu-22.04+gpu".
+	nameSeparator = "+"
 )
 
 type Label struct {
@@ -32,12 +48,35 @@ func Parse(str string) (*Label, error) {
 	if len(splits) >= 3 {
 		label.Arg = splits[2]
 	}
+	if label.Schema == schemeK8s {
+		return nil, fmt.Errorf("unsupported schema: %s, running jobs as Kubernetes pods isn't supported, use %q or %q instead", label.Schema, SchemeDocker, SchemeHost)
+	}
 	if label.Schema != SchemeHost && label.Schema != SchemeDocker {
 		return nil, fmt.Errorf("unsupported schema: %s", label.Schema)
 	}
 	return label, nil
 }
 
+// Requires returns the names which must all be in runs-on for the label to match.
+func (l *Label) Requires() []string {
+	var names []string
+	for _, name := range strings.Split(l.Name, nameSeparator) {
+		if name != "" && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Platform returns the platform for act to run the jobs of the label.
+func (l *Label) Platform() string {
+	if l.Schema == SchemeDocker {
+		// "//" will be ignored
+		return strings.TrimPrefix(l.Arg, "//")
+	}
+	return HostPlatform
+}
+
 type Labels []*Label
 
 func (l Labels) RequireDocker() bool {
@@ -49,40 +88,132 @@ func (l Labels) RequireDocker() bool {
 	return false
 }
 
-func (l Labels) PickPlatform(runsOn []string) string {
-	platforms := make(map[string]string, len(l))
+// Match returns the label which matches runs-on best, or nil if none matches.
+// A label matches only if all the names it requires are in runs-on,
+// the label requiring more names is more specific and wins.
+// For a tie, the label whose name appears earlier in runs-on wins, then the one declared first.
+func (l Labels) Match(runsOn []string) *Label {
+	var best *Label
+	bestScore, bestPos := 0, 0
 	for _, label := range l {
-		switch label.Schema {
-		case SchemeDocker:
-			// "//" will be ignored
-			platforms[label.Name] = strings.TrimPrefix(label.Arg, "//")
-		case SchemeHost:
-			platforms[label.Name] = "-self-hosted"
-		default:
+		if label.Schema != SchemeHost && label.Schema != SchemeDocker {
 			// It should not happen, because Parse has checked it.
 			continue
 		}
+		requires := label.Requires()
+		pos, ok := positionOfAll(runsOn, requires)
+		if !ok {
+			continue
+		}
+		if len(requires) > bestScore || (len(requires) == bestScore && pos < bestPos) {
+			best, bestScore, bestPos = label, len(requires), pos
+		}
 	}
-	for _, v := range runsOn {
-		if v, ok := platforms[v]; ok {
-			return v
+	return best
+}
+
+// PartialMatch returns a label requiring multiple names, some but not all of which are in runs-on, or nil if there is none.
+// Gitea can assign such jobs to the runner, because each name the label requires is declared on its own, see Names.
+func (l Labels) PartialMatch(runsOn []string) *Label {
+	for _, label := range l {
+		requires := label.Requires()
+		if len(requires) < 2 {
+			continue
+		}
+		if slices.ContainsFunc(requires, func(name string) bool { return slices.Contains(runsOn, name) }) {
+			return label
 		}
 	}
+	return nil
+}
 
-	// TODO: support multiple labels
-	// like:
-	//   ["ubuntu-22.04"] => "ubuntu:22.04"
-	//   ["with-gpu"] => "linux:with-gpu"
-	//   ["ubuntu-22.04", "with-gpu"] => "ubuntu:22.04_with-gpu"
+// positionOfAll reports whether all values are in the set, and the smallest index of them in the set.
+func positionOfAll(set, values []string) (int, bool) {
+	pos := len(set)
+	for _, v := range values {
+		i := slices.Index(set, v)
+		if i < 0 {
+			return 0, false
+		}
+		pos = min(pos, i)
+	}
+	return pos, len(values) > 0
+}
+
+// PickPlatform returns the platform of the label matching runs-on,
+// or falls back to the legacy default platform if none matches.
+// An empty platform is returned if runs-on only matches a label requiring multiple names partially, see PartialMatch.
+func (l Labels) PickPlatform(runsOn []string) string {
+	if label := l.Match(runsOn); label != nil {
+		return label.Platform()
+	}
+	if l.PartialMatch(runsOn) != nil {
+		return ""
+	}
 
 	// return default.
 	// So the runner receives a task with a label that the runner doesn't have,
 	// it happens when the user have edited the label of the runner in the web UI.
-	// TODO: it may be not correct, what if the runner is used as host mode only?
-	return "gitea/runner-images:ubuntu-latest"
+	return LegacyDefaultPlatform
+}
+
+// PlatformPicker returns a function which picks the platform of the label matching runs-on,
+// or falls back to the platform specified by fallback, see ParseDefaultPlatform.
+// Like PickPlatform, it never falls back if runs-on matches a label requiring multiple names partially.
+func (l Labels) PlatformPicker(fallback string) (func(runsOn []string) string, error) {
+	platform, err := ParseDefaultPlatform(fallback)
+	if err != nil {
+		return nil, err
+	}
+	return func(runsOn []string) string {
+		if label := l.Match(runsOn); label != nil {
+			return label.Platform()
+		}
+		if l.PartialMatch(runsOn) != nil {
+			return ""
+		}
+		return platform
+	}, nil
 }
 
+// ParseDefaultPlatform parses the platform to use when no label matches runs-on, it could be:
+//   - "": the legacy default platform, the docker image gitea/runner-images:ubuntu-latest
+//   - "host": run jobs on the host
+//   - "docker://<image>": run jobs in the docker image
+//   - "reject": don't run the job, an empty platform is returned
+func ParseDefaultPlatform(s string) (string, error) {
+	switch {
+	case s == "":
+		return LegacyDefaultPlatform, nil
+	case s == DefaultPlatformReject:
+		return "", nil
+	case s == SchemeHost:
+		return HostPlatform, nil
+	case strings.HasPrefix(s, SchemeDocker+"://") && len(s) > len(SchemeDocker+"://"):
+		return strings.TrimPrefix(s, SchemeDocker+"://"), nil
+	}
+	return "", fmt.Errorf("invalid default platform %q, it should be %q, %q or %q", s, SchemeHost, SchemeDocker+"://<image>", DefaultPlatformReject)
+}
+
+// Names returns the names to declare, labels requiring multiple names are split into them.
+// Gitea requires a runner to have every name in runs-on, so a label like "gpu+cuda" is declared as "gpu" and "cuda".
+// As a result, a job with only some of them, like `runs-on: gpu`, could be assigned to the runner, and it's rejected instead of
+// falling back to the default platform.
 func (l Labels) Names() []string {
+	names := make([]string, 0, len(l))
+	for _, label := range l {
+		for _, name := range label.Requires() {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// FullNames returns the names of the labels as they are configured, like "ubuntu-22.04+gpu" for a label requiring multiple names.
+// They are the keys of runner.label_capacity.
+func (l Labels) FullNames() []string {
 	names := make([]string, 0, len(l))
 	for _, label := range l {
 		names = append(names, label.Name)
@@ -4,6 +4,7 @@
 package labels
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -61,3 +62,93 @@ func TestParse(t *testing.T) {
 		})
 	}
 }
+
+func TestParse_K8s(t *testing.T) {
+	_, err := Parse("ubuntu:k8s://node:18")
+	assert.Error(t, err, `unsupported schema: k8s, running jobs as Kubernetes pods isn't supported, use "docker" or "host" instead`)
+}
+
+func TestLabels_PickPlatform(t *testing.T) {
+	ls := Labels{}
+	for _, v := range []string{
+		"ubuntu-latest:docker://node:18",
+		"ubuntu-22.04:docker://ubuntu:22.04",
+		"ubuntu-22.04+gpu:docker://ubuntu:22.04-gpu",
+		"gpu+ubuntu-22.04+large:docker://ubuntu:22.04-gpu-large",
+		"macos:host",
+	} {
+		l, err := Parse(v)
+		require.NoError(t, err)
+		ls = append(ls, l)
+	}
+
+	tests := []struct {
+		runsOn []string
+		want   string
+	}{
+		{[]string{"ubuntu-latest"}, "node:18"},
+		{[]string{"ubuntu-22.04"}, "ubuntu:22.04"},
+		{[]string{"gpu", "ubuntu-22.04"}, "ubuntu:22.04-gpu"},
+		{[]string{"ubuntu-22.04", "large", "gpu"}, "ubuntu:22.04-gpu-large"},
+		{[]string{"gpu"}, ""},
+		{[]string{"large", "ubuntu-22.04"}, "ubuntu:22.04"},
+		{[]string{"macos", "ubuntu-latest"}, "-self-hosted"},
+		{[]string{"windows"}, LegacyDefaultPlatform},
+		{nil, LegacyDefaultPlatform},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.runsOn, ","), func(t *testing.T) {
+			assert.Equal(t, tt.want, ls.PickPlatform(tt.runsOn))
+		})
+	}
+
+	assert.DeepEqual(t, []string{"ubuntu-latest", "ubuntu-22.04", "gpu", "large", "macos"}, ls.Names())
+	assert.DeepEqual(t, []string{"ubuntu-latest", "ubuntu-22.04", "ubuntu-22.04+gpu", "gpu+ubuntu-22.04+large", "macos"}, ls.FullNames())
+	assert.Equal(t, "ubuntu-22.04+gpu", ls.PartialMatch([]string{"gpu"}).Name)
+	assert.Equal(t, "gpu+ubuntu-22.04+large", ls.PartialMatch([]string{"large"}).Name)
+	assert.Assert(t, ls.PartialMatch([]string{"windows"}) == nil)
+}
+
+func TestLabels_PlatformPicker(t *testing.T) {
+	l, err := Parse("ubuntu-latest:docker://node:18")
+	require.NoError(t, err)
+	ls := Labels{l}
+
+	tests := []struct {
+		fallback string
+		want     string
+		wantErr  bool
+	}{
+		{"", LegacyDefaultPlatform, false},
+		{"host", "-self-hosted", false},
+		{"docker://alpine:3", "alpine:3", false},
+		{"reject", "", false},
+		{"docker://", "", true},
+		{"vm", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fallback, func(t *testing.T) {
+			pick, err := ls.PlatformPicker(tt.fallback)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "node:18", pick([]string{"ubuntu-latest"}))
+			assert.Equal(t, tt.want, pick([]string{"windows"}))
+		})
+	}
+
+	l, err = Parse("ubuntu-22.04+gpu:docker://ubuntu:22.04-gpu")
+	require.NoError(t, err)
+	ls = append(ls, l)
+	for _, fallback := range []string{"", "host", "docker://alpine:3"} {
+		t.Run(fallback+" partial", func(t *testing.T) {
+			pick, err := ls.PlatformPicker(fallback)
+			require.NoError(t, err)
+			// the job isn't run on the default platform, since it asks for a part of the label
+			assert.Equal(t, "", pick([]string{"gpu"}))
+			assert.Equal(t, "ubuntu:22.04-gpu", pick([]string{"ubuntu-22.04", "gpu"}))
+		})
+	}
+}
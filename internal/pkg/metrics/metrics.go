@@ -0,0 +1,97 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+// Package metrics provides the Prometheus metrics exposed by the runner daemon.
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+)
+
+const namespace = "act_runner_"
+
+var (
+	durationBuckets    = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	jobDurationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200, 10800}
+)
+
+var (
+	RunnerInfo = NewGaugeVec(namespace+"info",
+		"Information about the runner, the value is always 1.", "name", "version")
+
+	PollFetchTotal = NewCounterVec(namespace+"poll_fetch_total",
+		"Total number of FetchTask requests sent to Gitea.", "runner")
+	PollFetchErrorsTotal = NewCounterVec(namespace+"poll_fetch_errors_total",
+		"Total number of FetchTask requests that failed.", "runner")
+	PollTasksFetchedTotal = NewCounterVec(namespace+"poll_tasks_fetched_total",
+		"Total number of tasks received from Gitea.", "runner")
+	PollCircuitOpen = NewGaugeVec(namespace+"poll_circuit_open",
+		"Whether fetching tasks is held back because it has failed too many times in a row, 1 if it is.", "runner")
+
+	TasksRunning = NewGaugeVec(namespace+"tasks_running",
+		"Number of tasks currently being run.", "runner")
+	HostUnderPressure = NewGaugeVec(namespace+"host_under_pressure",
+		"Whether new tasks are held back because the host is short of resources, 1 if it is.", "runner")
+	RunnerDraining = NewGaugeVec(namespace+"runner_draining",
+		"Whether the runner is draining or drained, so no new task is taken, 1 if it is.")
+
+	JobsTotal = NewCounterVec(namespace+"jobs_total",
+		"Total number of finished jobs by result.", "runner", "result")
+	JobDurationSeconds = NewHistogramVec(namespace+"job_duration_seconds",
+		"Duration of finished jobs in seconds by result.", jobDurationBuckets, "runner", "result")
+
+	ReportDurationSeconds = NewHistogramVec(namespace+"report_duration_seconds",
+		"Latency of the requests reporting logs and states to Gitea in seconds.", durationBuckets, "method", "status")
+)
+
+// DefaultRegistry contains all metrics of the runner.
+var DefaultRegistry = NewRegistry(
+	RunnerInfo,
+	PollFetchTotal,
+	PollFetchErrorsTotal,
+	PollTasksFetchedTotal,
+	PollCircuitOpen,
+	TasksRunning,
+	HostUnderPressure,
+	RunnerDraining,
+	JobsTotal,
+	JobDurationSeconds,
+	ReportDurationSeconds,
+)
+
+// Registry is a set of collectors exposed together.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+func NewRegistry(collectors ...Collector) *Registry {
+	return &Registry{collectors: collectors}
+}
+
+func (r *Registry) Register(collectors ...Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, collectors...)
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.mu.Lock()
+	collectors := r.collectors
+	r.mu.Unlock()
+
+	buf := &bytes.Buffer{}
+	for _, c := range collectors {
+		c.Collect(buf)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// Handler returns the http handler serving the metrics of DefaultRegistry.
+func Handler() http.Handler {
+	return DefaultRegistry
+}
@@ -0,0 +1,54 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry_ServeHTTP(t *testing.T) {
+	counter := NewCounterVec("test_total", "A counter.", "result")
+	gauge := NewGaugeVec("test_running", "A gauge.")
+	histogram := NewHistogramVec("test_seconds", "A histogram.", []float64{1, 5}, "method")
+
+	counter.WithLabelValues("success").Inc()
+	counter.WithLabelValues("success").Add(2)
+	counter.WithLabelValues(`fa"il`).Inc()
+	gauge.WithLabelValues().Inc()
+	gauge.WithLabelValues().Inc()
+	gauge.WithLabelValues().Dec()
+	histogram.WithLabelValues("UpdateLog").Observe(0.5)
+	histogram.WithLabelValues("UpdateLog").Observe(3)
+	histogram.WithLabelValues("UpdateLog").Observe(10)
+
+	rec := httptest.NewRecorder()
+	NewRegistry(counter, gauge, histogram).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{result="fa\"il"} 1
+test_total{result="success"} 3
+# HELP test_running A gauge.
+# TYPE test_running gauge
+test_running 1
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{method="UpdateLog",le="1"} 1
+test_seconds_bucket{method="UpdateLog",le="5"} 2
+test_seconds_bucket{method="UpdateLog",le="+Inf"} 3
+test_seconds_sum{method="UpdateLog"} 13.5
+test_seconds_count{method="UpdateLog"} 3
+`, rec.Body.String())
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain")
+}
+
+func TestVec_WithLabelValues(t *testing.T) {
+	counter := NewCounterVec("test_total", "A counter.", "a", "b")
+	assert.Same(t, counter.WithLabelValues("x", "y"), counter.WithLabelValues("x", "y"))
+	assert.NotSame(t, counter.WithLabelValues("x", "y"), counter.WithLabelValues("xy", ""))
+	assert.Panics(t, func() { counter.WithLabelValues("x") })
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+// Package pressure checks whether the host has enough free resources to take a new task.
+package pressure
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/docker/go-units"
+
+	"gitea.com/gitea/act_runner/internal/pkg/config"
+)
+
+// Monitor compares the resource usages of the host with the configured thresholds.
+type Monitor struct {
+	maxLoad       float64
+	minFreeMemory uint64
+	minFreeDisk   uint64
+	paths         []string
+
+	// they can be replaced in tests
+	cpus          func() int
+	loadAverage   func() (float64, error)
+	freeMemory    func() (uint64, error)
+	freeDiskSpace func(path string) (uint64, error)
+}
+
+// NewMonitor creates a Monitor, paths are the directories whose file systems need free disk space.
+func NewMonitor(cfg config.Pressure, paths ...string) (*Monitor, error) {
+	m := &Monitor{
+		maxLoad: cfg.MaxLoad,
+		paths:   paths,
+
+		cpus:          runtime.NumCPU,
+		loadAverage:   readLoadAverage,
+		freeMemory:    readFreeMemory,
+		freeDiskSpace: freeDiskSpace,
+	}
+	if cfg.MinFreeMemory != "" {
+		v, err := units.RAMInBytes(cfg.MinFreeMemory)
+		if err != nil {
+			return nil, fmt.Errorf("invalid min_free_memory %q: %w", cfg.MinFreeMemory, err)
+		}
+		m.minFreeMemory = uint64(v)
+	}
+	if cfg.MinFreeDisk != "" {
+		v, err := units.RAMInBytes(cfg.MinFreeDisk)
+		if err != nil {
+			return nil, fmt.Errorf("invalid min_free_disk %q: %w", cfg.MinFreeDisk, err)
+		}
+		m.minFreeDisk = uint64(v)
+	}
+	return m, nil
+}
+
+// Check returns an error describing the pressure if any resource is beyond its threshold.
+// A resource which can't be read is ignored, so an unsupported platform never blocks the runner.
+func (m *Monitor) Check() error {
+	if m.maxLoad > 0 {
+		if load, err := m.loadAverage(); err == nil {
+			if perCPU := load / float64(m.cpus()); perCPU > m.maxLoad {
+				return fmt.Errorf("load average per CPU %.2f is above %.2f", perCPU, m.maxLoad)
+			}
+		}
+	}
+	if m.minFreeMemory > 0 {
+		if free, err := m.freeMemory(); err == nil && free < m.minFreeMemory {
+			return fmt.Errorf("free memory %s is below %s", units.BytesSize(float64(free)), units.BytesSize(float64(m.minFreeMemory)))
+		}
+	}
+	if m.minFreeDisk > 0 {
+		for _, path := range m.paths {
+			if free, err := m.freeDiskSpace(path); err == nil && free < m.minFreeDisk {
+				return fmt.Errorf("free disk space of %s %s is below %s", path, units.BytesSize(float64(free)), units.BytesSize(float64(m.minFreeDisk)))
+			}
+		}
+	}
+	return nil
+}
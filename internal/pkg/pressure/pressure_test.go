@@ -0,0 +1,75 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package pressure
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitea.com/gitea/act_runner/internal/pkg/config"
+)
+
+func TestParseLoadAverage(t *testing.T) {
+	load, err := parseLoadAverage(strings.NewReader("3.50 2.10 1.00 2/345 6789\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 3.5, load)
+
+	_, err = parseLoadAverage(strings.NewReader(""))
+	assert.Error(t, err)
+}
+
+func TestParseFreeMemory(t *testing.T) {
+	free, err := parseFreeMemory(strings.NewReader(`MemTotal:       16318412 kB
+MemFree:          812340 kB
+MemAvailable:    2097152 kB
+Buffers:          402812 kB
+`))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2<<30), free)
+
+	_, err = parseFreeMemory(strings.NewReader("MemTotal:       16318412 kB\n"))
+	assert.Error(t, err)
+}
+
+func TestMonitor_Check(t *testing.T) {
+	m, err := NewMonitor(config.Pressure{
+		Enabled:       true,
+		MaxLoad:       1.5,
+		MinFreeMemory: "1GiB",
+		MinFreeDisk:   "10GiB",
+	}, "/workdir", "/var/lib/docker")
+	require.NoError(t, err)
+
+	load, memory := 4.0, uint64(2<<30)
+	disk := map[string]uint64{"/workdir": 20 << 30, "/var/lib/docker": 20 << 30}
+	m.cpus = func() int { return 4 }
+	m.loadAverage = func() (float64, error) { return load, nil }
+	m.freeMemory = func() (uint64, error) { return memory, nil }
+	m.freeDiskSpace = func(path string) (uint64, error) { return disk[path], nil }
+	assert.NoError(t, m.Check())
+
+	load = 8
+	assert.EqualError(t, m.Check(), "load average per CPU 2.00 is above 1.50")
+	load = 4
+
+	memory = 512 << 20
+	assert.EqualError(t, m.Check(), "free memory 512MiB is below 1GiB")
+	memory = 2 << 30
+
+	disk["/var/lib/docker"] = 5 << 30
+	assert.EqualError(t, m.Check(), "free disk space of /var/lib/docker 5GiB is below 10GiB")
+
+	// resources which can't be read are ignored
+	m.freeDiskSpace = func(string) (uint64, error) { return 0, errors.New("not supported") }
+	assert.NoError(t, m.Check())
+}
+
+func TestNewMonitor_InvalidSize(t *testing.T) {
+	_, err := NewMonitor(config.Pressure{MinFreeMemory: "lots"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package pressure
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func readLoadAverage() (float64, error) {
+	f, err := os.Open("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return parseLoadAverage(f)
+}
+
+// parseLoadAverage returns the 1-minute load average in the format of /proc/loadavg, like "0.20 0.18 0.12 1/80 11206".
+func parseLoadAverage(r io.Reader) (float64, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("invalid loadavg %q", content)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+func readFreeMemory() (uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return parseFreeMemory(f)
+}
+
+// parseFreeMemory returns MemAvailable in bytes in the format of /proc/meminfo.
+func parseFreeMemory(r io.Reader) (uint64, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || key != "MemAvailable" {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			break
+		}
+		v, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		if len(fields) > 1 && fields[1] == "kB" {
+			v *= 1024
+		}
+		return v, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("MemAvailable not found")
+}
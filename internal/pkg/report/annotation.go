@@ -0,0 +1,144 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package report
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxAnnotations is the maximum number of annotations collected for a task, the rest are only counted.
+const maxAnnotations = 50
+
+// Annotation is created by the `notice`, `warning` and `error` workflow commands.
+type Annotation struct {
+	Level     string // Level is one of "notice", "warning" and "error".
+	Message   string
+	Title     string
+	File      string
+	Line      int
+	EndLine   int
+	Col       int
+	EndColumn int
+	Step      int // Step is the index of the step which created the annotation, -1 if it's not created by a step.
+}
+
+// Location returns the position in the source file, like "file.go:42-48:3", or an empty string if there is no file.
+func (a *Annotation) Location() string {
+	if a.File == "" {
+		return ""
+	}
+	loc := a.File
+	if a.Line > 0 {
+		loc += ":" + strconv.Itoa(a.Line)
+		if a.EndLine > a.Line {
+			loc += "-" + strconv.Itoa(a.EndLine)
+		}
+		if a.Col > 0 {
+			loc += ":" + strconv.Itoa(a.Col)
+			if a.EndColumn > a.Col {
+				loc += "-" + strconv.Itoa(a.EndColumn)
+			}
+		}
+	}
+	return loc
+}
+
+func (a *Annotation) String() string {
+	s := strings.ToUpper(a.Level[:1]) + a.Level[1:]
+	if loc := a.Location(); loc != "" {
+		s += " " + loc
+	}
+	if a.Title != "" {
+		s += ": " + a.Title
+	}
+	return s + ": " + a.Message
+}
+
+// parseAnnotation parses the parameters and the message of an annotation command,
+// see https://docs.github.com/en/actions/using-workflows/workflow-commands-for-github-actions#setting-a-notice-message
+func parseAnnotation(level, parameters, value string, step int) *Annotation {
+	a := &Annotation{
+		Level:   level,
+		Message: unescapeData(value),
+		Step:    step,
+	}
+	for _, p := range strings.Split(strings.TrimSpace(parameters), ",") {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok {
+			continue
+		}
+		v = unescapeProperty(v)
+		switch strings.TrimSpace(k) {
+		case "title":
+			a.Title = v
+		case "file":
+			a.File = v
+		case "line":
+			a.Line, _ = strconv.Atoi(v)
+		case "endLine":
+			a.EndLine, _ = strconv.Atoi(v)
+		case "col":
+			a.Col, _ = strconv.Atoi(v)
+		case "endColumn":
+			a.EndColumn, _ = strconv.Atoi(v)
+		}
+	}
+	return a
+}
+
+var (
+	dataUnescaper     = strings.NewReplacer("%0D", "\r", "%0A", "\n", "%25", "%")
+	propertyUnescaper = strings.NewReplacer("%0D", "\r", "%0A", "\n", "%3A", ":", "%2C", ",", "%25", "%")
+)
+
+func unescapeData(s string) string {
+	return dataUnescaper.Replace(s)
+}
+
+func unescapeProperty(s string) string {
+	return propertyUnescaper.Replace(s)
+}
+
+// addAnnotation records an annotation, it should be called with stateMu locked.
+// Its texts are masked like the log rows, since any of them could contain a secret.
+func (r *Reporter) addAnnotation(a *Annotation) {
+	if r.annotationCounts == nil {
+		r.annotationCounts = map[string]int{}
+	}
+	r.annotationCounts[a.Level]++
+	if len(r.annotations) >= maxAnnotations {
+		return
+	}
+	a.Message = r.masker.Replace(a.Message)
+	a.Title = r.masker.Replace(a.Title)
+	a.File = r.masker.Replace(a.File)
+	r.annotations = append(r.annotations, a)
+}
+
+// Annotations returns the annotations created by the task so far.
+func (r *Reporter) Annotations() []*Annotation {
+	r.stateMu.RLock()
+	defer r.stateMu.RUnlock()
+	ret := make([]*Annotation, len(r.annotations))
+	copy(ret, r.annotations)
+	return ret
+}
+
+// annotationSummary returns the log lines summarizing the annotations, it should be called with stateMu locked.
+func (r *Reporter) annotationSummary() []string {
+	if len(r.annotations) == 0 {
+		return nil
+	}
+	counts := r.annotationCounts
+	lines := []string{fmt.Sprintf("Annotations: %d error(s), %d warning(s), %d notice(s)", counts["error"], counts["warning"], counts["notice"])}
+	for _, a := range r.annotations {
+		lines = append(lines, a.String())
+	}
+	if dropped := counts["error"] + counts["warning"] + counts["notice"] - len(r.annotations); dropped > 0 {
+		lines = append(lines, fmt.Sprintf("%d more annotation(s) are omitted, only the first %d are kept", dropped, maxAnnotations))
+	}
+	return lines
+}
@@ -0,0 +1,122 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package report
+
+import (
+	"context"
+	"testing"
+
+	runnerv1 "code.gitea.io/actions-proto-go/runner/v1"
+	connect_go "connectrpc.com/connect"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"gitea.com/gitea/act_runner/internal/pkg/client/mocks"
+)
+
+func TestParseAnnotation(t *testing.T) {
+	tests := []struct {
+		level      string
+		parameters string
+		value      string
+		want       *Annotation
+		wantString string
+	}{
+		{
+			"notice", "", "Something happened",
+			&Annotation{Level: "notice", Message: "Something happened", Step: 1},
+			"Notice: Something happened",
+		},
+		{
+			"error", " file=app.js,line=1", "Missing semicolon",
+			&Annotation{Level: "error", Message: "Missing semicolon", File: "app.js", Line: 1, Step: 1},
+			"Error app.js:1: Missing semicolon",
+		},
+		{
+			"warning", " file=file.name,line=42,endLine=48,col=3,endColumn=7,title=Cool Title", "Gosh, that's not going to work",
+			&Annotation{Level: "warning", Message: "Gosh, that's not going to work", Title: "Cool Title", File: "file.name", Line: 42, EndLine: 48, Col: 3, EndColumn: 7, Step: 1},
+			"Warning file.name:42-48:3-7: Cool Title: Gosh, that's not going to work",
+		},
+		{
+			"error", " title=a%2C b%3A c%25", "line 1%0Aline 2",
+			&Annotation{Level: "error", Message: "line 1\nline 2", Title: "a, b: c%", Step: 1},
+			"Error: a, b: c%: line 1\nline 2",
+		},
+		{
+			"notice", " line=abc,unknown=1,broken", "message",
+			&Annotation{Level: "notice", Message: "message", Step: 1},
+			"Notice: message",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.wantString, func(t *testing.T) {
+			got := parseAnnotation(tt.level, tt.parameters, tt.value, 1)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantString, got.String())
+		})
+	}
+}
+
+func TestReporter_Annotations(t *testing.T) {
+	var rows []string
+	client := mocks.NewClient(t)
+	client.On("UpdateLog", mock.Anything, mock.Anything).Return(func(_ context.Context, req *connect_go.Request[runnerv1.UpdateLogRequest]) (*connect_go.Response[runnerv1.UpdateLogResponse], error) {
+		for _, row := range req.Msg.Rows {
+			rows = append(rows, row.Content)
+		}
+		return connect_go.NewResponse(&runnerv1.UpdateLogResponse{
+			AckIndex: req.Msg.Index + int64(len(req.Msg.Rows)),
+		}), nil
+	})
+	client.On("UpdateTask", mock.Anything, mock.Anything).Return(connect_go.NewResponse(&runnerv1.UpdateTaskResponse{}), nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	taskCtx, err := structpb.NewStruct(map[string]interface{}{})
+	require.NoError(t, err)
+	reporter := NewReporter(ctx, cancel, client, &runnerv1.Task{
+		Id:      3,
+		Context: taskCtx,
+		Secrets: map[string]string{"PASSWORD": "hunter2"},
+	})
+	reporter.ResetSteps(2)
+
+	step := func(i int) map[string]interface{} {
+		return map[string]interface{}{"stage": "Main", "stepNumber": i, "raw_output": true}
+	}
+	require.NoError(t, reporter.Fire(&log.Entry{Message: "::warning file=main.go,line=3::unused variable", Data: step(0)}))
+	require.NoError(t, reporter.Fire(&log.Entry{Message: "::error title=Login,file=hunter2.txt::wrong password hunter2", Data: step(1)}))
+	require.NoError(t, reporter.Fire(&log.Entry{Message: "::add-mask::not an annotation", Data: step(1)}))
+
+	annotations := reporter.Annotations()
+	require.Len(t, annotations, 2)
+	assert.Equal(t, 0, annotations[0].Step)
+	assert.Equal(t, 1, annotations[1].Step)
+	assert.Equal(t, "wrong password ***", annotations[1].Message)
+	assert.Equal(t, "***.txt", annotations[1].File)
+
+	require.NoError(t, reporter.Close(""))
+	assert.Equal(t, []string{
+		"Annotations: 1 error(s), 1 warning(s), 0 notice(s)",
+		"Warning main.go:3: unused variable",
+		"Error ***.txt: Login: wrong password ***",
+	}, rows[len(rows)-3:])
+}
+
+func TestReporter_AnnotationsLimit(t *testing.T) {
+	r := &Reporter{masker: NewMasker()}
+	for i := 0; i < maxAnnotations+5; i++ {
+		r.parseLogRow(&log.Entry{Message: "::notice::hello", Data: log.Fields{"raw_output": true}})
+	}
+	assert.Len(t, r.Annotations(), maxAnnotations)
+	r.parseLogRow(&log.Entry{Message: "::error::failed", Data: log.Fields{"raw_output": true}})
+	r.parseLogRow(&log.Entry{Message: "::error::logged by act, not an annotation"})
+	summary := r.annotationSummary()
+	// the dropped annotations are counted too
+	assert.Equal(t, "Annotations: 1 error(s), 0 warning(s), 55 notice(s)", summary[0])
+	assert.Equal(t, "6 more annotation(s) are omitted, only the first 50 are kept", summary[len(summary)-1])
+}
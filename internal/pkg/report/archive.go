@@ -0,0 +1,267 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package report
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	runnerv1 "code.gitea.io/actions-proto-go/runner/v1"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"gitea.com/gitea/act_runner/internal/pkg/config"
+)
+
+const archiveFileSuffix = ".jsonl"
+
+// Archive keeps the transcripts of tasks in a local directory, one JSONL file per task.
+// Each line of a file is an ArchiveRecord, the first one describes the task,
+// followed by the log rows and the states of the task in the order they were produced.
+type Archive struct {
+	dir      string
+	compress bool
+	maxAge   time.Duration
+	maxFiles int
+
+	pruneMu sync.Mutex
+}
+
+// ArchiveRecord is a line of an archive file.
+type ArchiveRecord struct {
+	Type string    `json:"type"` // Type is one of "task", "log" and "state".
+	Time time.Time `json:"time"`
+
+	// for "task"
+	TaskID     int64  `json:"task_id,omitempty"`
+	Repository string `json:"repository,omitempty"`
+	Workflow   string `json:"workflow,omitempty"`
+	Job        string `json:"job,omitempty"`
+	RunID      string `json:"run_id,omitempty"`
+
+	// for "log"
+	Index   int64  `json:"index,omitempty"`
+	Content string `json:"content,omitempty"`
+
+	// for "state", the TaskState encoded with protojson
+	State json.RawMessage `json:"state,omitempty"`
+}
+
+func NewArchive(cfg config.Archive) (*Archive, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create archive directory %q: %w", cfg.Dir, err)
+	}
+	return &Archive{
+		dir:      cfg.Dir,
+		compress: cfg.Compress,
+		maxAge:   cfg.MaxAge,
+		maxFiles: cfg.MaxFiles,
+	}, nil
+}
+
+// Create creates the archive file of the task, the old files are pruned according to the retention policy.
+// The file name starts with the creation time, so the files sort chronologically.
+func (a *Archive) Create(task *runnerv1.Task) (*ArchiveWriter, error) {
+	if err := a.Prune(); err != nil {
+		log.WithError(err).Warn("failed to prune archive")
+	}
+
+	now := time.Now()
+	name := fmt.Sprintf("%s-task-%d%s", now.UTC().Format("20060102T150405Z"), task.Id, archiveFileSuffix)
+	if a.compress {
+		name += ".gz"
+	}
+	f, err := os.OpenFile(filepath.Join(a.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &ArchiveWriter{file: f}
+	if a.compress {
+		w.gz = gzip.NewWriter(f)
+		w.buf = bufio.NewWriter(w.gz)
+	} else {
+		w.buf = bufio.NewWriter(f)
+	}
+
+	fields := task.GetContext().GetFields()
+	if err := w.write(&ArchiveRecord{
+		Type:       "task",
+		Time:       now,
+		TaskID:     task.Id,
+		Repository: fields["repository"].GetStringValue(),
+		Workflow:   fields["workflow"].GetStringValue(),
+		Job:        fields["job"].GetStringValue(),
+		RunID:      fields["run_id"].GetStringValue(),
+	}); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Prune removes the files which are older than the max age, and the oldest ones beyond the max number of files.
+func (a *Archive) Prune() error {
+	a.pruneMu.Lock()
+	defer a.pruneMu.Unlock()
+
+	entries, err := os.ReadDir(a.dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && (strings.HasSuffix(entry.Name(), archiveFileSuffix) || strings.HasSuffix(entry.Name(), archiveFileSuffix+".gz")) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for i, name := range names {
+		file := filepath.Join(a.dir, name)
+		expired := a.maxFiles > 0 && len(names)-i > a.maxFiles
+		if !expired && a.maxAge > 0 {
+			if info, err := os.Stat(file); err == nil && time.Since(info.ModTime()) > a.maxAge {
+				expired = true
+			}
+		}
+		if expired {
+			if err := removeIfExists(file); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ArchiveWriter writes the records of a task to its archive file.
+type ArchiveWriter struct {
+	file *os.File
+	gz   *gzip.Writer
+	buf  *bufio.Writer
+}
+
+func (w *ArchiveWriter) write(records ...*ArchiveRecord) error {
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if _, err := w.buf.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	// flush the records, so the file is readable even if the runner stops unexpectedly
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if w.gz != nil {
+		return w.gz.Flush()
+	}
+	return nil
+}
+
+// WriteLogs writes log rows, index is the index of the first row in the log of the task.
+func (w *ArchiveWriter) WriteLogs(index int64, rows []*runnerv1.LogRow) error {
+	records := make([]*ArchiveRecord, 0, len(rows))
+	for i, row := range rows {
+		records = append(records, &ArchiveRecord{
+			Type:    "log",
+			Time:    row.Time.AsTime(),
+			Index:   index + int64(i),
+			Content: row.Content,
+		})
+	}
+	return w.write(records...)
+}
+
+// WriteState writes the state of the task.
+func (w *ArchiveWriter) WriteState(state *runnerv1.TaskState) error {
+	data, err := protojson.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return w.write(&ArchiveRecord{
+		Type:  "state",
+		Time:  time.Now(),
+		State: data,
+	})
+}
+
+func (w *ArchiveWriter) Close() error {
+	var errs []error
+	if w.gz != nil {
+		errs = append(errs, w.gz.Close())
+	}
+	errs = append(errs, w.file.Close())
+	return errors.Join(errs...)
+}
+
+// SetArchive makes the reporter write the log rows and the states of the task to w, it's closed when the reporter is closed.
+func (r *Reporter) SetArchive(w *ArchiveWriter) {
+	r.archive = w
+}
+
+// archiveProgress writes the log rows and the state which haven't been archived yet.
+// It's called before they are reported, so they are archived even if Gitea can't be reached.
+func (r *Reporter) archiveProgress() {
+	r.archiveMu.Lock()
+	defer r.archiveMu.Unlock()
+	if r.archive == nil {
+		return
+	}
+
+	r.stateMu.RLock()
+	index := max(r.archivedRows, r.logOffset)
+	rows := r.logRows[index-r.logOffset:]
+	var state *runnerv1.TaskState
+	if !proto.Equal(r.state, r.archivedState) {
+		state = proto.Clone(r.state).(*runnerv1.TaskState)
+	}
+	r.stateMu.RUnlock()
+
+	err := r.archive.WriteLogs(int64(index), rows)
+	if err == nil && state != nil {
+		err = r.archive.WriteState(state)
+	}
+	if err != nil {
+		log.WithError(err).Warnf("failed to archive task %d, the rest of it won't be archived", r.state.Id)
+		r.closeArchiveLocked()
+		return
+	}
+	r.archivedRows = index + len(rows)
+	if state != nil {
+		r.archivedState = state
+	}
+}
+
+// closeArchive writes what's left and closes the archive file.
+func (r *Reporter) closeArchive() {
+	r.archiveProgress()
+
+	r.archiveMu.Lock()
+	defer r.archiveMu.Unlock()
+	r.closeArchiveLocked()
+}
+
+func (r *Reporter) closeArchiveLocked() {
+	if r.archive == nil {
+		return
+	}
+	if err := r.archive.Close(); err != nil {
+		log.WithError(err).Warnf("failed to close archive of task %d", r.state.Id)
+	}
+	r.archive = nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package report
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	runnerv1 "code.gitea.io/actions-proto-go/runner/v1"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"gitea.com/gitea/act_runner/internal/pkg/client/mocks"
+	"gitea.com/gitea/act_runner/internal/pkg/config"
+)
+
+func TestReporter_Archive(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(map[bool]string{false: "plain", true: "gzip"}[compress], func(t *testing.T) {
+			dir := t.TempDir()
+			archive, err := NewArchive(config.Archive{Dir: dir, Compress: compress})
+			require.NoError(t, err)
+
+			// Gitea can't be reached, but the task is still archived
+			offline := mocks.NewClient(t)
+			offline.On("UpdateLog", mock.Anything, mock.Anything).Return(nil, errors.New("connection refused")).Maybe()
+			offline.On("UpdateTask", mock.Anything, mock.Anything).Return(nil, errors.New("connection refused")).Maybe()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			taskCtx, err := structpb.NewStruct(map[string]interface{}{"repository": "owner/repo", "job": "build"})
+			require.NoError(t, err)
+			task := &runnerv1.Task{Id: 5, Context: taskCtx, Secrets: map[string]string{"TOKEN": "s3cr3t"}}
+			reporter := NewReporter(ctx, cancel, offline, task)
+			w, err := archive.Create(task)
+			require.NoError(t, err)
+			reporter.SetArchive(w)
+			reporter.ResetSteps(1)
+			reporter.Logf("first line")
+			assert.Error(t, reporter.ReportLog(false))
+			require.NoError(t, reporter.Fire(&log.Entry{Message: "token is s3cr3t", Data: map[string]interface{}{"stage": "Pre"}}))
+			cancel()
+			assert.Error(t, reporter.Close("job failed"))
+
+			files, err := filepath.Glob(filepath.Join(dir, "*"))
+			require.NoError(t, err)
+			require.Len(t, files, 1)
+			assert.Equal(t, compress, filepath.Ext(files[0]) == ".gz")
+			f, err := os.Open(files[0])
+			require.NoError(t, err)
+			defer f.Close()
+			records, err := readArchive(f, compress)
+			require.NoError(t, err)
+
+			var types, rows []string
+			for _, record := range records {
+				types = append(types, record.Type)
+				if record.Type == "log" {
+					rows = append(rows, record.Content)
+				}
+			}
+			assert.Equal(t, []string{"task", "log", "state", "log", "log", "state"}, types)
+			assert.Equal(t, []string{"first line", "token is ***", "job failed"}, rows)
+			assert.Equal(t, int64(5), records[0].TaskID)
+			assert.Equal(t, "owner/repo", records[0].Repository)
+			assert.Equal(t, int64(2), records[4].Index)
+
+			state := &runnerv1.TaskState{}
+			require.NoError(t, protojson.Unmarshal(records[len(records)-1].State, state))
+			assert.Equal(t, runnerv1.Result_RESULT_FAILURE, state.Result)
+			assert.Equal(t, runnerv1.Result_RESULT_CANCELLED, state.Steps[0].Result)
+		})
+	}
+}
+
+func TestArchive_Prune(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{
+		"20240101T000000Z-task-1.jsonl",
+		"20240102T000000Z-task-2.jsonl.gz",
+		"20240103T000000Z-task-3.jsonl",
+		"20240104T000000Z-task-4.jsonl",
+		"unrelated.txt",
+	}
+	for _, name := range names {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0o600))
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, names[2]), old, old))
+
+	archive, err := NewArchive(config.Archive{Dir: dir, MaxAge: 24 * time.Hour, MaxFiles: 2})
+	require.NoError(t, err)
+	require.NoError(t, archive.Prune())
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	for i := range files {
+		files[i] = filepath.Base(files[i])
+	}
+	assert.Equal(t, []string{"20240104T000000Z-task-4.jsonl", "unrelated.txt"}, files)
+}
+
+// readArchive reads the records of an archive file, which could be gzip-compressed.
+func readArchive(r io.Reader, compressed bool) ([]*ArchiveRecord, error) {
+	if compressed {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	var records []*ArchiveRecord
+	dec := json.NewDecoder(r)
+	for {
+		record := &ArchiveRecord{}
+		if err := dec.Decode(record); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
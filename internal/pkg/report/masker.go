@@ -0,0 +1,152 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package report
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	// minSecretLength is the minimum length of a value to be masked,
+	// shorter values are too likely to be part of unrelated text.
+	minSecretLength = 3
+	// minShiftedLength is the minimum length of the base64 fragments of a secret which doesn't start at a multiple of 3 bytes,
+	// since a short fragment is likely to appear in any base64 text.
+	minShiftedLength = 8
+)
+
+var base64Encodings = []*base64.Encoding{base64.RawStdEncoding, base64.RawURLEncoding}
+
+// Masker replaces secrets in log lines with "***".
+// Besides the secret itself, it masks each line of a multi-line secret, since logs are split into lines,
+// and the common encoded forms of the secret: base64, URL and JSON encoding.
+// Add is not safe to be called concurrently with other methods.
+type Masker struct {
+	values   map[string]struct{}
+	replacer *strings.Replacer
+}
+
+func NewMasker(secrets ...string) *Masker {
+	m := &Masker{
+		values:   map[string]struct{}{},
+		replacer: strings.NewReplacer(),
+	}
+	for _, v := range secrets {
+		m.add(v)
+	}
+	m.build()
+	return m
+}
+
+// Add adds a secret to be masked.
+func (m *Masker) Add(secret string) {
+	if m.add(secret) {
+		m.build()
+	}
+}
+
+// Replace returns s with all secrets masked.
+func (m *Masker) Replace(s string) string {
+	return m.replacer.Replace(s)
+}
+
+// add adds the secret and its variants, and returns whether there is any new value.
+func (m *Masker) add(secret string) bool {
+	n := len(m.values)
+
+	m.addValue(secret)
+	if strings.ContainsAny(secret, "\r\n") {
+		for _, line := range strings.FieldsFunc(secret, func(r rune) bool { return r == '\r' || r == '\n' }) {
+			m.addValue(line)
+			// the indentation of a line is not a secret
+			m.addValue(strings.TrimSpace(line))
+		}
+	}
+
+	return len(m.values) > n
+}
+
+// addValue adds the value and its encoded forms.
+func (m *Masker) addValue(v string) {
+	if len(strings.TrimSpace(v)) < minSecretLength {
+		return
+	}
+	m.values[v] = struct{}{}
+
+	m.values[base64.StdEncoding.EncodeToString([]byte(v))] = struct{}{}
+	for _, enc := range base64Encodings {
+		for _, fragment := range base64Fragments(enc, v) {
+			m.values[fragment] = struct{}{}
+		}
+	}
+
+	if e := url.QueryEscape(v); e != v {
+		m.values[e] = struct{}{}
+	}
+	if e := url.PathEscape(v); e != v {
+		m.values[e] = struct{}{}
+	}
+	for _, escapeHTML := range []bool{false, true} {
+		if e := jsonEscape(v, escapeHTML); e != v {
+			m.values[e] = struct{}{}
+		}
+	}
+}
+
+// jsonEscape returns v encoded as a JSON string without the quotes.
+func jsonEscape(v string, escapeHTML bool) string {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(escapeHTML)
+	_ = enc.Encode(v) // encoding a string never fails
+	b := bytes.TrimSpace(buf.Bytes())
+	return string(b[1 : len(b)-1])
+}
+
+// base64Fragments returns the parts of the base64 encoding of v which only depend on v,
+// when v starts at an offset of 0, 1 or 2 bytes in the encoded data.
+func base64Fragments(enc *base64.Encoding, v string) []string {
+	var fragments []string
+	for offset := 0; offset < 3; offset++ {
+		data := make([]byte, offset, offset+len(v))
+		data = append(data, v...)
+		encoded := enc.EncodeToString(data)
+		// each character encodes 6 bits, keep the ones whose bits are all from v
+		start := (8*offset + 5) / 6
+		end := 8 * len(data) / 6
+		if end <= start {
+			continue
+		}
+		fragment := encoded[start:end]
+		if offset == 0 && len(fragment) >= minSecretLength || len(fragment) >= minShiftedLength {
+			fragments = append(fragments, fragment)
+		}
+	}
+	return fragments
+}
+
+// build creates the replacer, longer values come first so they are masked as a whole.
+func (m *Masker) build() {
+	values := make([]string, 0, len(m.values))
+	for v := range m.values {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if len(values[i]) != len(values[j]) {
+			return len(values[i]) > len(values[j])
+		}
+		return values[i] < values[j]
+	})
+
+	oldnew := make([]string, 0, 2*len(values))
+	for _, v := range values {
+		oldnew = append(oldnew, v, "***")
+	}
+	m.replacer = strings.NewReplacer(oldnew...)
+}
@@ -19,8 +19,12 @@ import (
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"gitea.com/gitea/act_runner/internal/pkg/client"
+	"gitea.com/gitea/act_runner/internal/pkg/metrics"
 )
 
+// maxRecentRows is the number of the reported log rows kept for Logs.
+const maxRecentRows = 1000
+
 type Reporter struct {
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -29,10 +33,10 @@ type Reporter struct {
 	client  client.Client
 	clientM sync.Mutex
 
-	logOffset   int
-	logRows     []*runnerv1.LogRow
-	logReplacer *strings.Replacer
-	oldnew      []string
+	logOffset  int
+	logRows    []*runnerv1.LogRow
+	recentRows []*runnerv1.LogRow // recentRows are the last log rows which have been reported, they are kept for Logs.
+	masker     *Masker
 
 	state   *runnerv1.TaskState
 	stateMu sync.RWMutex
@@ -40,26 +44,44 @@ type Reporter struct {
 
 	debugOutputEnabled  bool
 	stopCommandEndToken string
+
+	annotations      []*Annotation
+	annotationCounts map[string]int // annotationCounts is the number of annotations by level, including the ones over the limit.
+
+	spool      *Spool
+	spoolMu    sync.Mutex
+	spoolFinal bool // spoolFinal is true once the final state has been saved, then it can't be overwritten.
+
+	stepListeners []StepListener
+
+	cancelOnce     sync.Once
+	cancelHandler  func()
+	cancelled      bool         // cancelled is true once Gitea has reported that the task is cancelled.
+	cancelledSteps map[int]bool // cancelledSteps are the steps which have been stopped because of the cancellation.
+
+	archive       *ArchiveWriter
+	archiveMu     sync.Mutex
+	archivedRows  int                 // archivedRows is the number of log rows which have been archived.
+	archivedState *runnerv1.TaskState // archivedState is the last archived state.
 }
 
 func NewReporter(ctx context.Context, cancel context.CancelFunc, client client.Client, task *runnerv1.Task) *Reporter {
-	var oldnew []string
+	var secrets []string
 	if v := task.Context.Fields["token"].GetStringValue(); v != "" {
-		oldnew = append(oldnew, v, "***")
+		secrets = append(secrets, v)
 	}
 	if v := task.Context.Fields["gitea_runtime_token"].GetStringValue(); v != "" {
-		oldnew = append(oldnew, v, "***")
+		secrets = append(secrets, v)
 	}
 	for _, v := range task.Secrets {
-		oldnew = append(oldnew, v, "***")
+		secrets = append(secrets, v)
 	}
 
 	rv := &Reporter{
-		ctx:         ctx,
-		cancel:      cancel,
-		client:      client,
-		oldnew:      oldnew,
-		logReplacer: strings.NewReplacer(oldnew...),
+		ctx:    ctx,
+		cancel: cancel,
+		client: client,
+		masker: NewMasker(secrets...),
 		state: &runnerv1.TaskState{
 			Id: task.Id,
 		},
@@ -72,6 +94,14 @@ func NewReporter(ctx context.Context, cancel context.CancelFunc, client client.C
 	return rv
 }
 
+// SetSpool makes the reporter persist the unsent logs and the state of the task to the spool.
+func (r *Reporter) SetSpool(spool *Spool) {
+	r.spool = spool
+	if spool != nil {
+		spool.own(r.state.Id)
+	}
+}
+
 func (r *Reporter) ResetSteps(l int) {
 	r.stateMu.Lock()
 	defer r.stateMu.Unlock()
@@ -109,6 +139,9 @@ func (r *Reporter) Fire(entry *log.Entry) error {
 	if stage != "Main" {
 		if v, ok := entry.Data["jobResult"]; ok {
 			if jobResult, ok := r.parseResult(v); ok {
+				if r.cancelled {
+					jobResult = runnerv1.Result_RESULT_CANCELLED
+				}
 				r.state.Result = jobResult
 				r.state.StoppedAt = timestamppb.New(timestamp)
 				for _, s := range r.state.Steps {
@@ -128,9 +161,11 @@ func (r *Reporter) Fire(entry *log.Entry) error {
 	}
 
 	var step *runnerv1.StepState
+	var stepIndex int
 	if v, ok := entry.Data["stepNumber"]; ok {
 		if v, ok := v.(int); ok && len(r.state.Steps) > v {
 			step = r.state.Steps[v]
+			stepIndex = v
 		}
 	}
 	if step == nil {
@@ -142,6 +177,7 @@ func (r *Reporter) Fire(entry *log.Entry) error {
 
 	if step.StartedAt == nil {
 		step.StartedAt = timestamppb.New(timestamp)
+		r.notifyStep(stepIndex, step)
 	}
 	if v, ok := entry.Data["raw_output"]; ok {
 		if rawOutput, ok := v.(bool); ok && rawOutput {
@@ -161,14 +197,33 @@ func (r *Reporter) Fire(entry *log.Entry) error {
 			if step.LogLength == 0 {
 				step.LogIndex = int64(r.logOffset + len(r.logRows))
 			}
+			if stepResult == runnerv1.Result_RESULT_FAILURE && r.cancelledSteps[stepIndex] {
+				stepResult = runnerv1.Result_RESULT_CANCELLED
+			}
 			step.Result = stepResult
 			step.StoppedAt = timestamppb.New(timestamp)
+			r.notifyStep(stepIndex, step)
 		}
 	}
 
 	return nil
 }
 
+// StepListener is called when a step starts, and when it finishes with the result set.
+// It's called with the state locked, so it must not block or call the reporter.
+type StepListener func(index int, step *runnerv1.StepState)
+
+// AddStepListener adds a listener of the steps, it should be called before the task runs.
+func (r *Reporter) AddStepListener(l StepListener) {
+	r.stepListeners = append(r.stepListeners, l)
+}
+
+func (r *Reporter) notifyStep(index int, step *runnerv1.StepState) {
+	for _, l := range r.stepListeners {
+		l(index, proto.Clone(step).(*runnerv1.StepState))
+	}
+}
+
 func (r *Reporter) RunDaemon() {
 	if r.closed {
 		return
@@ -179,6 +234,7 @@ func (r *Reporter) RunDaemon() {
 
 	_ = r.ReportLog(false)
 	_ = r.ReportState()
+	r.saveSpool(false)
 
 	time.AfterFunc(time.Second, r.RunDaemon)
 }
@@ -227,47 +283,62 @@ func (r *Reporter) Close(lastWords string) error {
 		if lastWords == "" {
 			lastWords = "Early termination"
 		}
-		for _, v := range r.state.Steps {
-			if v.Result == runnerv1.Result_RESULT_UNSPECIFIED {
-				v.Result = runnerv1.Result_RESULT_CANCELLED
-			}
-		}
-		r.state.Result = runnerv1.Result_RESULT_FAILURE
+		finishState(r.state, runnerv1.Result_RESULT_FAILURE)
 		r.logRows = append(r.logRows, &runnerv1.LogRow{
 			Time:    timestamppb.Now(),
 			Content: lastWords,
 		})
-		r.state.StoppedAt = timestamppb.Now()
 	} else if lastWords != "" {
 		r.logRows = append(r.logRows, &runnerv1.LogRow{
 			Time:    timestamppb.Now(),
 			Content: lastWords,
 		})
 	}
+	for _, line := range r.annotationSummary() {
+		r.logRows = append(r.logRows, &runnerv1.LogRow{
+			Time:    timestamppb.Now(),
+			Content: line,
+		})
+	}
 	r.stateMu.Unlock()
 
-	return retry.Do(func() error {
+	// save the final state before trying to report it, so it won't be lost if the runner stops during retries
+	r.saveSpool(true)
+	r.closeArchive()
+
+	err := retry.Do(func() error {
 		if err := r.ReportLog(true); err != nil {
 			return err
 		}
 		return r.ReportState()
 	}, retry.Context(r.ctx))
+	if r.spool != nil {
+		// the spool is left to be replayed if the final state couldn't be reported
+		if err := r.spool.release(r.state.Id, err == nil); err != nil {
+			log.WithError(err).Warnf("failed to remove spool of task %d", r.state.Id)
+		}
+	}
+	return err
 }
 
 func (r *Reporter) ReportLog(noMore bool) error {
 	r.clientM.Lock()
 	defer r.clientM.Unlock()
 
+	r.archiveProgress()
+
 	r.stateMu.RLock()
 	rows := r.logRows
 	r.stateMu.RUnlock()
 
+	start := time.Now()
 	resp, err := r.client.UpdateLog(r.ctx, connect.NewRequest(&runnerv1.UpdateLogRequest{
 		TaskId: r.state.Id,
 		Index:  int64(r.logOffset),
 		Rows:   rows,
 		NoMore: noMore,
 	}))
+	observeReport("UpdateLog", start, err)
 	if err != nil {
 		return err
 	}
@@ -278,6 +349,10 @@ func (r *Reporter) ReportLog(noMore bool) error {
 	}
 
 	r.stateMu.Lock()
+	r.recentRows = append(r.recentRows, r.logRows[:ack-r.logOffset]...)
+	if n := len(r.recentRows) - maxRecentRows; n > 0 {
+		r.recentRows = r.recentRows[n:]
+	}
 	r.logRows = r.logRows[ack-r.logOffset:]
 	r.logOffset = ack
 	r.stateMu.Unlock()
@@ -293,22 +368,20 @@ func (r *Reporter) ReportState() error {
 	r.clientM.Lock()
 	defer r.clientM.Unlock()
 
+	r.archiveProgress()
+
 	r.stateMu.RLock()
 	state := proto.Clone(r.state).(*runnerv1.TaskState)
 	r.stateMu.RUnlock()
 
-	outputs := make(map[string]string)
-	r.outputs.Range(func(k, v interface{}) bool {
-		if val, ok := v.(string); ok {
-			outputs[k.(string)] = val
-		}
-		return true
-	})
+	outputs := r.pendingOutputs()
 
+	start := time.Now()
 	resp, err := r.client.UpdateTask(r.ctx, connect.NewRequest(&runnerv1.UpdateTaskRequest{
 		State:   state,
 		Outputs: outputs,
 	}))
+	observeReport("UpdateTask", start, err)
 	if err != nil {
 		return err
 	}
@@ -318,7 +391,7 @@ func (r *Reporter) ReportState() error {
 	}
 
 	if resp.Msg.State != nil && resp.Msg.State.Result == runnerv1.Result_RESULT_CANCELLED {
-		r.cancel()
+		r.cancelOnce.Do(r.handleCancel)
 	}
 
 	var noSent []string
@@ -335,6 +408,148 @@ func (r *Reporter) ReportState() error {
 	return nil
 }
 
+// pendingOutputs returns the outputs which haven't been sent.
+func (r *Reporter) pendingOutputs() map[string]string {
+	outputs := make(map[string]string)
+	r.outputs.Range(func(k, v interface{}) bool {
+		if val, ok := v.(string); ok {
+			outputs[k.(string)] = val
+		}
+		return true
+	})
+	return outputs
+}
+
+// saveSpool persists the unsent logs and the state of the task, if the spool is enabled.
+func (r *Reporter) saveSpool(noMore bool) {
+	if r.spool == nil {
+		return
+	}
+
+	r.spoolMu.Lock()
+	defer r.spoolMu.Unlock()
+	if r.spoolFinal {
+		return
+	}
+	r.spoolFinal = noMore
+
+	r.stateMu.RLock()
+	data, err := encodeSpoolRecord(&runnerv1.UpdateLogRequest{
+		TaskId: r.state.Id,
+		Index:  int64(r.logOffset),
+		Rows:   r.logRows,
+		NoMore: noMore,
+	}, &runnerv1.UpdateTaskRequest{
+		State:   r.state,
+		Outputs: r.pendingOutputs(),
+	})
+	r.stateMu.RUnlock()
+
+	if err == nil {
+		err = r.spool.write(r.state.Id, data)
+	}
+	if err != nil {
+		log.WithError(err).Warnf("failed to save spool of task %d", r.state.Id)
+	}
+}
+
+// AddMasks masks the values in the logs from now on, like the secrets resolved by the runner.
+func (r *Reporter) AddMasks(values ...string) {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	for _, v := range values {
+		r.masker.Add(v)
+	}
+}
+
+// SetCancelHandler sets the function called once when Gitea reports that the task is cancelled,
+// by default the context of the task is cancelled.
+func (r *Reporter) SetCancelHandler(f func()) {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	r.cancelHandler = f
+}
+
+func (r *Reporter) handleCancel() {
+	r.stateMu.Lock()
+	r.cancelled = true
+	handler := r.cancelHandler
+	r.stateMu.Unlock()
+
+	if handler != nil {
+		handler()
+		return
+	}
+	r.cancel()
+}
+
+// RunningStep returns the index of the step which has started but not finished, or -1 if there isn't one.
+func (r *Reporter) RunningStep() int {
+	r.stateMu.RLock()
+	defer r.stateMu.RUnlock()
+	for i, step := range r.state.Steps {
+		if step.StartedAt != nil && step.Result == runnerv1.Result_RESULT_UNSPECIFIED {
+			return i
+		}
+	}
+	return -1
+}
+
+// CancelStep marks the step as stopped because of the cancellation, so its failure is reported as cancelled.
+func (r *Reporter) CancelStep(index int) {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	if r.cancelledSteps == nil {
+		r.cancelledSteps = map[int]bool{}
+	}
+	r.cancelledSteps[index] = true
+}
+
+// Cancel cancels the task like Gitea reports that it's cancelled, it's used to cancel a task on the runner side.
+func (r *Reporter) Cancel() {
+	r.cancelOnce.Do(r.handleCancel)
+}
+
+// Logs returns the log rows starting at the index from, and the index of the first returned row.
+// Only the last maxRecentRows rows are kept after being reported, so the returned rows may start after from.
+func (r *Reporter) Logs(from int) ([]*runnerv1.LogRow, int) {
+	r.stateMu.RLock()
+	defer r.stateMu.RUnlock()
+
+	start := r.logOffset - len(r.recentRows)
+	from = max(from, start)
+	var rows []*runnerv1.LogRow
+	if i := from - start; i < len(r.recentRows) {
+		rows = append(rows, r.recentRows[i:]...)
+	}
+	if i := from - r.logOffset; i < len(r.logRows) {
+		rows = append(rows, r.logRows[max(i, 0):]...)
+	}
+	return rows, from
+}
+
+// State returns a copy of the current state of the task.
+func (r *Reporter) State() *runnerv1.TaskState {
+	r.stateMu.RLock()
+	defer r.stateMu.RUnlock()
+	return proto.Clone(r.state).(*runnerv1.TaskState)
+}
+
+// Mask returns s with the secrets of the task masked, like the log lines.
+func (r *Reporter) Mask(s string) string {
+	r.stateMu.RLock()
+	defer r.stateMu.RUnlock()
+	return r.masker.Replace(s)
+}
+
+func observeReport(method string, start time.Time, err error) {
+	status := "success"
+	if err != nil {
+		status = "error"
+	}
+	metrics.ReportDurationSeconds.WithLabelValues(method, status).Observe(time.Since(start).Seconds())
+}
+
 func (r *Reporter) duringSteps() bool {
 	if steps := r.state.Steps; len(steps) == 0 {
 		return false
@@ -367,14 +582,15 @@ func (r *Reporter) parseResult(result interface{}) (runnerv1.Result, bool) {
 
 var cmdRegex = regexp.MustCompile(`^::([^ :]+)( .*)?::(.*)$`)
 
-func (r *Reporter) handleCommand(originalContent, command, parameters, value string) *string {
+func (r *Reporter) handleCommand(originalContent, command, parameters, value string, step int, raw bool) *string {
 	if r.stopCommandEndToken != "" && command != r.stopCommandEndToken {
 		return &originalContent
 	}
 
 	switch command {
 	case "add-mask":
-		r.addMask(value)
+		// the value could be a multi-line secret with escaped line breaks
+		r.addMask(unescapeData(value))
 		return nil
 	case "debug":
 		if r.debugOutputEnabled {
@@ -382,14 +598,12 @@ func (r *Reporter) handleCommand(originalContent, command, parameters, value str
 		}
 		return nil
 
-	case "notice":
-		// Not implemented yet, so just return the original content.
-		return &originalContent
-	case "warning":
-		// Not implemented yet, so just return the original content.
-		return &originalContent
-	case "error":
-		// Not implemented yet, so just return the original content.
+	case "notice", "warning", "error":
+		// act logs the command once more besides the raw output of the step, only the raw output creates an annotation
+		if raw {
+			r.addAnnotation(parseAnnotation(command, parameters, value, step))
+		}
+		// Returning the original content, so it's still visible in the log.
 		return &originalContent
 	case "group":
 		// Returning the original content, because I think the frontend
@@ -413,14 +627,19 @@ func (r *Reporter) parseLogRow(entry *log.Entry) *runnerv1.LogRow {
 
 	matches := cmdRegex.FindStringSubmatch(content)
 	if matches != nil {
-		if output := r.handleCommand(content, matches[1], matches[2], matches[3]); output != nil {
+		step := -1
+		if v, ok := entry.Data["stepNumber"].(int); ok {
+			step = v
+		}
+		raw, _ := entry.Data["raw_output"].(bool)
+		if output := r.handleCommand(content, matches[1], matches[2], matches[3], step, raw); output != nil {
 			content = *output
 		} else {
 			return nil
 		}
 	}
 
-	content = r.logReplacer.Replace(content)
+	content = r.masker.Replace(content)
 
 	return &runnerv1.LogRow{
 		Time:    timestamppb.New(entry.Time),
@@ -429,6 +648,5 @@ func (r *Reporter) parseLogRow(entry *log.Entry) *runnerv1.LogRow {
 }
 
 func (r *Reporter) addMask(msg string) {
-	r.oldnew = append(r.oldnew, msg, "***")
-	r.logReplacer = strings.NewReplacer(r.oldnew...)
+	r.masker.Add(msg)
 }
@@ -5,7 +5,7 @@ package report
 
 import (
 	"context"
-	"strings"
+	"fmt"
 	"testing"
 
 	runnerv1 "code.gitea.io/actions-proto-go/runner/v1"
@@ -138,7 +138,7 @@ func TestReporter_parseLogRow(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			r := &Reporter{
-				logReplacer:        strings.NewReplacer(),
+				masker:             NewMasker(),
 				debugOutputEnabled: tt.debugOutputEnabled,
 			}
 			for idx, arg := range tt.args {
@@ -195,3 +195,102 @@ func TestReporter_Fire(t *testing.T) {
 		assert.Equal(t, int64(3), reporter.state.Steps[0].LogLength)
 	})
 }
+
+func TestReporter_StepListener(t *testing.T) {
+	r := &Reporter{masker: NewMasker(), state: &runnerv1.TaskState{}}
+	r.ResetSteps(2)
+
+	var events []string
+	r.AddStepListener(func(index int, step *runnerv1.StepState) {
+		events = append(events, fmt.Sprintf("%d %s", index, step.Result))
+	})
+
+	step := func(i int) map[string]interface{} {
+		return map[string]interface{}{"stage": "Main", "stepNumber": i, "raw_output": true}
+	}
+	require.NoError(t, r.Fire(&log.Entry{Message: "hello", Data: step(0)}))
+	require.NoError(t, r.Fire(&log.Entry{Message: "world", Data: step(0)}))
+	require.NoError(t, r.Fire(&log.Entry{Data: map[string]interface{}{"stage": "Main", "stepNumber": 0, "stepResult": "success"}}))
+	require.NoError(t, r.Fire(&log.Entry{Data: map[string]interface{}{"stage": "Main", "stepNumber": 1, "stepResult": "failure"}}))
+
+	assert.Equal(t, []string{
+		"0 RESULT_UNSPECIFIED",
+		"0 RESULT_SUCCESS",
+		"1 RESULT_UNSPECIFIED",
+		"1 RESULT_FAILURE",
+	}, events)
+}
+
+func TestReporter_CancelHandler(t *testing.T) {
+	r := &Reporter{masker: NewMasker(), state: &runnerv1.TaskState{}}
+	r.ResetSteps(3)
+
+	cancelled := 0
+	r.SetCancelHandler(func() { cancelled++ })
+	r.cancelOnce.Do(r.handleCancel)
+	r.cancelOnce.Do(r.handleCancel)
+	assert.Equal(t, 1, cancelled)
+
+	step := func(i int) map[string]interface{} {
+		return map[string]interface{}{"stage": "Main", "stepNumber": i, "raw_output": true}
+	}
+	assert.Equal(t, -1, r.RunningStep())
+	require.NoError(t, r.Fire(&log.Entry{Message: "running", Data: step(0)}))
+	assert.Equal(t, 0, r.RunningStep())
+
+	// the failure of a stopped step is reported as cancelled
+	r.CancelStep(0)
+	require.NoError(t, r.Fire(&log.Entry{Data: map[string]interface{}{"stage": "Main", "stepNumber": 0, "stepResult": "failure"}}))
+	require.NoError(t, r.Fire(&log.Entry{Data: map[string]interface{}{"stage": "Main", "stepNumber": 1, "stepResult": "skipped"}}))
+	require.NoError(t, r.Fire(&log.Entry{Message: "cleaning up", Data: step(2)}))
+	require.NoError(t, r.Fire(&log.Entry{Data: map[string]interface{}{"stage": "Main", "stepNumber": 2, "stepResult": "success"}}))
+	require.NoError(t, r.Fire(&log.Entry{Data: map[string]interface{}{"stage": "Post", "jobResult": "failure"}}))
+
+	assert.Equal(t, runnerv1.Result_RESULT_CANCELLED, r.state.Steps[0].Result)
+	assert.Equal(t, runnerv1.Result_RESULT_SKIPPED, r.state.Steps[1].Result)
+	assert.Equal(t, runnerv1.Result_RESULT_SUCCESS, r.state.Steps[2].Result)
+	assert.Equal(t, runnerv1.Result_RESULT_CANCELLED, r.state.Result)
+}
+
+func TestReporter_Logs(t *testing.T) {
+	client := mocks.NewClient(t)
+	client.On("UpdateLog", mock.Anything, mock.Anything).Return(func(_ context.Context, req *connect_go.Request[runnerv1.UpdateLogRequest]) (*connect_go.Response[runnerv1.UpdateLogResponse], error) {
+		return connect_go.NewResponse(&runnerv1.UpdateLogResponse{
+			AckIndex: req.Msg.Index + int64(len(req.Msg.Rows)),
+		}), nil
+	})
+	r := &Reporter{ctx: context.Background(), client: client, masker: NewMasker(), state: &runnerv1.TaskState{}}
+	contents := func(rows []*runnerv1.LogRow) []string {
+		var ret []string
+		for _, row := range rows {
+			ret = append(ret, row.Content)
+		}
+		return ret
+	}
+
+	r.Logf("line 0")
+	r.Logf("line 1")
+	require.NoError(t, r.ReportLog(false))
+	r.Logf("line 2")
+
+	// both the reported rows and the unsent ones are returned
+	rows, start := r.Logs(0)
+	assert.Equal(t, 0, start)
+	assert.Equal(t, []string{"line 0", "line 1", "line 2"}, contents(rows))
+	rows, start = r.Logs(2)
+	assert.Equal(t, 2, start)
+	assert.Equal(t, []string{"line 2"}, contents(rows))
+	rows, start = r.Logs(3)
+	assert.Equal(t, 3, start)
+	assert.Empty(t, rows)
+
+	// only the last rows are kept after being reported
+	for i := 3; i < maxRecentRows+5; i++ {
+		r.Logf("line %d", i)
+	}
+	require.NoError(t, r.ReportLog(false))
+	rows, start = r.Logs(0)
+	assert.Equal(t, 5, start)
+	require.Len(t, rows, maxRecentRows)
+	assert.Equal(t, "line 5", rows[0].Content)
+}
@@ -0,0 +1,301 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	runnerv1 "code.gitea.io/actions-proto-go/runner/v1"
+	"connectrpc.com/connect"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"gitea.com/gitea/act_runner/internal/pkg/client"
+)
+
+const spoolFileSuffix = ".json"
+
+// Spool persists the unsent logs and the state of tasks to a directory,
+// so they can be replayed to Gitea after an outage or a restart of the runner.
+type Spool struct {
+	dir string
+
+	mu    sync.Mutex
+	owned map[int64]bool // owned has the IDs of the tasks whose reporters are still writing or reporting their spool files.
+}
+
+// spoolRecord is the content of a spool file, the requests are encoded with protojson.
+type spoolRecord struct {
+	Log  json.RawMessage `json:"log"`
+	Task json.RawMessage `json:"task"`
+}
+
+func NewSpool(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create spool directory %q: %w", dir, err)
+	}
+	return &Spool{dir: dir, owned: map[int64]bool{}}, nil
+}
+
+func (s *Spool) path(taskID int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("task-%d%s", taskID, spoolFileSuffix))
+}
+
+func encodeSpoolRecord(logReq *runnerv1.UpdateLogRequest, taskReq *runnerv1.UpdateTaskRequest) ([]byte, error) {
+	logData, err := protojson.Marshal(logReq)
+	if err != nil {
+		return nil, err
+	}
+	taskData, err := protojson.Marshal(taskReq)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&spoolRecord{Log: logData, Task: taskData})
+}
+
+// write replaces the spool file of the task atomically.
+func (s *Spool) write(taskID int64, data []byte) error {
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(taskID))
+}
+
+// own marks the spool file of the task as owned by its reporter, so it isn't replayed while the reporter is live.
+func (s *Spool) own(taskID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.owned[taskID] = true
+}
+
+// release deletes the spool file of the task if remove is true, and lets it be replayed if it's kept.
+// It's not an error if the file doesn't exist.
+func (s *Spool) release(taskID int64, remove bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.owned, taskID)
+	if !remove {
+		return nil
+	}
+	return removeIfExists(s.path(taskID))
+}
+
+// loadUnowned loads the spool file if it isn't owned by a live reporter, ok is false if it's owned.
+// The file is loaded while holding the lock, so it's never one which its reporter is about to remove.
+func (s *Spool) loadUnowned(file string) (logReq *runnerv1.UpdateLogRequest, taskReq *runnerv1.UpdateTaskRequest, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	logReq, taskReq, err = s.load(file)
+	if err == nil && s.owned[logReq.TaskId] {
+		return nil, nil, false, nil
+	}
+	return logReq, taskReq, true, err
+}
+
+func removeIfExists(file string) error {
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *Spool) load(file string) (*runnerv1.UpdateLogRequest, *runnerv1.UpdateTaskRequest, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	var record spoolRecord
+	if err := json.Unmarshal(content, &record); err != nil {
+		return nil, nil, err
+	}
+	logReq := &runnerv1.UpdateLogRequest{}
+	if err := protojson.Unmarshal(record.Log, logReq); err != nil {
+		return nil, nil, err
+	}
+	taskReq := &runnerv1.UpdateTaskRequest{}
+	if err := protojson.Unmarshal(record.Task, taskReq); err != nil {
+		return nil, nil, err
+	}
+	if taskReq.State == nil {
+		taskReq.State = &runnerv1.TaskState{Id: logReq.TaskId}
+	}
+	return logReq, taskReq, nil
+}
+
+// files returns the spool files in the directory.
+func (s *Spool) files() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !strings.HasSuffix(entry.Name(), spoolFileSuffix) {
+			continue
+		}
+		files = append(files, filepath.Join(s.dir, entry.Name()))
+	}
+	return files, nil
+}
+
+// Replay sends the spooled logs and states to Gitea, and removes the spool files which have been flushed.
+// Spools owned by live reporters are always skipped.
+// Spools of tasks which are still running are skipped unless unfinished is true,
+// in which case those tasks are reported as failed, it should only be done when no task is running.
+func (s *Spool) Replay(ctx context.Context, cli client.Client, unfinished bool) error {
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	_, err = s.replayFiles(ctx, cli, files, unfinished)
+	return err
+}
+
+// replayFiles replays the files and returns the ones which failed.
+func (s *Spool) replayFiles(ctx context.Context, cli client.Client, files []string, unfinished bool) ([]string, error) {
+	var failed []string
+	var errs []error
+	for _, file := range files {
+		if err := s.replayFile(ctx, cli, file, unfinished); err != nil {
+			failed = append(failed, file)
+			errs = append(errs, fmt.Errorf("replay %q: %w", file, err))
+		}
+	}
+	return failed, errors.Join(errs...)
+}
+
+func (s *Spool) replayFile(ctx context.Context, cli client.Client, file string, unfinished bool) error {
+	logReq, taskReq, ok, err := s.loadUnowned(file)
+	if !ok {
+		// its reporter is still reporting it, like retrying the final state
+		return nil
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			// it has been flushed by the reporter
+			return nil
+		}
+		log.WithError(err).Warnf("remove corrupted spool file %q", file)
+		return removeIfExists(file)
+	}
+
+	if !logReq.NoMore {
+		if !unfinished {
+			return nil
+		}
+		finishState(taskReq.State, runnerv1.Result_RESULT_FAILURE)
+		logReq.Rows = append(logReq.Rows, &runnerv1.LogRow{
+			Time:    timestamppb.Now(),
+			Content: "The runner was stopped before the task finished",
+		})
+		logReq.NoMore = true
+	}
+
+	log.Infof("replaying spooled logs and state of task %d", logReq.TaskId)
+	err = flushLog(ctx, cli, logReq)
+	if err == nil {
+		_, err = cli.UpdateTask(ctx, connect.NewRequest(taskReq))
+	}
+	if err != nil {
+		if !isPermanentError(err) {
+			return err
+		}
+		log.WithError(err).Warnf("give up replaying task %d", logReq.TaskId)
+	}
+	return removeIfExists(file)
+}
+
+// flushLog sends the log rows until all of them have been acknowledged.
+func flushLog(ctx context.Context, cli client.Client, req *runnerv1.UpdateLogRequest) error {
+	for {
+		resp, err := cli.UpdateLog(ctx, connect.NewRequest(req))
+		if err != nil {
+			return err
+		}
+		ack := resp.Msg.AckIndex
+		if ack < req.Index {
+			log.Warnf("logs of task %d before index %d are lost", req.TaskId, req.Index)
+			return nil
+		}
+		if ack >= req.Index+int64(len(req.Rows)) {
+			return nil
+		}
+		req.Rows = req.Rows[ack-req.Index:]
+		req.Index = ack
+	}
+}
+
+func isPermanentError(err error) bool {
+	switch connect.CodeOf(err) {
+	case connect.CodeNotFound, connect.CodeInvalidArgument, connect.CodeFailedPrecondition:
+		return true
+	}
+	return false
+}
+
+// Start replays the spool in background until ctx is done.
+// The spools found when it's called belong to tasks which can't be running anymore, so they are reported as failed if they haven't finished.
+// After that, only the spools of finished tasks are retried periodically.
+func (s *Spool) Start(ctx context.Context, cli client.Client, interval time.Duration) error {
+	orphans, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			var err error
+			if orphans, err = s.replayFiles(ctx, cli, orphans, true); err != nil {
+				log.WithError(err).Warn("failed to replay spool")
+			}
+			if err := s.Replay(ctx, cli, false); err != nil {
+				log.WithError(err).Warn("failed to replay spool")
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+	return nil
+}
+
+// finishState sets the result of the task and of its steps which haven't finished.
+func finishState(state *runnerv1.TaskState, result runnerv1.Result) {
+	if state.Result != runnerv1.Result_RESULT_UNSPECIFIED {
+		return
+	}
+	for _, v := range state.Steps {
+		if v.Result == runnerv1.Result_RESULT_UNSPECIFIED {
+			v.Result = runnerv1.Result_RESULT_CANCELLED
+		}
+	}
+	state.Result = result
+	state.StoppedAt = timestamppb.Now()
+}
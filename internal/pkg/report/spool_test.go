@@ -0,0 +1,168 @@
+// Copyright 2024 The Gitea Authors. All rights reserved.
+// SPDX-License-Identifier: MIT
+
+package report
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	runnerv1 "code.gitea.io/actions-proto-go/runner/v1"
+	connect_go "connectrpc.com/connect"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"gitea.com/gitea/act_runner/internal/pkg/client/mocks"
+)
+
+// recordingClient returns a client which acknowledges and records all logs and states.
+func recordingClient(t *testing.T, rows *[]string, states *[]*runnerv1.TaskState) *mocks.Client {
+	client := mocks.NewClient(t)
+	client.On("UpdateLog", mock.Anything, mock.Anything).Return(func(_ context.Context, req *connect_go.Request[runnerv1.UpdateLogRequest]) (*connect_go.Response[runnerv1.UpdateLogResponse], error) {
+		for _, row := range req.Msg.Rows[len(*rows)-int(req.Msg.Index):] {
+			*rows = append(*rows, row.Content)
+		}
+		return connect_go.NewResponse(&runnerv1.UpdateLogResponse{
+			AckIndex: int64(len(*rows)),
+		}), nil
+	}).Maybe()
+	client.On("UpdateTask", mock.Anything, mock.Anything).Return(func(_ context.Context, req *connect_go.Request[runnerv1.UpdateTaskRequest]) (*connect_go.Response[runnerv1.UpdateTaskResponse], error) {
+		*states = append(*states, req.Msg.State)
+		return connect_go.NewResponse(&runnerv1.UpdateTaskResponse{}), nil
+	}).Maybe()
+	return client
+}
+
+func TestSpool_ReplayFinishedTask(t *testing.T) {
+	spool, err := NewSpool(t.TempDir())
+	require.NoError(t, err)
+
+	// Gitea is down, and the task context ends before the logs could be reported
+	offline := mocks.NewClient(t)
+	offline.On("UpdateLog", mock.Anything, mock.Anything).Return(nil, errors.New("connection refused")).Maybe()
+	offline.On("UpdateTask", mock.Anything, mock.Anything).Return(nil, errors.New("connection refused")).Maybe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	taskCtx, err := structpb.NewStruct(map[string]interface{}{})
+	require.NoError(t, err)
+	reporter := NewReporter(ctx, cancel, offline, &runnerv1.Task{Id: 42, Context: taskCtx})
+	reporter.SetSpool(spool)
+	reporter.ResetSteps(1)
+	reporter.Logf("first line")
+	reporter.Logf("second line")
+	cancel()
+	assert.Error(t, reporter.Close("job failed"))
+	assert.FileExists(t, spool.path(42))
+
+	// spools of finished tasks are replayed even if unfinished is false
+	var rows []string
+	var states []*runnerv1.TaskState
+	require.NoError(t, spool.Replay(context.Background(), recordingClient(t, &rows, &states), false))
+
+	assert.Equal(t, []string{"first line", "second line", "job failed"}, rows)
+	require.Len(t, states, 1)
+	assert.Equal(t, int64(42), states[0].Id)
+	assert.Equal(t, runnerv1.Result_RESULT_FAILURE, states[0].Result)
+	assert.Equal(t, runnerv1.Result_RESULT_CANCELLED, states[0].Steps[0].Result)
+	assert.NoFileExists(t, spool.path(42))
+}
+
+func TestSpool_ReplayUnfinishedTask(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := NewSpool(dir)
+	require.NoError(t, err)
+
+	// the runner crashes while the task is running
+	var sent []string
+	var sentStates []*runnerv1.TaskState
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	taskCtx, err := structpb.NewStruct(map[string]interface{}{})
+	require.NoError(t, err)
+	reporter := NewReporter(ctx, cancel, recordingClient(t, &sent, &sentStates), &runnerv1.Task{Id: 7, Context: taskCtx})
+	reporter.SetSpool(spool)
+	reporter.ResetSteps(2)
+	reporter.Logf("sent line")
+	require.NoError(t, reporter.ReportLog(false))
+	require.NoError(t, reporter.Fire(&log.Entry{Message: "pending line", Data: map[string]interface{}{
+		"stage":      "Main",
+		"stepNumber": 0,
+		"raw_output": true,
+	}}))
+	reporter.saveSpool(false)
+
+	var rows []string
+	var states []*runnerv1.TaskState
+	cli := recordingClient(t, &rows, &states)
+	rows = append(rows, "sent line")
+
+	// it could be still running, so it's skipped
+	require.NoError(t, spool.Replay(context.Background(), cli, false))
+	assert.FileExists(t, spool.path(7))
+	assert.Empty(t, states)
+
+	// the runner is restarted
+	spool, err = NewSpool(dir)
+	require.NoError(t, err)
+	require.NoError(t, spool.Replay(context.Background(), cli, true))
+	assert.Equal(t, []string{"sent line", "pending line", "The runner was stopped before the task finished"}, rows)
+	require.Len(t, states, 1)
+	assert.Equal(t, runnerv1.Result_RESULT_FAILURE, states[0].Result)
+	assert.Equal(t, runnerv1.Result_RESULT_CANCELLED, states[0].Steps[0].Result)
+	assert.Equal(t, runnerv1.Result_RESULT_CANCELLED, states[0].Steps[1].Result)
+	assert.NoFileExists(t, spool.path(7))
+}
+
+func TestSpool_ReplayOwnedByReporter(t *testing.T) {
+	spool, err := NewSpool(t.TempDir())
+	require.NoError(t, err)
+
+	var sent []string
+	var sentStates []*runnerv1.TaskState
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	taskCtx, err := structpb.NewStruct(map[string]interface{}{})
+	require.NoError(t, err)
+	reporter := NewReporter(ctx, cancel, recordingClient(t, &sent, &sentStates), &runnerv1.Task{Id: 3, Context: taskCtx})
+	reporter.SetSpool(spool)
+	reporter.ResetSteps(1)
+	reporter.Logf("final line")
+	// the final state is saved, and the reporter is retrying to report it
+	reporter.saveSpool(true)
+
+	var rows []string
+	var states []*runnerv1.TaskState
+	cli := recordingClient(t, &rows, &states)
+	require.NoError(t, spool.Replay(context.Background(), cli, false))
+	require.NoError(t, spool.Replay(context.Background(), cli, true))
+	assert.FileExists(t, spool.path(3))
+	assert.Empty(t, rows)
+	assert.Empty(t, states)
+
+	require.NoError(t, reporter.Close(""))
+	assert.NoFileExists(t, spool.path(3))
+	require.NoError(t, spool.Replay(context.Background(), cli, true))
+	assert.Empty(t, states)
+}
+
+func TestSpool_ReplayPermanentError(t *testing.T) {
+	spool, err := NewSpool(t.TempDir())
+	require.NoError(t, err)
+	data, err := encodeSpoolRecord(&runnerv1.UpdateLogRequest{TaskId: 1, NoMore: true}, &runnerv1.UpdateTaskRequest{})
+	require.NoError(t, err)
+	require.NoError(t, spool.write(1, data))
+	require.NoError(t, os.WriteFile(spool.path(2), []byte("corrupted"), 0o600))
+
+	client := mocks.NewClient(t)
+	client.On("UpdateLog", mock.Anything, mock.Anything).Return(nil, connect_go.NewError(connect_go.CodeNotFound, errors.New("task not found")))
+	require.NoError(t, spool.Replay(context.Background(), client, true))
+
+	files, err := spool.files()
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
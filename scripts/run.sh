@@ -23,33 +23,17 @@ if [[ -z "${GITEA_RUNNER_REGISTRATION_TOKEN}" ]] && [[ -f "${GITEA_RUNNER_REGIST
 fi
 
 # Use the same ENV variable names as https://github.com/vegardit/docker-gitea-act-runner
-test -f "$RUNNER_STATE_FILE" || echo "$RUNNER_STATE_FILE is missing or not a regular file"
-
+# The default name is the hostname, which changes with each container, so only register if the state file is missing.
+# It waits for gitea to become available with backoff, which is handy when running both act_runner and gitea in docker.
 if [[ ! -s "$RUNNER_STATE_FILE" ]]; then
-  try=$((try + 1))
-  success=0
-
-  # The point of this loop is to make it simple, when running both act_runner and gitea in docker,
-  # for the act_runner to wait a moment for gitea to become available before erroring out.  Within
-  # the context of a single docker-compose, something similar could be done via healthchecks, but
-  # this is more flexible.
-  while [[ $success -eq 0 ]] && [[ $try -lt ${GITEA_MAX_REG_ATTEMPTS:-10} ]]; do
-    act_runner register \
-      --instance "${GITEA_INSTANCE_URL}" \
-      --token    "${GITEA_RUNNER_REGISTRATION_TOKEN}" \
-      --name     "${GITEA_RUNNER_NAME:-`hostname`}" \
-      ${CONFIG_ARG} ${EXTRA_ARGS} --no-interactive 2>&1 | tee /tmp/reg.log
-
-    cat /tmp/reg.log | grep 'Runner registered successfully' > /dev/null
-    if [[ $? -eq 0 ]]; then
-      echo "SUCCESS"
-      success=1
-    else
-      echo "Waiting to retry ..."
-      sleep 5
-    fi
-  done
+  act_runner register --bootstrap \
+    --instance     "${GITEA_INSTANCE_URL}" \
+    --token        "${GITEA_RUNNER_REGISTRATION_TOKEN}" \
+    --name         "${GITEA_RUNNER_NAME:-`hostname`}" \
+    --max-attempts "${GITEA_MAX_REG_ATTEMPTS:-10}" \
+    ${CONFIG_ARG} ${EXTRA_ARGS} || exit $?
 fi
+
 # Prevent reading the token from the act_runner process
 unset GITEA_RUNNER_REGISTRATION_TOKEN
 unset GITEA_RUNNER_REGISTRATION_TOKEN_FILE